@@ -0,0 +1,13 @@
+#!/bin/sh
+# Runs a benchmark of tests/ against the test database and records its output in benchmarks/<name>_bench.txt,
+# e.g. benchmarks/run.sh DictionaryEncoding. The extra arguments are passed to go test.
+set -eu
+
+name=${1:?usage: benchmarks/run.sh <benchmark name without the Benchmark prefix> [go test flags]}
+shift
+dir=$(cd "$(dirname "$0")" && pwd)
+output="$dir/$(echo "$name" | sed 's/\([a-z0-9]\)\([A-Z]\)/\1_\2/g' | tr '[:upper:]' '[:lower:]')_bench.txt"
+
+cd "$dir/../tests"
+go test -run '^$' -bench "^Benchmark$name\$" -benchtime=1x -count=5 "$@" | tee "$output"
+echo "Recorded in $output"
@@ -1,6 +1,10 @@
 package config
 
-import "os"
+import (
+	"os"
+	"strconv"
+	"time"
+)
 
 const (
 	TOKEN_EXPIRATION_MINS = 60
@@ -10,6 +14,57 @@ const (
 	SERVER_PORT_DEFAULT = "8080"
 )
 
+const (
+	// Number of parsing goroutines used for a single log file outside of the queue (e.g. streamed uploads)
+	PROCESSOR_NUM_WORKERS = 12
+
+	MAX_CONCURRENT_FILES_DEFAULT = 2
+	// Parsing goroutines shared by all the files processed at the same time by the queue
+	WORKER_BUDGET_DEFAULT = 12
+	// Processing attempts of a log file before transient errors fail it for good
+	MAX_ATTEMPTS_DEFAULT = 5
+
+	// Pending files are normally picked up as soon as they are notified,
+	// polling only catches up on missed notifications and retries coming due
+	PENDING_POLL_INTERVAL = time.Minute
+	// Processing files whose lease expired are returned to the queue by a scheduled job
+	REAP_LEASES_INTERVAL = time.Minute
+	// Deleted log files and domains are removed in the background by a scheduled job
+	PURGE_DELETED_INTERVAL = time.Minute
+	// Scheduled jobs runs are kept this long
+	JOB_RUNS_RETENTION = 30 * 24 * time.Hour
+
+	SHUTDOWN_TIMEOUT_SECS_DEFAULT = 30
+
+	// Upload priorities range from -MAX_FILE_PRIORITY to MAX_FILE_PRIORITY, 0 by default
+	MAX_FILE_PRIORITY = 10
+
+	// log_entries is partitioned by the entries timestamp, one partition per month, week or day
+	PARTITION_INTERVAL_DEFAULT = "month"
+	// Partitions created in advance by the maintenance job, past the current one
+	PARTITIONS_AHEAD = 3
+
+	// Secondary indexes of new log_entries partitions are created with them, or deferred to the indexes job
+	ENTRY_INDEXES_MODE_DEFAULT = "immediate"
+	// The indexes job builds the missing indexes of the partitions, without blocking the ingestion
+	BUILD_ENTRY_INDEXES_INTERVAL = 15 * time.Minute
+
+	// Distinct lines of a file remembered to detect duplicate lines, a few tens of bytes each.
+	// Past it, only the duplicates of the remembered lines are counted.
+	DUPLICATE_LINES_TRACKED_DEFAULT = 1000000
+
+	// Rows deleted per statement by the retention job, so purging doesn't hold long locks
+	RETENTION_BATCH_SIZE = 10000
+
+	// Local directory of the entries archives, when they aren't stored in S3
+	ARCHIVE_DIR_DEFAULT       = "archives"
+	ARCHIVE_S3_REGION_DEFAULT = "us-east-1"
+	// Restored days are left out of the archive job this long, then archived again
+	ARCHIVE_RESTORE_KEEP_DAYS_DEFAULT = 7
+	// Pending archive restores are picked up by a scheduled job
+	RESTORE_ARCHIVES_INTERVAL = time.Minute
+)
+
 func GetServerPortOrDefault() string {
 	serverPort := os.Getenv("SERVER_PORT")
 	if serverPort == "" {
@@ -17,3 +72,141 @@ func GetServerPortOrDefault() string {
 	}
 	return serverPort
 }
+
+// Root directory under which domains are allowed to follow log files, follow mode is disabled if empty
+func GetFollowRootDir() string {
+	return os.Getenv("FOLLOW_ROOT_DIR")
+}
+
+// Maximum number of pending log files processed at the same time by this instance
+func GetMaxConcurrentFilesOrDefault() int {
+	return getPositiveIntOrDefault("MAX_CONCURRENT_FILES", MAX_CONCURRENT_FILES_DEFAULT)
+}
+
+func GetWorkerBudgetOrDefault() int {
+	return getPositiveIntOrDefault("WORKER_BUDGET", WORKER_BUDGET_DEFAULT)
+}
+
+func getPositiveIntOrDefault(env string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(env))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+func GetMaxAttemptsOrDefault() int {
+	return getPositiveIntOrDefault("MAX_ATTEMPTS", MAX_ATTEMPTS_DEFAULT)
+}
+
+// Time given to in-flight requests and files being processed to finish on SIGINT or SIGTERM
+func GetShutdownTimeoutOrDefault() time.Duration {
+	return time.Duration(getPositiveIntOrDefault("SHUTDOWN_TIMEOUT_SECS", SHUTDOWN_TIMEOUT_SECS_DEFAULT)) * time.Second
+}
+
+// Range of the log_entries partitions: "month", "week" or "day".
+// It only applies to partitions created from then on, the ranges of existing partitions must not overlap with the new ones.
+func GetPartitionIntervalOrDefault() string {
+	switch interval := os.Getenv("PARTITION_INTERVAL"); interval {
+	case "month", "week", "day":
+		return interval
+	default:
+		return PARTITION_INTERVAL_DEFAULT
+	}
+}
+
+// When the secondary indexes of a new log_entries partition are created: "immediate" creates them with the partition,
+// "deferred" leaves them to the indexes job, once no file is being processed, so bulk loads into new partitions don't maintain them.
+func GetEntryIndexesModeOrDefault() string {
+	switch mode := os.Getenv("ENTRY_INDEXES_MODE"); mode {
+	case "immediate", "deferred":
+		return mode
+	default:
+		return ENTRY_INDEXES_MODE_DEFAULT
+	}
+}
+
+// Distinct lines remembered per file to count the duplicate lines, 0 disables the detection
+func GetDuplicateLinesTrackedOrDefault() int {
+	return getNonNegativeIntOrDefault("DUPLICATE_LINES_TRACKED", DUPLICATE_LINES_TRACKED_DEFAULT)
+}
+
+// Retention periods in days applied to the domains that don't set their own, 0 keeps the data forever
+func GetEntriesRetentionDays() int {
+	return getNonNegativeIntOrDefault("ENTRIES_RETENTION_DAYS", 0)
+}
+
+// Uploaded files kept in uploaded_logs for reprocessing
+func GetFilesRetentionDays() int {
+	return getNonNegativeIntOrDefault("FILES_RETENTION_DAYS", 0)
+}
+
+// Per file stats, summaries and aggregates
+func GetSummariesRetentionDays() int {
+	return getNonNegativeIntOrDefault("SUMMARIES_RETENTION_DAYS", 0)
+}
+
+func getNonNegativeIntOrDefault(env string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(env))
+	if err != nil || value < 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// Entries older than this many days are moved to the archives, for the domains that don't set their own, 0 never archives them
+func GetArchiveAfterDays() int {
+	return getNonNegativeIntOrDefault("ARCHIVE_AFTER_DAYS", 0)
+}
+
+func GetArchiveDirOrDefault() string {
+	if dir := os.Getenv("ARCHIVE_DIR"); dir != "" {
+		return dir
+	}
+	return ARCHIVE_DIR_DEFAULT
+}
+
+func GetArchiveRestoreKeepDaysOrDefault() int {
+	return getPositiveIntOrDefault("ARCHIVE_RESTORE_KEEP_DAYS", ARCHIVE_RESTORE_KEEP_DAYS_DEFAULT)
+}
+
+// ArchiveS3Config is the S3-compatible store of the entries archives
+type ArchiveS3Config struct {
+	Endpoint  string // e.g. https://s3.eu-west-1.amazonaws.com, objects are addressed path-style
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// GetArchiveS3Config returns the S3 store of the archives, and false when ARCHIVE_S3_BUCKET is empty and they are stored in ARCHIVE_DIR
+func GetArchiveS3Config() (ArchiveS3Config, bool) {
+	s3 := ArchiveS3Config{
+		Endpoint:  os.Getenv("ARCHIVE_S3_ENDPOINT"),
+		Bucket:    os.Getenv("ARCHIVE_S3_BUCKET"),
+		Region:    os.Getenv("ARCHIVE_S3_REGION"),
+		AccessKey: os.Getenv("ARCHIVE_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("ARCHIVE_S3_SECRET_KEY"),
+	}
+	if s3.Region == "" {
+		s3.Region = ARCHIVE_S3_REGION_DEFAULT
+	}
+	return s3, s3.Bucket != ""
+}
+
+// Default quotas of the users, 0 is unlimited
+func GetQuotaMaxFileSize() int64 {
+	return int64(getNonNegativeIntOrDefault("QUOTA_MAX_FILE_SIZE_MB", 0)) << 20
+}
+
+func GetQuotaMaxStoredBytes() int64 {
+	return int64(getNonNegativeIntOrDefault("QUOTA_MAX_STORED_MB", 0)) << 20
+}
+
+func GetQuotaMaxEntries() int64 {
+	return int64(getNonNegativeIntOrDefault("QUOTA_MAX_ENTRIES", 0))
+}
+
+func GetQuotaMaxUploadsPerDay() int64 {
+	return int64(getNonNegativeIntOrDefault("QUOTA_MAX_UPLOADS_PER_DAY", 0))
+}
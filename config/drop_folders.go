@@ -0,0 +1,72 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	DROP_FOLDER_STABLE_SECS_DEFAULT = 60
+)
+
+// DropFolderRule maps the files of a drop folder to a domain.
+// A pattern containing a "/" is matched against the path relative to the drop folder (e.g. "web01/*.log"),
+// otherwise it's matched against the file name only (e.g. "u_ex*.log").
+type DropFolderRule struct {
+	Pattern  string `json:"pattern"`
+	DomainID uint   `json:"domainId"`
+}
+
+// DropFolder is a directory watched for new log files, files are matched against the rules in order
+type DropFolder struct {
+	Path string `json:"path"`
+	// A file is only ingested once its size and modification time didn't change for this long
+	StableSecs int              `json:"stableSecs"`
+	Rules      []DropFolderRule `json:"rules"`
+}
+
+// LoadDropFolders reads the drop folders from the JSON file at DROP_FOLDERS_CONFIG, returns nil if it's not set
+func LoadDropFolders() ([]DropFolder, error) {
+	configPath := os.Getenv("DROP_FOLDERS_CONFIG")
+	if configPath == "" {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read drop folders config: %w", err)
+	}
+
+	var folders []DropFolder
+	if err := json.Unmarshal(content, &folders); err != nil {
+		return nil, fmt.Errorf("failed to parse drop folders config: %w", err)
+	}
+
+	for i := range folders {
+		if folders[i].Path == "" {
+			return nil, fmt.Errorf("drop folder %d has no path", i)
+		}
+		if folders[i].StableSecs <= 0 {
+			folders[i].StableSecs = DROP_FOLDER_STABLE_SECS_DEFAULT
+		}
+	}
+	return folders, nil
+}
+
+// MatchDomain returns the domain of the first rule matching the file at rel, the path relative to the drop folder
+func (f *DropFolder) MatchDomain(rel string) (uint, bool) {
+	rel = filepath.ToSlash(rel)
+	for _, rule := range f.Rules {
+		name := rel
+		if !strings.Contains(rule.Pattern, "/") {
+			name = filepath.Base(rel)
+		}
+		if ok, _ := filepath.Match(rule.Pattern, name); ok {
+			return rule.DomainID, true
+		}
+	}
+	return 0, false
+}
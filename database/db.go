@@ -1,10 +1,8 @@
 package db
 
 import (
-	"errors"
 	"fmt"
 	gormzerolog "iis-logs-parser/gorm-zerolog"
-	"iis-logs-parser/models"
 	"net/url"
 	"os"
 	"strings"
@@ -17,6 +15,10 @@ import (
 
 var GormDB *gorm.DB
 
+// PendingLogFilesChannel is notified with the id of every log file that becomes pending, once its transaction commits.
+// Its trigger is created by the migrations.
+const PendingLogFilesChannel = "log_files_pending"
+
 type DBConfig struct {
 	Host     string
 	Port     string
@@ -75,6 +77,7 @@ func (c *DBConfig) NoPassDSN() string {
 	return strings.Replace(c.DSN(), url.QueryEscape(c.Password), "****", 1)
 }
 
+// InitGormDB connects GormDB, the schema is created by the migrations, see MigrateUp
 func InitGormDB() {
 	dbConfig, err := LoadConfigFromEnv()
 	if err != nil {
@@ -90,14 +93,4 @@ func InitGormDB() {
 		log.Fatal().Err(err).Msg("DB-GORM: Failed to connect to database")
 	}
 	log.Info().Msg("DB-GORM: Connected to database")
-
-	err = errors.Join(
-		GormDB.AutoMigrate(&models.LogEntry{}),
-		GormDB.AutoMigrate(&models.LogFile{}),
-		GormDB.AutoMigrate(&models.User{}),
-		GormDB.AutoMigrate(&models.Domain{}),
-	)
-	if err != nil {
-		log.Fatal().Err(err).Msg("DB-GORM: Failed to migrate database")
-	}
 }
@@ -0,0 +1,317 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"iis-logs-parser/config"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+// Migrations are named <version>_<name>.up.sql and <version>_<name>.down.sql, and applied in version order
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// MigrationsLockKey is the advisory lock held while migrating, the other instances wait for it then find nothing left to apply
+const MigrationsLockKey = "schema-migrations"
+
+// noTransactionMarker on the first line of a migration runs its statements one by one outside of a transaction,
+// which CREATE INDEX CONCURRENTLY needs. Such a migration must be safe to run again, since a failure leaves it half applied.
+const noTransactionMarker = "-- migrate:no-transaction"
+
+var migrationFileRegexp = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus is a migration along with when it was applied, nil when it's pending
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+	Missing   bool // Applied, but unknown to this build
+}
+
+// LoadMigrations returns the embedded migrations in version order
+func LoadMigrations() ([]Migration, error) {
+	files, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, file := range files {
+		match := migrationFileRegexp.FindStringSubmatch(path.Base(file))
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %s", file)
+		}
+		version, _ := strconv.Atoi(match[1])
+		content, err := migrationFiles.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int { return a.Version - b.Version })
+	return migrations, nil
+}
+
+// MigrateUp applies the pending migrations, and returns how many were applied
+func MigrateUp(ctx context.Context, dbPool *pgxpool.Pool) (int, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	err = withMigrationsLock(ctx, dbPool, func(conn *pgxpool.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		// The first migration partitions a log_entries table that AutoMigrate created with the configured interval
+		_, err = conn.Exec(ctx, "SELECT set_config('iis_logs_parser.partition_interval', $1, false)", config.GetPartitionIntervalOrDefault())
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if _, ok := versions[m.Version]; ok {
+				continue
+			}
+			log.Info().Int("version", m.Version).Str("name", m.Name).Msg("Migrate: applying migration")
+			err := runMigration(ctx, conn, m.Up, "INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, now())", m.Version, m.Name)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+			}
+			applied++
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// MigrateDown reverts the last steps applied migrations, and returns how many were reverted
+func MigrateDown(ctx context.Context, dbPool *pgxpool.Pool, steps int) (int, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	reverted := 0
+	err = withMigrationsLock(ctx, dbPool, func(conn *pgxpool.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0 && reverted < steps; i-- {
+			m := migrations[i]
+			if _, ok := versions[m.Version]; !ok {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migration %d_%s can't be reverted, it has no down file", m.Version, m.Name)
+			}
+			log.Info().Int("version", m.Version).Str("name", m.Name).Msg("Migrate: reverting migration")
+			err := runMigration(ctx, conn, m.Down, "DELETE FROM schema_migrations WHERE version = $1", m.Version)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+			}
+			reverted++
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// GetMigrationStatus returns the embedded migrations and the applied ones this build doesn't know, in version order.
+// It only reads schema_migrations, without waiting for a migration in progress, and every migration is pending until the table exists.
+func GetMigrationStatus(ctx context.Context, dbPool *pgxpool.Pool) ([]MigrationStatus, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dbPool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	var exists bool
+	if err := conn.QueryRow(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, err
+	}
+	versions := map[int]MigrationStatus{}
+	if exists {
+		if versions, err = appliedVersions(ctx, conn); err != nil {
+			return nil, err
+		}
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations)+len(versions))
+	for _, m := range migrations {
+		status := MigrationStatus{Version: m.Version, Name: m.Name}
+		if applied, ok := versions[m.Version]; ok {
+			status.AppliedAt = applied.AppliedAt
+			delete(versions, m.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	for _, applied := range versions {
+		statuses = append(statuses, applied)
+	}
+	slices.SortFunc(statuses, func(a, b MigrationStatus) int { return a.Version - b.Version })
+	return statuses, nil
+}
+
+// withMigrationsLock runs f on a connection holding MigrationsLockKey, once schema_migrations exists
+func withMigrationsLock(ctx context.Context, dbPool *pgxpool.Pool, f func(conn *pgxpool.Conn) error) error {
+	conn, err := dbPool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock(hashtext($1))", MigrationsLockKey); err != nil {
+		return fmt.Errorf("failed to take migrations lock: %w", err)
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", MigrationsLockKey)
+
+	_, err = conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version bigint PRIMARY KEY,
+		name text NOT NULL,
+		applied_at timestamptz NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	return f(conn)
+}
+
+func appliedVersions(ctx context.Context, conn *pgxpool.Conn) (map[int]MigrationStatus, error) {
+	rows, err := conn.Query(ctx, "SELECT version, name, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	versions := map[int]MigrationStatus{}
+	var version int
+	var name string
+	var appliedAt time.Time
+	_, err = pgx.ForEachRow(rows, []any{&version, &name, &appliedAt}, func() error {
+		applied := appliedAt
+		versions[version] = MigrationStatus{Version: version, Name: name, AppliedAt: &applied, Missing: true}
+		return nil
+	})
+	return versions, err
+}
+
+// runMigration runs the migration sql then records it with the record statement,
+// in one transaction unless the migration has the noTransactionMarker
+func runMigration(ctx context.Context, conn *pgxpool.Conn, sql string, record string, args ...any) error {
+	if !strings.HasPrefix(strings.TrimSpace(sql), noTransactionMarker) {
+		return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			// Without arguments the whole file is sent as a single multi-statement query
+			if _, err := tx.Exec(ctx, sql); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, record, args...)
+			return err
+		})
+	}
+
+	// A multi-statement query is run in an implicit transaction, the statements must be sent one by one
+	for _, statement := range splitStatements(sql) {
+		if _, err := conn.Exec(ctx, statement); err != nil {
+			return err
+		}
+	}
+	_, err := conn.Exec(ctx, record, args...)
+	return err
+}
+
+// splitStatements splits sql on the semicolons outside of comments, quoted strings and dollar-quoted bodies
+func splitStatements(sql string) []string {
+	var statements []string
+	start := 0
+	add := func(end int) {
+		if statement := strings.TrimSpace(stripLineComments(sql[start:end])); statement != "" {
+			statements = append(statements, statement)
+		}
+		start = end + 1
+	}
+
+	for i := 0; i < len(sql); i++ {
+		switch {
+		case strings.HasPrefix(sql[i:], "--"):
+			if end := strings.IndexByte(sql[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(sql)
+			}
+		case sql[i] == '\'':
+			for i++; i < len(sql) && sql[i] != '\''; i++ {
+			}
+		case sql[i] == '$':
+			if tag := dollarQuoteRegexp.FindString(sql[i:]); tag != "" {
+				if end := strings.Index(sql[i+len(tag):], tag); end >= 0 {
+					i += len(tag) + end + len(tag) - 1
+				} else {
+					i = len(sql)
+				}
+			}
+		case sql[i] == ';':
+			add(i)
+		}
+	}
+	add(len(sql))
+	return statements
+}
+
+var dollarQuoteRegexp = regexp.MustCompile(`^\$\w*\$`)
+
+func stripLineComments(statement string) string {
+	lines := strings.Split(statement, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
@@ -0,0 +1,18 @@
+DROP TRIGGER IF EXISTS log_files_pending_notify ON log_files;
+DROP FUNCTION IF EXISTS notify_log_file_pending();
+DROP VIEW IF EXISTS log_files_queue;
+DROP VIEW IF EXISTS log_entries_resolved;
+DROP TABLE IF EXISTS log_entries_staging;
+DROP TABLE IF EXISTS log_entries;
+DROP TABLE IF EXISTS user_agents;
+DROP TABLE IF EXISTS uri_stems;
+DROP TABLE IF EXISTS server_ips;
+DROP TABLE IF EXISTS log_rollups_staging;
+DROP TABLE IF EXISTS log_rollups;
+DROP TABLE IF EXISTS retention_purges;
+DROP TABLE IF EXISTS log_file_stats;
+DROP TABLE IF EXISTS workers;
+DROP TABLE IF EXISTS job_runs;
+DROP TABLE IF EXISTS log_files;
+DROP TABLE IF EXISTS domains;
+DROP TABLE IF EXISTS users;
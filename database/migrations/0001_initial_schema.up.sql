@@ -0,0 +1,347 @@
+-- The schema as it was created by AutoMigrate, a database it created is adopted: the columns added since its tables
+-- were created are added, and log_entries is converted when it predates the partitioning or the dictionary encoding.
+CREATE TABLE IF NOT EXISTS users (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	email text,
+	password text NOT NULL,
+	first_name text,
+	last_name text,
+	job_title text,
+	organization text,
+	phone_number text,
+	role text,
+	last_login_at timestamptz,
+	verified boolean,
+	CONSTRAINT uni_users_email UNIQUE (email)
+);
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at);
+
+CREATE TABLE IF NOT EXISTS domains (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	user_id bigint NOT NULL,
+	domain_name varchar(255) NOT NULL,
+	description text,
+	is_active boolean DEFAULT true,
+	business_field varchar(255),
+	business_sector varchar(255),
+	is_subdomain boolean DEFAULT false,
+	"default" boolean DEFAULT false,
+	follow_path varchar(1024),
+	entries_retention_days bigint,
+	files_retention_days bigint,
+	summaries_retention_days bigint,
+	CONSTRAINT fk_users_domains FOREIGN KEY (user_id) REFERENCES users (id)
+);
+CREATE INDEX IF NOT EXISTS idx_domains_deleted_at ON domains (deleted_at);
+ALTER TABLE domains
+	ADD COLUMN IF NOT EXISTS follow_path varchar(1024),
+	ADD COLUMN IF NOT EXISTS entries_retention_days bigint,
+	ADD COLUMN IF NOT EXISTS files_retention_days bigint,
+	ADD COLUMN IF NOT EXISTS summaries_retention_days bigint;
+
+CREATE TABLE IF NOT EXISTS log_files (
+	id bigserial PRIMARY KEY,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	domain_id bigint NOT NULL,
+	name varchar(255) NOT NULL,
+	size bigint NOT NULL,
+	status varchar(20) NOT NULL,
+	start_timestamp timestamp,
+	end_timestamp timestamp,
+	parsing_time bigint,
+	processed_at timestamptz,
+	source_path varchar(1024),
+	lease_owner varchar(255),
+	lease_expires_at timestamptz,
+	attempts bigint NOT NULL DEFAULT 0,
+	last_error text,
+	next_retry_at timestamptz,
+	priority bigint NOT NULL DEFAULT 0,
+	file_purged_at timestamptz,
+	CONSTRAINT fk_domains_log_files FOREIGN KEY (domain_id) REFERENCES domains (id)
+);
+CREATE INDEX IF NOT EXISTS idx_log_files_deleted_at ON log_files (deleted_at);
+ALTER TABLE log_files
+	ADD COLUMN IF NOT EXISTS processed_at timestamptz,
+	ADD COLUMN IF NOT EXISTS source_path varchar(1024),
+	ADD COLUMN IF NOT EXISTS lease_owner varchar(255),
+	ADD COLUMN IF NOT EXISTS lease_expires_at timestamptz,
+	ADD COLUMN IF NOT EXISTS attempts bigint NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS last_error text,
+	ADD COLUMN IF NOT EXISTS next_retry_at timestamptz,
+	ADD COLUMN IF NOT EXISTS priority bigint NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS file_purged_at timestamptz;
+
+CREATE TABLE IF NOT EXISTS job_runs (
+	id bigserial PRIMARY KEY,
+	name varchar(255) NOT NULL,
+	scheduled_at timestamptz,
+	trigger varchar(20) NOT NULL,
+	status varchar(20) NOT NULL,
+	worker_id varchar(255),
+	started_at timestamptz NOT NULL,
+	finished_at timestamptz,
+	error text
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_job_runs_name_scheduled_at ON job_runs (name, scheduled_at);
+CREATE INDEX IF NOT EXISTS idx_job_runs_name_started_at ON job_runs (name, started_at);
+
+CREATE TABLE IF NOT EXISTS workers (
+	id varchar(255) PRIMARY KEY,
+	hostname varchar(255),
+	pid bigint,
+	mode varchar(20),
+	status varchar(20) NOT NULL,
+	active_files bigint,
+	max_concurrent_files bigint,
+	started_at timestamptz,
+	heartbeat_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_workers_heartbeat_at ON workers (heartbeat_at);
+
+CREATE TABLE IF NOT EXISTS log_file_stats (
+	log_file_id bigint PRIMARY KEY,
+	lines_read bigint,
+	entries_inserted bigint,
+	rejected_lines bigint,
+	duplicate_lines bigint,
+	failed_writes bigint,
+	batch_count bigint,
+	bytes_read bigint,
+	lines_per_second decimal,
+	bytes_per_second decimal,
+	duration_ms bigint,
+	parsing_time_ms bigint,
+	insertion_time_ms bigint,
+	summary jsonb,
+	updated_at timestamptz,
+	CONSTRAINT fk_log_file_stats_log_file FOREIGN KEY (log_file_id) REFERENCES log_files (id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+ALTER TABLE log_file_stats ADD COLUMN IF NOT EXISTS summary jsonb;
+
+CREATE TABLE IF NOT EXISTS retention_purges (
+	id bigserial PRIMARY KEY,
+	target varchar(20) NOT NULL,
+	domain_id bigint,
+	partition varchar(255),
+	cutoff timestamptz NOT NULL,
+	rows bigint NOT NULL,
+	bytes bigint NOT NULL DEFAULT 0,
+	purged_at timestamptz NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_retention_purges_domain_id ON retention_purges (domain_id);
+CREATE INDEX IF NOT EXISTS idx_retention_purges_purged_at ON retention_purges (purged_at);
+
+CREATE TABLE IF NOT EXISTS log_rollups (
+	log_file_id bigint,
+	granularity varchar(10),
+	bucket timestamp,
+	domain_id bigint NOT NULL,
+	requests bigint NOT NULL,
+	status1xx bigint NOT NULL,
+	status2xx bigint NOT NULL,
+	status3xx bigint NOT NULL,
+	status4xx bigint NOT NULL,
+	status5xx bigint NOT NULL,
+	log_bytes bigint NOT NULL,
+	timed_requests bigint NOT NULL,
+	time_taken_sum bigint NOT NULL,
+	time_taken_min bigint,
+	time_taken_max bigint,
+	latency_histogram bigint[] NOT NULL,
+	PRIMARY KEY (log_file_id, granularity, bucket),
+	CONSTRAINT fk_log_rollups_log_file FOREIGN KEY (log_file_id) REFERENCES log_files (id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_log_rollups_domain ON log_rollups (domain_id, granularity, bucket);
+
+-- Reprocessed files are loaded here first, then swapped with their old rollups in one transaction
+CREATE UNLOGGED TABLE IF NOT EXISTS log_rollups_staging (LIKE log_rollups INCLUDING DEFAULTS INCLUDING INDEXES);
+
+-- Lookup tables of the dictionary-encoded log_entries columns, hash is the SHA-256 of the value
+CREATE TABLE IF NOT EXISTS server_ips (
+	id serial PRIMARY KEY,
+	value text NOT NULL,
+	hash bytea NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_server_ips_hash ON server_ips (hash);
+
+CREATE TABLE IF NOT EXISTS uri_stems (
+	id serial PRIMARY KEY,
+	value text NOT NULL,
+	hash bytea NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_uri_stems_hash ON uri_stems (hash);
+
+CREATE TABLE IF NOT EXISTS user_agents (
+	id serial PRIMARY KEY,
+	value text NOT NULL,
+	hash bytea NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_user_agents_hash ON user_agents (hash);
+
+-- A log_entries table created by AutoMigrate before partitioning is moved into the partitioned one below
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM pg_class WHERE oid = to_regclass('log_entries') AND relkind = 'r') THEN
+		ALTER TABLE log_entries RENAME TO log_entries_unpartitioned;
+		ALTER INDEX IF EXISTS log_entries_pkey RENAME TO log_entries_unpartitioned_pkey;
+		ALTER INDEX IF EXISTS idx_log_entries_deleted_at RENAME TO idx_log_entries_unpartitioned_deleted_at;
+		ALTER SEQUENCE IF EXISTS log_entries_id_seq RENAME TO log_entries_unpartitioned_id_seq;
+		ALTER TABLE log_entries_unpartitioned DROP CONSTRAINT IF EXISTS fk_log_files_log_entries;
+		-- Recreated below along with log_entries, it only holds the entries of the files being reprocessed
+		DROP TABLE IF EXISTS log_entries_staging;
+	END IF;
+END
+$$;
+
+-- Partitioned by range of timestamp, the partitions are created as entries come in.
+-- The primary key must include the partition key.
+CREATE TABLE IF NOT EXISTS log_entries (
+	id bigserial NOT NULL,
+	created_at timestamptz,
+	updated_at timestamptz,
+	deleted_at timestamptz,
+	log_file_id bigint NOT NULL,
+	line_number bigint,
+	byte_offset bigint,
+	timestamp timestamp NOT NULL,
+	date text,
+	time text,
+	server_ip_id integer,
+	method text,
+	uri_stem_id integer,
+	uri_query text,
+	port text,
+	username text,
+	client_ip text,
+	user_agent_id integer,
+	status text,
+	sub_status text,
+	win32_status text,
+	time_taken text,
+	PRIMARY KEY (id, timestamp),
+	CONSTRAINT fk_log_files_log_entries FOREIGN KEY (log_file_id) REFERENCES log_files (id) ON UPDATE CASCADE ON DELETE CASCADE
+) PARTITION BY RANGE (timestamp);
+CREATE INDEX IF NOT EXISTS idx_log_entries_log_file_id ON log_entries (log_file_id);
+
+-- The entries of an unpartitioned log_entries are copied into partitions of PARTITION_INTERVAL,
+-- see db.PartitionRange, which rewrites all the entries once.
+-- Their values are copied as they are, the next step replaces them with their ids.
+DO $$
+DECLARE
+	unit text := COALESCE(NULLIF(current_setting('iis_logs_parser.partition_interval', true), ''), 'month');
+	step interval := ('1 ' || unit)::interval;
+	-- Entries with an invalid date or time fall back to when they were inserted
+	ts text := $ts$CASE WHEN date ~ '^\d{4}-\d{2}-\d{2}$' AND time ~ '^\d{2}:\d{2}:\d{2}$'
+		THEN (date || ' ' || time)::timestamp ELSE created_at::timestamp END$ts$;
+	first_ts timestamp;
+	last_ts timestamp;
+	start timestamp;
+BEGIN
+	IF to_regclass('log_entries_unpartitioned') IS NULL THEN
+		RETURN;
+	END IF;
+	RAISE NOTICE 'Moving log_entries to a partitioned table, this may take a while';
+
+	-- Added after the partitioning, the entries of older databases have none
+	ALTER TABLE log_entries_unpartitioned ADD COLUMN IF NOT EXISTS line_number bigint, ADD COLUMN IF NOT EXISTS byte_offset bigint;
+	ALTER TABLE log_entries ADD COLUMN server_ip text, ADD COLUMN uri_stem text, ADD COLUMN user_agent text;
+
+	EXECUTE format('SELECT MIN(%1$s), MAX(%1$s) FROM log_entries_unpartitioned', ts) INTO first_ts, last_ts;
+	start := date_trunc(unit, first_ts);
+	WHILE start <= last_ts LOOP
+		EXECUTE format('CREATE TABLE IF NOT EXISTS %I PARTITION OF log_entries FOR VALUES FROM (%L) TO (%L)',
+			'log_entries_p' || to_char(start, 'YYYYMMDD'), start, start + step);
+		start := start + step;
+	END LOOP;
+
+	EXECUTE format('INSERT INTO log_entries (timestamp, id, created_at, updated_at, deleted_at, log_file_id, line_number, byte_offset,
+			date, time, server_ip, method, uri_stem, uri_query, port, username, client_ip, user_agent, status, sub_status, win32_status, time_taken)
+		SELECT %s, id, created_at, updated_at, deleted_at, log_file_id, line_number, byte_offset,
+			date, time, server_ip, method, uri_stem, uri_query, port, username, client_ip, user_agent, status, sub_status, win32_status, time_taken
+		FROM log_entries_unpartitioned', ts);
+	PERFORM setval(pg_get_serial_sequence('log_entries', 'id'), COALESCE(MAX(id), 1)) FROM log_entries;
+	DROP TABLE log_entries_unpartitioned;
+END
+$$;
+
+-- The values of the entries stored before dictionary encoding are replaced with their ids, which rewrites all the entries once
+DO $$
+DECLARE
+	c record;
+BEGIN
+	FOR c IN SELECT * FROM (VALUES ('server_ip', 'server_ips'), ('uri_stem', 'uri_stems'), ('user_agent', 'user_agents')) AS v (col, dictionary)
+	LOOP
+		IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = 'log_entries' AND column_name = c.col) THEN
+			CONTINUE;
+		END IF;
+		RAISE NOTICE 'Dictionary-encoding log_entries column %, this may take a while', c.col;
+		EXECUTE format('INSERT INTO %2$I (value, hash)
+			SELECT DISTINCT %1$I, sha256(convert_to(%1$I, ''UTF8'')) FROM log_entries WHERE %1$I IS NOT NULL
+			ON CONFLICT (hash) DO NOTHING', c.col, c.dictionary);
+		EXECUTE format('ALTER TABLE log_entries ADD COLUMN IF NOT EXISTS %I integer', c.col || '_id');
+		EXECUTE format('UPDATE log_entries e SET %1$I = d.id FROM %3$I d WHERE d.hash = sha256(convert_to(e.%2$I, ''UTF8''))',
+			c.col || '_id', c.col, c.dictionary);
+		EXECUTE format('ALTER TABLE log_entries DROP COLUMN %I', c.col);
+		-- Recreated below with the columns of log_entries
+		DROP TABLE IF EXISTS log_entries_staging;
+	END LOOP;
+END
+$$;
+
+-- Reprocessed files are loaded here first, then swapped with their old entries in one transaction
+CREATE UNLOGGED TABLE IF NOT EXISTS log_entries_staging (LIKE log_entries INCLUDING DEFAULTS);
+
+-- The entries along with the values of their encoded columns
+CREATE OR REPLACE VIEW log_entries_resolved AS
+SELECT e.*, s.value AS server_ip, u.value AS uri_stem, a.value AS user_agent
+FROM log_entries e
+LEFT JOIN server_ips s ON s.id = e.server_ip_id
+LEFT JOIN uri_stems u ON u.id = e.uri_stem_id
+LEFT JOIN user_agents a ON a.id = e.user_agent_id;
+
+-- The processing order of the pending files that are due.
+-- Users take turns: the n-th file of a user comes after the (n-1)-th file of every other user,
+-- counting the files it already has processing, and a user's domains take turns the same way.
+-- Priority only orders the files of a same user, so it can't be used to skip ahead of the other users.
+CREATE OR REPLACE VIEW log_files_queue AS
+SELECT id, ROW_NUMBER() OVER (ORDER BY fair_rank, priority DESC, id) AS position
+FROM (
+	SELECT f.id, f.priority,
+		ROW_NUMBER() OVER (PARTITION BY d.user_id ORDER BY f.priority DESC, f.domain_rank, f.id) + COALESCE(p.files, 0) AS fair_rank
+	FROM (
+		SELECT id, domain_id, priority, ROW_NUMBER() OVER (PARTITION BY domain_id ORDER BY priority DESC, id) AS domain_rank
+		FROM log_files
+		WHERE status = 'pending' AND deleted_at IS NULL AND (next_retry_at IS NULL OR next_retry_at <= now())
+	) f
+	JOIN domains d ON d.id = f.domain_id
+	LEFT JOIN (
+		SELECT d.user_id, COUNT(*) AS files
+		FROM log_files pf JOIN domains d ON d.id = pf.domain_id
+		WHERE pf.status = 'processing'
+		GROUP BY d.user_id
+	) p ON p.user_id = d.user_id
+) ranked;
+
+-- Notifies the log_files_pending channel whenever a log file is queued, whichever code path inserted or updated it
+CREATE OR REPLACE FUNCTION notify_log_file_pending() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_notify('log_files_pending', NEW.id::text);
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+-- CREATE OR REPLACE TRIGGER needs Postgres 14
+DROP TRIGGER IF EXISTS log_files_pending_notify ON log_files;
+CREATE TRIGGER log_files_pending_notify
+AFTER INSERT OR UPDATE OF status ON log_files
+FOR EACH ROW WHEN (NEW.status = 'pending' AND NEW.deleted_at IS NULL)
+EXECUTE FUNCTION notify_log_file_pending();
@@ -0,0 +1,3 @@
+-- migrate:no-transaction
+-- pg_trgm is kept, other objects may use it
+DROP INDEX CONCURRENTLY IF EXISTS idx_uri_stems_value_trgm;
@@ -0,0 +1,5 @@
+-- migrate:no-transaction
+-- Substring searches on the URI stems, e.g. value ILIKE '%/api/%', matched to their entries by the uri_stem_id partition indexes.
+-- The other log_entries indexes are created per partition, see db.EntryIndexes.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX CONCURRENTLY IF NOT EXISTS idx_uri_stems_value_trgm ON uri_stems USING gin (value gin_trgm_ops);
@@ -0,0 +1 @@
+ALTER TABLE domains DROP COLUMN IF EXISTS deleting_at;
@@ -0,0 +1,2 @@
+-- Deleted domains are removed by the purge-deleted-files job once their log files are
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS deleting_at timestamptz;
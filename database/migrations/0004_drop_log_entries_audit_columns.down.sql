@@ -0,0 +1,12 @@
+-- The removed log files are not given back
+DROP VIEW log_entries_resolved;
+
+ALTER TABLE log_entries ADD COLUMN created_at timestamptz, ADD COLUMN updated_at timestamptz, ADD COLUMN deleted_at timestamptz;
+ALTER TABLE log_entries_staging ADD COLUMN created_at timestamptz, ADD COLUMN updated_at timestamptz, ADD COLUMN deleted_at timestamptz;
+
+CREATE VIEW log_entries_resolved AS
+SELECT e.*, s.value AS server_ip, u.value AS uri_stem, a.value AS user_agent
+FROM log_entries e
+LEFT JOIN server_ips s ON s.id = e.server_ip_id
+LEFT JOIN uri_stems u ON u.id = e.uri_stem_id
+LEFT JOIN user_agents a ON a.id = e.user_agent_id;
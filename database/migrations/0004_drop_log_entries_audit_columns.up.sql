@@ -0,0 +1,17 @@
+-- Entries are append-only and hard deleted, they lose the gorm.Model columns.
+-- Entries were only soft deleted along with their log file, the purge-deleted-files job now removes both for good.
+UPDATE log_files SET status = 'deleting', lease_owner = NULL WHERE deleted_at IS NOT NULL AND status <> 'deleting';
+UPDATE domains SET deleting_at = deleted_at WHERE deleted_at IS NOT NULL AND deleting_at IS NULL;
+
+-- Its columns follow the ones of log_entries
+DROP VIEW log_entries_resolved;
+
+ALTER TABLE log_entries DROP COLUMN created_at, DROP COLUMN updated_at, DROP COLUMN deleted_at;
+ALTER TABLE log_entries_staging DROP COLUMN created_at, DROP COLUMN updated_at, DROP COLUMN deleted_at;
+
+CREATE VIEW log_entries_resolved AS
+SELECT e.*, s.value AS server_ip, u.value AS uri_stem, a.value AS user_agent
+FROM log_entries e
+LEFT JOIN server_ips s ON s.id = e.server_ip_id
+LEFT JOIN uri_stems u ON u.id = e.uri_stem_id
+LEFT JOIN user_agents a ON a.id = e.user_agent_id;
@@ -0,0 +1,2 @@
+-- migrate:no-transaction
+-- Nothing to revert, the reclaimed space stays reclaimed
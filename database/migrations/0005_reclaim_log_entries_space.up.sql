@@ -0,0 +1,4 @@
+-- migrate:no-transaction
+-- The columns dropped by 0004 keep their space until the entries are rewritten, which locks each partition meanwhile.
+-- Migrations are applied at startup, so the space is reclaimed by hand instead, see "Reclaiming Disk Space" in the README.
+-- The migration stays, so that the databases that ran its VACUUM FULL and the others have the same versions.
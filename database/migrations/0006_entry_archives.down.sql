@@ -0,0 +1,4 @@
+-- The archived files are left in their store
+DROP TABLE IF EXISTS archive_restores;
+DROP TABLE IF EXISTS entry_archives;
+ALTER TABLE domains DROP COLUMN IF EXISTS archive_after_days;
@@ -0,0 +1,32 @@
+-- Entries older than archive_after_days are moved to compressed files by the archive-entries job
+ALTER TABLE domains ADD COLUMN IF NOT EXISTS archive_after_days bigint;
+
+CREATE TABLE IF NOT EXISTS entry_archives (
+	id bigserial PRIMARY KEY,
+	domain_id bigint NOT NULL,
+	day timestamp NOT NULL,
+	entries bigint NOT NULL,
+	bytes bigint NOT NULL,
+	sha256 varchar(64) NOT NULL,
+	store varchar(20) NOT NULL,
+	key varchar(1024) NOT NULL,
+	created_at timestamptz NOT NULL,
+	restored_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_entry_archives_domain_id_day ON entry_archives (domain_id, day);
+
+CREATE TABLE IF NOT EXISTS archive_restores (
+	id bigserial PRIMARY KEY,
+	domain_id bigint NOT NULL,
+	range_start timestamp NOT NULL,
+	range_end timestamp NOT NULL,
+	status varchar(20) NOT NULL,
+	entries bigint NOT NULL DEFAULT 0,
+	skipped_entries bigint NOT NULL DEFAULT 0,
+	error text,
+	created_at timestamptz NOT NULL,
+	started_at timestamptz,
+	finished_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_archive_restores_domain_id ON archive_restores (domain_id);
+CREATE INDEX IF NOT EXISTS idx_archive_restores_status ON archive_restores (status);
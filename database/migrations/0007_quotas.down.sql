@@ -0,0 +1,12 @@
+DROP TABLE IF EXISTS daily_uploads;
+ALTER TABLE log_files DROP COLUMN IF EXISTS entries, DROP COLUMN IF EXISTS stored_bytes;
+ALTER TABLE domains
+	DROP COLUMN IF EXISTS quota_max_file_size,
+	DROP COLUMN IF EXISTS quota_max_stored_bytes,
+	DROP COLUMN IF EXISTS quota_max_entries,
+	DROP COLUMN IF EXISTS quota_max_uploads_per_day;
+ALTER TABLE users
+	DROP COLUMN IF EXISTS quota_max_file_size,
+	DROP COLUMN IF EXISTS quota_max_stored_bytes,
+	DROP COLUMN IF EXISTS quota_max_entries,
+	DROP COLUMN IF EXISTS quota_max_uploads_per_day;
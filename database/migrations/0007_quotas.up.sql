@@ -0,0 +1,33 @@
+-- Quotas of the users (NULL applies the QUOTA_* defaults) and of the domains (NULL is no limit of its own)
+ALTER TABLE users
+	ADD COLUMN IF NOT EXISTS quota_max_file_size bigint,
+	ADD COLUMN IF NOT EXISTS quota_max_stored_bytes bigint,
+	ADD COLUMN IF NOT EXISTS quota_max_entries bigint,
+	ADD COLUMN IF NOT EXISTS quota_max_uploads_per_day bigint;
+ALTER TABLE domains
+	ADD COLUMN IF NOT EXISTS quota_max_file_size bigint,
+	ADD COLUMN IF NOT EXISTS quota_max_stored_bytes bigint,
+	ADD COLUMN IF NOT EXISTS quota_max_entries bigint,
+	ADD COLUMN IF NOT EXISTS quota_max_uploads_per_day bigint;
+
+-- Usage counters of the log files, the usage of a domain or user is the sum over its files
+ALTER TABLE log_files
+	ADD COLUMN IF NOT EXISTS entries bigint NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS stored_bytes bigint NOT NULL DEFAULT 0;
+
+UPDATE log_files f SET entries = c.entries
+FROM (SELECT log_file_id, COUNT(*) AS entries FROM log_entries GROUP BY log_file_id) c
+WHERE f.id = c.log_file_id;
+
+-- Files picked up by the follow mode have no stored copy, the completed ones can't be told apart
+-- and count until the retention policy marks them as purged
+UPDATE log_files SET stored_bytes = size WHERE file_purged_at IS NULL AND status NOT IN ('following', 'deleting');
+
+CREATE TABLE IF NOT EXISTS daily_uploads (
+	domain_id bigint NOT NULL,
+	day date NOT NULL,
+	user_id bigint NOT NULL,
+	uploads bigint NOT NULL,
+	PRIMARY KEY (domain_id, day)
+);
+CREATE INDEX IF NOT EXISTS idx_daily_uploads_user_id_day ON daily_uploads (user_id, day);
@@ -0,0 +1 @@
+ALTER TABLE log_file_stats DROP COLUMN IF EXISTS duplicate_lines_approximate;
@@ -0,0 +1,2 @@
+-- Duplicate lines are only detected among the first DUPLICATE_LINES_TRACKED distinct lines of a file
+ALTER TABLE log_file_stats ADD COLUMN IF NOT EXISTS duplicate_lines_approximate boolean NOT NULL DEFAULT false;
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"fmt"
+	"iis-logs-parser/config"
+	"time"
+)
+
+// PartitionRange returns the bounds of the log_entries partition holding the timestamp, for the configured interval
+func PartitionRange(timestamp time.Time) (time.Time, time.Time) {
+	year, month, day := timestamp.Date()
+	switch config.GetPartitionIntervalOrDefault() {
+	case "day":
+		start := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1)
+	case "week":
+		// Weeks start on Monday, like date_trunc('week', ...)
+		start := time.Date(year, month, day-(int(timestamp.Weekday())+6)%7, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 7)
+	default:
+		start := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	}
+}
+
+// PartitionName returns the name of the log_entries partition starting at start
+func PartitionName(start time.Time) string {
+	return "log_entries_p" + start.Format("20060102")
+}
+
+// CreatePartitionSQL creates the log_entries partition for the range, unless it exists.
+// It must run while holding the PartitionsLockKey advisory lock, concurrent creations of the same partition fail otherwise.
+func CreatePartitionSQL(start time.Time, end time.Time) string {
+	return fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s PARTITION OF log_entries FOR VALUES FROM ('%s') TO ('%s')",
+		PartitionName(start), start.Format(time.DateTime), end.Format(time.DateTime),
+	)
+}
+
+// EntryIndex is a secondary index of the log_entries partitions.
+// They are created on each partition rather than on log_entries, so they can be built concurrently and deferred.
+type EntryIndex struct {
+	Suffix     string
+	Definition string
+}
+
+// EntryIndexes are the secondary indexes of every log_entries partition, log_file_id is indexed on log_entries itself
+var EntryIndexes = []EntryIndex{
+	// Entries are mostly inserted in time order, a BRIN index is a tiny fraction of a B-tree and cheap to maintain
+	{"timestamp_brin", "USING brin (timestamp)"},
+	{"status", "(status)"},
+	// Joins the uri_stems found by a trigram search to their entries
+	{"uri_stem_id", "(uri_stem_id)"},
+}
+
+// Name returns the name of the index on the partition
+func (i EntryIndex) Name(partition string) string {
+	return partition + "_" + i.Suffix + "_idx"
+}
+
+// CreateSQL creates the index on the partition unless it exists, concurrently to not block the writes to a partition holding entries
+func (i EntryIndex) CreateSQL(partition string, concurrently bool) string {
+	option := ""
+	if concurrently {
+		option = "CONCURRENTLY "
+	}
+	return fmt.Sprintf("CREATE INDEX %sIF NOT EXISTS %s ON %s %s", option, i.Name(partition), partition, i.Definition)
+}
+
+// PartitionsLockKey is the advisory lock serializing the creation of log_entries partitions
+const PartitionsLockKey = "log-entries-partitions"
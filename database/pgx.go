@@ -0,0 +1,43 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	pgxZerolog "github.com/jackc/pgx-zerolog"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/tracelog"
+	"github.com/rs/zerolog/log"
+)
+
+// PgxPool is shared by the processor and the routes that feed it
+var PgxPool *pgxpool.Pool
+
+// NewPgxPool opens the pgx connection pool used by the processor, which needs COPY support GORM doesn't have
+func NewPgxPool(ctx context.Context) (*pgxpool.Pool, error) {
+	dbConfig, err := LoadConfigFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load database config: %w", err)
+	}
+
+	log.Info().Msgf("DB-PGX: Connecting to database: %s", dbConfig.NoPassDSN())
+	pgxConfig, err := pgxpool.ParseConfig(dbConfig.DSN())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse database config: %w", err)
+	}
+
+	logger := pgxZerolog.NewLogger(log.Logger)
+
+	pgxConfig.ConnConfig.Tracer = &tracelog.TraceLog{
+		Logger:   logger,
+		LogLevel: tracelog.LogLevelTrace,
+	}
+
+	dbPool, err := pgxpool.NewWithConfig(ctx, pgxConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create connection pool: %w", err)
+	}
+	log.Info().Msg("DB-PGX: Connected to database")
+
+	return dbPool, nil
+}
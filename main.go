@@ -3,23 +3,25 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
+	"fmt"
 	"iis-logs-parser/config"
 	db "iis-logs-parser/database"
 	"iis-logs-parser/models"
 	"iis-logs-parser/processor"
 	"iis-logs-parser/routes"
+	"iis-logs-parser/scheduler"
 	"iis-logs-parser/utils"
+	"net"
+	"net/http"
 	"os"
-	"path/filepath"
-	"strconv"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	pgxZerolog "github.com/jackc/pgx-zerolog"
-	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/jackc/pgx/v5/tracelog"
 	"github.com/joho/godotenv"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -36,124 +38,231 @@ func init() {
 	// log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 }
 
-func processLogsCron(ctx context.Context) {
-	dbConfig, err := db.LoadConfigFromEnv()
-	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to load database config")
+// Run modes, a process serves the API, processes the log files, or both
+const (
+	modeAPI    = "api"
+	modeWorker = "worker"
+	modeAll    = "all"
+)
+
+func main() {
+	mode := flag.String("mode", modeAll, "what this process runs: api, worker or all")
+	flag.Parse()
+	if flag.Arg(0) == "migrate" {
+		os.Exit(runMigrateCommand(flag.Args()[1:]))
+	}
+	if *mode != modeAPI && *mode != modeWorker && *mode != modeAll {
+		fmt.Fprintf(os.Stderr, "invalid mode %q, must be one of: api, worker, all\n", *mode)
+		os.Exit(2)
 	}
+	runsAPI := *mode == modeAPI || *mode == modeAll
+	runsWorker := *mode == modeWorker || *mode == modeAll
+	log.Info().Str("mode", *mode).Str("workerId", processor.WorkerID).Msg("Starting")
 
-	log.Info().Msgf("DB-PGX: Connecting to database: %s", dbConfig.NoPassDSN())
-	pgxConfig, err := pgxpool.ParseConfig(dbConfig.DSN())
-	if err != nil {
-		log.Fatal().Err(err).Msg("DB-PGX: Failed to connect to database")
+	if _, err := os.Stat("uploaded_logs"); os.IsNotExist(err) {
+		os.Mkdir("uploaded_logs", 0755)
 	}
 
-	logger := pgxZerolog.NewLogger(log.Logger)
+	if err := godotenv.Load(".env.local"); err != nil {
+		log.Fatal().Err(err).Msg("Failed to load .env file")
+	}
 
-	pgxConfig.ConnConfig.Tracer = &tracelog.TraceLog{
-		Logger:   logger,
-		LogLevel: tracelog.LogLevelTrace,
+	// Only the API sends emails
+	if runsAPI && os.Getenv("GO_ENV") != "production" {
+		if emailPass := os.Getenv("FROM_EMAIL_PASSWORD"); emailPass == "" {
+			if flag.NArg() < 1 {
+				log.Fatal().Msg("Please provide FROM_EMAIL_PASSWORD as an argument, or set it in .env.local")
+			}
+			os.Setenv("FROM_EMAIL_PASSWORD", flag.Arg(0))
+		}
 	}
 
-	dbPool, err := pgxpool.NewWithConfig(ctx, pgxConfig)
+	utils.InitValidator()
+
+	db.InitGormDB()
+
+	dbPool, err := db.NewPgxPool(context.Background())
 	if err != nil {
-		var pgErr *pgconn.PgError
-		if errors.As(err, &pgErr) {
-			log.Fatal().Err(err).Msg("DB-PGX: Unable to create connection pool")
-		}
+		log.Fatal().Err(err).Msg("DB-PGX: Failed to connect to database")
 	}
 	defer dbPool.Close()
-	log.Info().Msg("DB-PGX: Connected to database")
+	db.PgxPool = dbPool
 
-	log.Info().Msg("Searching for files to parse")
-	var pendingFilesCount int
-	err = dbPool.QueryRow(ctx, "SELECT COUNT(*) FROM log_files WHERE status = 'pending'").Scan(&pendingFilesCount)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to get pending files count")
+	// Instances started together wait for the first one to migrate
+	if applied, err := db.MigrateUp(context.Background(), dbPool); err != nil {
+		log.Fatal().Err(err).Msg("Failed to migrate database")
+	} else if applied > 0 {
+		log.Info().Int("applied", applied).Msg("Migrated database")
 	}
-	if pendingFilesCount == 0 {
-		log.Info().Msg("No files to process")
-		return
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// The API lists and triggers the jobs, but only workers run them on their schedule
+	jobs := registerJobs(dbPool)
+	scheduler.Default = jobs
+
+	var ingestWorker *worker
+	if runsWorker {
+		ingestWorker = startWorker(ctx, dbPool, jobs, *mode)
 	}
-	log.Info().Msgf("Found %d files to process", pendingFilesCount)
 
-	rows, err := dbPool.Query(ctx, "SELECT id, name FROM log_files WHERE status = 'pending'")
-	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to query log files")
-	}
-
-	var fileId uint
-	var fileName string
-	pgx.ForEachRow(
-		rows,
-		[]any{&fileId, &fileName},
-		func() error {
-			log.Info().Msgf("Starting to process file: %s with id: %d", fileName, fileId)
-
-			_, err := dbPool.Exec(ctx, "UPDATE log_files SET status = $1 WHERE id = $2", models.StatusProcessing, fileId)
-			if err != nil {
-				log.Err(err).Msgf("Failed to update file status to processing: %s with id: %d", fileName, fileId)
-				log.Info().Msgf("Skipping file: %s with id: %d", fileName, fileId)
-				return nil
-			}
+	var apiServer *server
+	if runsAPI {
+		apiServer = startServer()
+	}
 
-			savedFileName := filepath.Join("uploaded_logs", fileName+"-"+strconv.FormatUint(uint64(fileId), 10))
-			parsingTime, startTimestamp, endTimestamp, err := processor.ProcessLogFile(savedFileName, 12, dbPool, "batch", fileId)
-			if err != nil {
-				log.Err(err).Msgf("Failed to process file: %s with id: %d", fileName, fileId)
-				_, err := dbPool.Exec(ctx, "UPDATE log_files SET status = $1 WHERE id = $2", models.StatusFailed, fileId)
-				if err != nil {
-					log.Err(err).Msgf("Failed to update file status to failed: %s with id: %d", fileName, fileId)
-				}
-				return nil
-			}
-			log.Info().Msgf("Finished processing file: %s with id: %d", fileName, fileId)
-			_, err = dbPool.Exec(ctx, "UPDATE log_files SET status = $1, start_timestamp = $2, end_timestamp = $3, parsing_time = $4 WHERE id = $5", models.StatusCompleted, startTimestamp, endTimestamp, parsingTime, fileId)
-			if err != nil {
-				log.Err(err).Msgf("Failed to update file status to completed: %s with id: %d", fileName, fileId)
-			}
-			return nil
-		},
-	)
+	<-ctx.Done()
+	stop()
+	shutdownTimeout := config.GetShutdownTimeoutOrDefault()
+	log.Info().Dur("timeout", shutdownTimeout).Msg("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	if apiServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			apiServer.shutdown(shutdownCtx)
+		}()
+	}
+	if ingestWorker != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ingestWorker.shutdown(shutdownCtx)
+		}()
+	}
+	wg.Wait()
+	log.Info().Msg("Shut down")
 }
 
-func main() {
-	if _, err := os.Stat("uploaded_logs"); os.IsNotExist(err) {
-		os.Mkdir("uploaded_logs", 0755)
+type server struct {
+	httpServer *http.Server
+	// Cancels the context of the requests still running after the shutdown deadline
+	cancelRequests context.CancelFunc
+}
+
+func startServer() *server {
+	r := gin.Default()
+	routes.RegisterRoutes(r)
+
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+	s := &server{
+		httpServer: &http.Server{
+			Addr:        ":" + config.GetServerPortOrDefault(),
+			Handler:     r,
+			BaseContext: func(net.Listener) context.Context { return requestsCtx },
+		},
+		cancelRequests: cancelRequests,
 	}
+	go func() {
+		if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal().Err(err).Msg("Failed to start server")
+		}
+	}()
+	return s
+}
 
-	if err := godotenv.Load(".env.local"); err != nil {
-		log.Fatal().Err(err).Msg("Failed to load .env file")
+// shutdown stops accepting connections and waits for the in-flight requests until ctx is done,
+// then interrupts the remaining ones (e.g. streamed uploads) and gives them a moment to record their failure
+func (s *server) shutdown(ctx context.Context) {
+	if err := s.httpServer.Shutdown(ctx); err == nil {
+		return
 	}
+	log.Warn().Msg("Shutdown deadline reached, interrupting the in-flight requests")
+	s.cancelRequests()
 
-	if os.Getenv("GO_ENV") != "production" {
-		if emailPass := os.Getenv("FROM_EMAIL_PASSWORD"); emailPass == "" {
-			if len(os.Args) < 2 {
-				log.Fatal().Msg("Please provide FROM_EMAIL_PASSWORD as an argument, or set it in .env.local")
-			}
-			os.Setenv("FROM_EMAIL_PASSWORD", os.Args[1])
-		}
+	graceCtx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+	defer cancel()
+	if err := s.httpServer.Shutdown(graceCtx); err != nil {
+		s.httpServer.Close()
 	}
+}
 
-	utils.InitValidator()
+// Time given to interrupted requests and files to clean up after the shutdown deadline
+const shutdownGracePeriod = 10 * time.Second
 
-	db.InitGormDB()
+type worker struct {
+	dbPool *pgxpool.Pool
+	queue  *processor.Queue
+	// Stops the heartbeat, which goes on while the files are finishing
+	stopHeartbeat context.CancelFunc
+}
 
-	var scheduleNext func() // Declare a function variable for self-referencing
+// startWorker starts the background ingestion until ctx is cancelled: the queue, follow mode, drop folders and scheduled jobs
+func startWorker(ctx context.Context, dbPool *pgxpool.Pool, jobs *scheduler.Scheduler, mode string) *worker {
+	// The daily job may not run before the first files arrive
+	if err := processor.CreateFuturePartitions(ctx, dbPool, config.PARTITIONS_AHEAD); err != nil {
+		log.Err(err).Msg("Failed to create the log entries partitions in advance")
+	}
 
-	task := func(ctx context.Context) {
-		processLogsCron(ctx)
-		time.AfterFunc(20*time.Second, scheduleNext)
+	if followRootDir := config.GetFollowRootDir(); followRootDir != "" {
+		go processor.FollowDomains(ctx, dbPool, followRootDir)
 	}
 
-	// Define scheduleNext to trigger the task in a goroutine
-	scheduleNext = func() {
-		go task(context.Background())
+	dropFolders, err := config.LoadDropFolders()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load drop folders")
 	}
+	processor.WatchDropFolders(ctx, dbPool, dropFolders)
 
-	scheduleNext()
+	queue := processor.NewQueue(dbPool, config.GetMaxConcurrentFilesOrDefault(), config.GetWorkerBudgetOrDefault())
+	go queue.Listen(ctx, db.PendingLogFilesChannel, config.PENDING_POLL_INTERVAL)
+	heartbeatCtx, stopHeartbeat := context.WithCancel(context.Background())
+	go processor.ReportWorker(heartbeatCtx, dbPool, mode, queue)
 
-	r := gin.Default()
-	routes.RegisterRoutes(r)
-	r.Run(":" + config.GetServerPortOrDefault())
+	jobs.Start(ctx)
+	return &worker{dbPool: dbPool, queue: queue, stopHeartbeat: stopHeartbeat}
+}
+
+// shutdown lets the files being processed finish until ctx is done, then returns the remaining ones to the queue
+func (w *worker) shutdown(ctx context.Context) {
+	processor.SetWorkerStatus(context.Background(), w.dbPool, models.WorkerStatusStopping)
+	w.queue.Shutdown(ctx)
+	w.stopHeartbeat()
+	processor.SetWorkerStatus(context.Background(), w.dbPool, models.WorkerStatusStopped)
+}
+
+func registerJobs(dbPool *pgxpool.Pool) *scheduler.Scheduler {
+	jobs := scheduler.New(dbPool, processor.WorkerID)
+	jobs.Register("reap-expired-leases", scheduler.Every(config.REAP_LEASES_INTERVAL), func(ctx context.Context) error {
+		reaped, err := processor.ReapExpiredLeases(ctx, dbPool)
+		if reaped > 0 {
+			log.Info().Msgf("Requeued %d files with an expired lease", reaped)
+		}
+		return err
+	})
+	jobs.Register("purge-deleted-files", scheduler.Every(config.PURGE_DELETED_INTERVAL), func(ctx context.Context) error {
+		removed, err := processor.PurgeDeletedFiles(ctx, dbPool)
+		if removed > 0 {
+			log.Info().Msgf("Removed %d deleted files", removed)
+		}
+		return err
+	})
+	jobs.Register("prune-job-runs", scheduler.MustParseCron("30 3 * * *"), func(ctx context.Context) error {
+		_, err := jobs.PruneRuns(ctx, config.JOB_RUNS_RETENTION)
+		return err
+	})
+	jobs.Register("create-log-entries-partitions", scheduler.MustParseCron("0 2 * * *"), func(ctx context.Context) error {
+		return processor.CreateFuturePartitions(ctx, dbPool, config.PARTITIONS_AHEAD)
+	})
+	jobs.Register("build-log-entries-indexes", scheduler.Every(config.BUILD_ENTRY_INDEXES_INTERVAL), func(ctx context.Context) error {
+		return processor.BuildEntryIndexes(ctx, dbPool)
+	})
+	jobs.Register("apply-retention", scheduler.MustParseCron("0 4 * * *"), func(ctx context.Context) error {
+		return processor.ApplyRetention(ctx, dbPool)
+	})
+	jobs.Register("archive-entries", scheduler.MustParseCron("0 5 * * *"), func(ctx context.Context) error {
+		return processor.ArchiveEntries(ctx, dbPool)
+	})
+	jobs.Register("restore-archives", scheduler.Every(config.RESTORE_ARCHIVES_INTERVAL), func(ctx context.Context) error {
+		restored, err := processor.RestoreArchives(ctx, dbPool)
+		if restored > 0 {
+			log.Info().Msgf("Completed %d archive restores", restored)
+		}
+		return err
+	})
+	return jobs
 }
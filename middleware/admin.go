@@ -0,0 +1,18 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireAdmin must run after Authenticate, it rejects the users without the admin role
+func RequireAdmin(ctx *gin.Context) {
+	if role := ctx.GetString("role"); role != "admin" {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error": "Forbidden",
+		})
+		return
+	}
+	ctx.Next()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	db "iis-logs-parser/database"
+	"os"
+	"strconv"
+	"time"
+)
+
+const migrateUsage = "usage: iis-logs-parser migrate up | down [steps] | status"
+
+// runMigrateCommand runs "migrate up|down|status" and returns the exit code, reverting one migration by default
+func runMigrateCommand(args []string) int {
+	if len(args) == 0 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	ctx := context.Background()
+	dbPool, err := db.NewPgxPool(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to connect to database: %v\n", err)
+		return 1
+	}
+	defer dbPool.Close()
+
+	switch args[0] {
+	case "up":
+		applied, err := db.MigrateUp(ctx, dbPool)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to migrate: %v\n", err)
+			return 1
+		}
+		fmt.Printf("applied %d migrations\n", applied)
+	case "down":
+		steps := 1
+		if len(args) == 2 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				fmt.Fprintln(os.Stderr, migrateUsage)
+				return 2
+			}
+		}
+		reverted, err := db.MigrateDown(ctx, dbPool, steps)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to revert migrations: %v\n", err)
+			return 1
+		}
+		fmt.Printf("reverted %d migrations\n", reverted)
+	case "status":
+		statuses, err := db.GetMigrationStatus(ctx, dbPool)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to get migration status: %v\n", err)
+			return 1
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.AppliedAt != nil {
+				state = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			if status.Missing {
+				state += " (no migration file in this build)"
+			}
+			fmt.Printf("%04d %-40s %s\n", status.Version, status.Name, state)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	return 0
+}
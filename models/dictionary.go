@@ -0,0 +1,15 @@
+package models
+
+// DictionaryValue is a distinct value of a dictionary-encoded log_entries column, the entries only store its id
+type DictionaryValue struct {
+	ID    int32  `gorm:"primarykey"`
+	Value string `gorm:"type:text;not null"`
+	Hash  []byte `gorm:"type:bytea;not null;uniqueIndex"` // SHA-256 of the value, long values don't fit in a btree index
+}
+
+// Lookup tables of the dictionary-encoded columns
+type (
+	ServerIP  struct{ DictionaryValue }
+	URIStem   struct{ DictionaryValue }
+	UserAgent struct{ DictionaryValue }
+)
@@ -2,6 +2,7 @@ package models
 
 import (
 	"iis-logs-parser/utils"
+	"time"
 
 	"gorm.io/gorm"
 )
@@ -18,6 +19,19 @@ type Domain struct {
 	BusinessSector string `json:"businessSector" gorm:"type:varchar(255)"  validate:"required"`     // Business sector
 	IsSubdomain    bool   `json:"isSubdomain" gorm:"default:false"`                                 // Boolean for subdomain status
 	Default        bool   `json:"default" gorm:"default:false"`                                     // Boolean for default domain status
+	FollowPath     string `json:"followPath" gorm:"type:varchar(1024)"`                             // Local log file or directory continuously ingested, relative to FOLLOW_ROOT_DIR, only set by admins
+
+	// Retention periods in days, nil applies the global default and 0 keeps the data forever
+	EntriesRetentionDays   *int `json:"entriesRetentionDays" validate:"omitempty,min=0"`   // Raw log entries, by entry timestamp
+	FilesRetentionDays     *int `json:"filesRetentionDays" validate:"omitempty,min=0"`     // Uploaded files kept for reprocessing, by upload date
+	SummariesRetentionDays *int `json:"summariesRetentionDays" validate:"omitempty,min=0"` // Stats and aggregates, by the file's last entry
+	// Entries older than this many days are moved to the archives, nil applies the global default and 0 never archives them
+	ArchiveAfterDays *int `json:"archiveAfterDays" validate:"omitempty,min=0"`
+	// Limits of the domain, on top of those of its user
+	Quotas Quotas `json:"quotas" gorm:"embedded;embeddedPrefix:quota_"`
+
+	// Set when the domain is deleted, it's removed for good once its log files are
+	DeletingAt *time.Time `json:"-"`
 }
 type DomainUpdateRequest struct {
 	DomainName     *string `json:"domainName,omitempty"`
@@ -27,6 +41,13 @@ type DomainUpdateRequest struct {
 	BusinessSector *string `json:"businessSector,omitempty"`
 	IsSubdomain    *bool   `json:"isSubdomain,omitempty"`
 	Default        *bool   `json:"default,omitempty"`
+
+	EntriesRetentionDays   *int `json:"entriesRetentionDays,omitempty"`
+	FilesRetentionDays     *int `json:"filesRetentionDays,omitempty"`
+	SummariesRetentionDays *int `json:"summariesRetentionDays,omitempty"`
+	ArchiveAfterDays       *int `json:"archiveAfterDays,omitempty"`
+	// Replaces all the quotas of the domain
+	Quotas *Quotas `json:"quotas,omitempty"`
 }
 
 func (d *Domain) Validate() error {
@@ -55,4 +76,19 @@ func (d *Domain) PartialUpdate(update DomainUpdateRequest) {
 	if update.Default != nil {
 		d.Default = *update.Default
 	}
+	if update.EntriesRetentionDays != nil {
+		d.EntriesRetentionDays = update.EntriesRetentionDays
+	}
+	if update.FilesRetentionDays != nil {
+		d.FilesRetentionDays = update.FilesRetentionDays
+	}
+	if update.SummariesRetentionDays != nil {
+		d.SummariesRetentionDays = update.SummariesRetentionDays
+	}
+	if update.ArchiveAfterDays != nil {
+		d.ArchiveAfterDays = update.ArchiveAfterDays
+	}
+	if update.Quotas != nil {
+		d.Quotas = *update.Quotas
+	}
 }
@@ -0,0 +1,42 @@
+package models
+
+import "time"
+
+// EntryArchive is the catalog record of a compressed file holding the archived entries of a domain for a UTC day
+type EntryArchive struct {
+	ID         uint       `json:"id" gorm:"primarykey"`
+	DomainID   uint       `json:"domainId" gorm:"not null;index"`
+	Day        time.Time  `json:"day" gorm:"type:timestamp;not null"`      // Start of the day of the entries
+	Entries    int64      `json:"entries" gorm:"not null"`                 // Entries in the archive
+	Bytes      int64      `json:"bytes" gorm:"not null"`                   // Compressed size
+	SHA256     string     `json:"sha256" gorm:"type:varchar(64);not null"` // Checksum of the compressed file, verified on restore
+	Store      string     `json:"store" gorm:"type:varchar(20);not null"`  // "local" or "s3"
+	Key        string     `json:"key" gorm:"type:varchar(1024);not null"`  // Path of the file in its store
+	CreatedAt  time.Time  `json:"createdAt" gorm:"not null"`
+	RestoredAt *time.Time `json:"restoredAt"` // Set once its entries are back in log_entries, they are archived again after ARCHIVE_RESTORE_KEEP_DAYS
+}
+
+type RestoreStatus string
+
+const (
+	RestorePending   RestoreStatus = "pending"
+	RestoreRunning   RestoreStatus = "running"
+	RestoreCompleted RestoreStatus = "completed"
+	RestoreFailed    RestoreStatus = "failed"
+)
+
+// ArchiveRestore is a request to reload the archived entries of a time range into log_entries, run by the restore-archives job.
+// Whole archived days are restored, the days overlapping the range.
+type ArchiveRestore struct {
+	ID             uint          `json:"id" gorm:"primarykey"`
+	DomainID       uint          `json:"domainId" gorm:"not null;index"`
+	RangeStart     time.Time     `json:"from" gorm:"type:timestamp;not null"`
+	RangeEnd       time.Time     `json:"to" gorm:"type:timestamp;not null"`
+	Status         RestoreStatus `json:"status" gorm:"type:varchar(20);not null"`
+	Entries        int64         `json:"entries" gorm:"not null;default:0"`        // Entries reloaded
+	SkippedEntries int64         `json:"skippedEntries" gorm:"not null;default:0"` // Entries of deleted log files, or already in log_entries
+	Error          string        `json:"error,omitempty" gorm:"type:text"`
+	CreatedAt      time.Time     `json:"createdAt" gorm:"not null"`
+	StartedAt      *time.Time    `json:"startedAt"`
+	FinishedAt     *time.Time    `json:"finishedAt"`
+}
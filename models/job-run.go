@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+type JobRunStatus string
+
+const (
+	JobRunRunning   JobRunStatus = "running"
+	JobRunSucceeded JobRunStatus = "succeeded"
+	JobRunFailed    JobRunStatus = "failed"
+)
+
+type JobTrigger string
+
+const (
+	JobTriggerSchedule JobTrigger = "schedule"
+	JobTriggerManual   JobTrigger = "manual"
+)
+
+// JobRun is one run of a scheduled job, kept as the job's history
+type JobRun struct {
+	ID   uint   `json:"id" gorm:"primarykey"`
+	Name string `json:"name" gorm:"type:varchar(255);not null;uniqueIndex:idx_job_runs_name_scheduled_at;index:idx_job_runs_name_started_at,priority:1"`
+	// Run time the schedule fired for, unique per job so a run time is only handled by one replica. Null for manual runs
+	ScheduledAt *time.Time   `json:"scheduledAt" gorm:"uniqueIndex:idx_job_runs_name_scheduled_at"`
+	Trigger     JobTrigger   `json:"trigger" gorm:"type:varchar(20);not null"`
+	Status      JobRunStatus `json:"status" gorm:"type:varchar(20);not null"`
+	WorkerID    string       `json:"workerId" gorm:"type:varchar(255)"`
+	StartedAt   time.Time    `json:"startedAt" gorm:"not null;index:idx_job_runs_name_started_at,priority:2"`
+	FinishedAt  *time.Time   `json:"finishedAt"`
+	Error       string       `json:"error" gorm:"type:text"`
+}
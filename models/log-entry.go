@@ -2,31 +2,43 @@ package models
 
 import (
 	"fmt"
-
-	"gorm.io/gorm"
+	"time"
 )
 
 type LogEntry struct {
-	// IMPORTANT: This struct is used by both pgx (parser) and gorm (api)
-	// and MUST be auto migrated with gorm
-	gorm.Model
+	// IMPORTANT: This struct is used by both pgx (parser) and gorm (api),
+	// its partitioned table is created by the migrations in database/migrations.
+	// ServerIP, URIStem and UserAgent are dictionary-encoded, read the entries from the log_entries_resolved view to get them.
+	// Entries are append-only, they have no timestamps nor soft delete, deleting them removes them for good.
+	ID        uint `gorm:"primarykey"`
 	LogFileID uint // Foreign key to the owner file
 	LogFile   LogFile
 
+	LineNumber int64 // 1-based line number in the source file, gives back the original order of the entries
+	ByteOffset int64 // Offset of the line's first byte in the source file
+	LineSize   int64 `gorm:"-"` // Bytes of the line in the source file, not stored
+
+	Timestamp time.Time `gorm:"type:timestamp;not null"` // Date and Time, the table is partitioned on it
+
 	Date        string
 	Time        string
-	ServerIP    string
+	ServerIP    string `gorm:"->"`
 	Method      string
-	URIStem     string
+	URIStem     string `gorm:"->"`
 	URIQuery    string
 	Port        string
 	Username    string
 	ClientIP    string
-	UserAgent   string
+	UserAgent   string `gorm:"->"`
 	Status      string
 	SubStatus   string
 	Win32Status string
 	TimeTaken   string
+
+	// Ids of the values in the server_ips, uri_stems and user_agents lookup tables, set when the entry is inserted
+	ServerIPID  int32
+	URIStemID   int32
+	UserAgentID int32
 }
 
 func (entry *LogEntry) String() string {
@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// LogFileStats are the ingestion statistics of the last processing attempt of a log file
+type LogFileStats struct {
+	LogFileID       uint    `json:"logFileId" gorm:"primarykey;autoIncrement:false"`
+	LogFile         LogFile `json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	LinesRead       int64   `json:"linesRead"`
+	EntriesInserted int64   `json:"entriesInserted"`
+	RejectedLines   int64   `json:"rejectedLines"`  // Lines that couldn't be parsed
+	DuplicateLines  int64   `json:"duplicateLines"` // Lines identical to a previous line of the file, still inserted
+	// DuplicateLines is then a lower bound, only the duplicates of the first DUPLICATE_LINES_TRACKED distinct lines are counted
+	DuplicateLinesApproximate bool    `json:"duplicateLinesApproximate"`
+	FailedWrites              int64   `json:"failedWrites"`
+	BatchCount                int64   `json:"batchCount"`
+	BytesRead                 int64   `json:"bytesRead"`
+	LinesPerSecond            float64 `json:"linesPerSecond"`
+	BytesPerSecond            float64 `json:"bytesPerSecond"`
+	DurationMs                int64   `json:"durationMs"`
+	// Summed over the parsing goroutines and the insertion batches, so they can exceed the duration
+	ParsingTimeMs   int64           `json:"parsingTimeMs"`
+	InsertionTimeMs int64           `json:"insertionTimeMs"`
+	Summary         *LogFileSummary `json:"summary" gorm:"type:jsonb"`
+	UpdatedAt       time.Time       `json:"updatedAt"`
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// LogFileSummary is computed while a log file is ingested, so it can be shown without scanning its entries
+type LogFileSummary struct {
+	Entries      int64            `json:"entries"`
+	StatusCodes  map[string]int64 `json:"statusCodes"`
+	Methods      map[string]int64 `json:"methods"`
+	TopURIStems  []ValueCount     `json:"topUriStems"`
+	TopClientIPs []ValueCount     `json:"topClientIps"`
+	ClientErrors int64            `json:"clientErrors"` // 4xx responses
+	ServerErrors int64            `json:"serverErrors"` // 5xx responses
+	ErrorRate    float64          `json:"errorRate"`    // Share of 4xx and 5xx responses, between 0 and 1
+	// In milliseconds, over the entries with a valid time-taken
+	TimeTakenMin int64   `json:"timeTakenMin"`
+	TimeTakenMax int64   `json:"timeTakenMax"`
+	TimeTakenAvg float64 `json:"timeTakenAvg"`
+}
+
+type ValueCount struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// Value stores the summary as JSON
+func (s LogFileSummary) Value() (driver.Value, error) {
+	return json.Marshal(s)
+}
+
+func (s *LogFileSummary) Scan(value any) error {
+	switch v := value.(type) {
+	case []byte:
+		return json.Unmarshal(v, s)
+	case string:
+		return json.Unmarshal([]byte(v), s)
+	default:
+		return fmt.Errorf("unsupported type for LogFileSummary: %T", value)
+	}
+}
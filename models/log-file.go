@@ -1,6 +1,8 @@
 package models
 
 import (
+	"path/filepath"
+	"strconv"
 	"time"
 
 	"gorm.io/gorm"
@@ -13,6 +15,8 @@ const (
 	StatusProcessing Status = "processing"
 	StatusCompleted  Status = "completed"
 	StatusFailed     Status = "failed"
+	StatusFollowing  Status = "following" // Still being appended to, ingested by the follow mode
+	StatusDeleting   Status = "deleting"  // Soft deleted, its entries and stored copy are being removed in the background
 )
 
 type LogFile struct {
@@ -30,4 +34,21 @@ type LogFile struct {
 	StartTimestamp *time.Time `gorm:"type:timestamp"`             // The timestamp of the oldest log in the log file.
 	EndTimestamp   *time.Time `gorm:"type:timestamp"`             // The timestamp of the most recent log in the log file.
 	ParsingTime    int64      ``                                  // The time taken to parse the log file.
+	ProcessedAt    *time.Time ``                                  // Last time the log file was processed successfully, nil if never.
+	SourcePath     string     `gorm:"size:1024" json:"-"`         // Location of the original file when picked up from a drop folder.
+	LeaseOwner     string     `gorm:"size:255"`                   // Worker processing the file, empty when not processing.
+	LeaseExpiresAt *time.Time ``                                  // Processing files are requeued when their lease isn't renewed by then.
+	Attempts       int        `gorm:"not null;default:0"`         // Number of times the file was picked for processing.
+	LastError      string     `gorm:"type:text"`                  // Why the last processing attempt failed.
+	NextRetryAt    *time.Time ``                                  // Pending files aren't picked before this time after a transient failure.
+	Priority       int        `gorm:"not null;default:0"`         // Higher priority files of a user are processed before its other files.
+	QueuePosition  *int64     `gorm:"-"`                          // Position of a pending file in the processing queue, starting at 1.
+	FilePurgedAt   *time.Time ``                                  // When the uploaded file was deleted by the retention policy, it can't be reprocessed since.
+	Entries        int64      `gorm:"not null;default:0"`         // Entries of the file in log_entries, counted against the entries quota.
+	StoredBytes    int64      `gorm:"not null;default:0"`         // Size of the copy kept in uploaded_logs, counted against the storage quota.
+}
+
+// StoragePath is where the uploaded file is kept on disk while it waits to be (re)processed
+func (f *LogFile) StoragePath() string {
+	return filepath.Join("uploaded_logs", f.Name+"-"+strconv.FormatUint(uint64(f.ID), 10))
 }
@@ -0,0 +1,157 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RollupGranularity string
+
+const (
+	RollupMinute RollupGranularity = "minute"
+	RollupHour   RollupGranularity = "hour"
+	RollupDay    RollupGranularity = "day"
+)
+
+// RollupGranularities are the bucket sizes every entry is rolled up into
+var RollupGranularities = map[RollupGranularity]time.Duration{
+	RollupMinute: time.Minute,
+	RollupHour:   time.Hour,
+	RollupDay:    24 * time.Hour,
+}
+
+// RollupLatencyBounds are the upper bounds in milliseconds of the latency histogram buckets,
+// the histogram has one more bucket for the slower requests
+var RollupLatencyBounds = []int64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// LogRollup aggregates the entries of a log file over a time bucket.
+// Rollups are kept per file so they can be corrected when it's deleted or reprocessed, domain rollups are their sum.
+type LogRollup struct {
+	LogFileID   uint              `json:"logFileId,omitempty" gorm:"primaryKey;autoIncrement:false"`
+	LogFile     LogFile           `json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	Granularity RollupGranularity `json:"granularity" gorm:"primaryKey;type:varchar(10);index:idx_log_rollups_domain,priority:2"`
+	Bucket      time.Time         `json:"bucket" gorm:"primaryKey;type:timestamp;index:idx_log_rollups_domain,priority:3"` // Start of the bucket, UTC
+	DomainID    uint              `json:"domainId" gorm:"not null;index:idx_log_rollups_domain,priority:1"`
+
+	Requests  int64 `json:"requests" gorm:"not null"`
+	Status1xx int64 `json:"status1xx" gorm:"not null"`
+	Status2xx int64 `json:"status2xx" gorm:"not null"`
+	Status3xx int64 `json:"status3xx" gorm:"not null"`
+	Status4xx int64 `json:"status4xx" gorm:"not null"`
+	Status5xx int64 `json:"status5xx" gorm:"not null"`
+	// Size of the raw log lines, the supported fields have no sc-bytes
+	LogBytes int64 `json:"logBytes" gorm:"not null"`
+	// In milliseconds, over the requests with a valid time-taken
+	TimedRequests    int64            `json:"timedRequests" gorm:"not null"`
+	TimeTakenSum     int64            `json:"timeTakenSum" gorm:"not null"`
+	TimeTakenMin     *int64           `json:"timeTakenMin"`
+	TimeTakenMax     *int64           `json:"timeTakenMax"`
+	LatencyHistogram LatencyHistogram `json:"latencyHistogram" gorm:"type:bigint[];not null"` // Requests per RollupLatencyBounds bucket
+}
+
+// Add counts the entry in the rollup
+func (r *LogRollup) Add(entry *LogEntry) {
+	r.Requests++
+	r.LogBytes += entry.LineSize
+	switch {
+	case strings.HasPrefix(entry.Status, "1"):
+		r.Status1xx++
+	case strings.HasPrefix(entry.Status, "2"):
+		r.Status2xx++
+	case strings.HasPrefix(entry.Status, "3"):
+		r.Status3xx++
+	case strings.HasPrefix(entry.Status, "4"):
+		r.Status4xx++
+	case strings.HasPrefix(entry.Status, "5"):
+		r.Status5xx++
+	}
+
+	timeTaken, err := strconv.ParseInt(entry.TimeTaken, 10, 64)
+	if err != nil {
+		return
+	}
+	r.TimedRequests++
+	r.TimeTakenSum += timeTaken
+	if r.TimeTakenMin == nil || timeTaken < *r.TimeTakenMin {
+		r.TimeTakenMin = &timeTaken
+	}
+	if r.TimeTakenMax == nil || timeTaken > *r.TimeTakenMax {
+		r.TimeTakenMax = &timeTaken
+	}
+	if r.LatencyHistogram == nil {
+		r.LatencyHistogram = make(LatencyHistogram, len(RollupLatencyBounds)+1)
+	}
+	bucket := len(RollupLatencyBounds)
+	for i, bound := range RollupLatencyBounds {
+		if timeTaken <= bound {
+			bucket = i
+			break
+		}
+	}
+	r.LatencyHistogram[bucket]++
+}
+
+// Merge adds the counts of other to the rollup
+func (r *LogRollup) Merge(other *LogRollup) {
+	r.Requests += other.Requests
+	r.Status1xx += other.Status1xx
+	r.Status2xx += other.Status2xx
+	r.Status3xx += other.Status3xx
+	r.Status4xx += other.Status4xx
+	r.Status5xx += other.Status5xx
+	r.LogBytes += other.LogBytes
+	r.TimedRequests += other.TimedRequests
+	r.TimeTakenSum += other.TimeTakenSum
+	if other.TimeTakenMin != nil && (r.TimeTakenMin == nil || *other.TimeTakenMin < *r.TimeTakenMin) {
+		r.TimeTakenMin = other.TimeTakenMin
+	}
+	if other.TimeTakenMax != nil && (r.TimeTakenMax == nil || *other.TimeTakenMax > *r.TimeTakenMax) {
+		r.TimeTakenMax = other.TimeTakenMax
+	}
+	if len(other.LatencyHistogram) > len(r.LatencyHistogram) {
+		r.LatencyHistogram = append(r.LatencyHistogram, make(LatencyHistogram, len(other.LatencyHistogram)-len(r.LatencyHistogram))...)
+	}
+	for i, count := range other.LatencyHistogram {
+		r.LatencyHistogram[i] += count
+	}
+}
+
+// LatencyHistogram is stored as a Postgres bigint[]
+type LatencyHistogram []int64
+
+func (h LatencyHistogram) Value() (driver.Value, error) {
+	values := make([]string, len(h))
+	for i, count := range h {
+		values[i] = strconv.FormatInt(count, 10)
+	}
+	return "{" + strings.Join(values, ",") + "}", nil
+}
+
+func (h *LatencyHistogram) Scan(value any) error {
+	var s string
+	switch v := value.(type) {
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	default:
+		return fmt.Errorf("unsupported type for LatencyHistogram: %T", value)
+	}
+
+	s = strings.Trim(s, "{}")
+	*h = LatencyHistogram{}
+	if s == "" {
+		return nil
+	}
+	for _, value := range strings.Split(s, ",") {
+		count, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid LatencyHistogram value %q: %w", value, err)
+		}
+		*h = append(*h, count)
+	}
+	return nil
+}
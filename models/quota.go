@@ -0,0 +1,36 @@
+package models
+
+// Quotas are the limits set on a user or a domain, nil applies the default and 0 is unlimited.
+// The default of a user is the global QUOTA_* setting, a domain has no limit of its own by default.
+type Quotas struct {
+	MaxFileSize      *int64 `json:"maxFileSize" validate:"omitempty,min=0"`      // Bytes of an uploaded file
+	MaxStoredBytes   *int64 `json:"maxStoredBytes" validate:"omitempty,min=0"`   // Bytes of the uploaded files kept for reprocessing
+	MaxEntries       *int64 `json:"maxEntries" validate:"omitempty,min=0"`       // Log entries in the database
+	MaxUploadsPerDay *int64 `json:"maxUploadsPerDay" validate:"omitempty,min=0"` // Uploaded files per UTC day
+}
+
+// QuotaLimits are the quotas in effect, 0 is unlimited
+type QuotaLimits struct {
+	MaxFileSize      int64 `json:"maxFileSize"`
+	MaxStoredBytes   int64 `json:"maxStoredBytes"`
+	MaxEntries       int64 `json:"maxEntries"`
+	MaxUploadsPerDay int64 `json:"maxUploadsPerDay"`
+}
+
+// Usage is what counts against the quotas, deleted files don't count anymore
+type Usage struct {
+	StoredBytes  int64 `json:"storedBytes"`
+	Entries      int64 `json:"entries"`
+	UploadsToday int64 `json:"uploadsToday"`
+}
+
+type QuotaUsage struct {
+	Limits QuotaLimits `json:"limits"`
+	Usage  Usage       `json:"usage"`
+}
+
+type DomainQuotaUsage struct {
+	DomainID   uint   `json:"domainId"`
+	DomainName string `json:"domainName"`
+	QuotaUsage
+}
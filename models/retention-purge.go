@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// RetentionTarget is the kind of data removed by the retention policy
+type RetentionTarget string
+
+const (
+	RetentionEntries   RetentionTarget = "entries"   // Raw log entries
+	RetentionFiles     RetentionTarget = "files"     // Uploaded files in uploaded_logs
+	RetentionSummaries RetentionTarget = "summaries" // Stats, summaries and rollups
+)
+
+// RetentionPurge records data removed by the retention job
+type RetentionPurge struct {
+	ID        uint            `json:"id" gorm:"primarykey"`
+	Target    RetentionTarget `json:"target" gorm:"type:varchar(20);not null"`
+	DomainID  *uint           `json:"domainId" gorm:"index"`              // Nil when a whole partition was dropped
+	Partition string          `json:"partition" gorm:"type:varchar(255)"` // Dropped log_entries partition
+	Cutoff    time.Time       `json:"cutoff" gorm:"not null"`             // Data older than this was removed
+	Rows      int64           `json:"rows" gorm:"not null"`               // Entries, files or stats removed
+	Bytes     int64           `json:"bytes" gorm:"not null;default:0"`    // Disk space freed by the removed files
+	PurgedAt  time.Time       `json:"purgedAt" gorm:"not null;index"`
+}
@@ -22,6 +22,8 @@ type User struct {
 	// If the user is not verified, LastLoginAt used as the last verification email sent
 	LastLoginAt time.Time
 	Verified    bool
+	// Only set by the admins
+	Quotas Quotas `json:"quotas" gorm:"embedded;embeddedPrefix:quota_"`
 }
 
 func (u *User) Validate() error {
@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+type WorkerStatus string
+
+const (
+	WorkerStatusRunning  WorkerStatus = "running"
+	WorkerStatusStopping WorkerStatus = "stopping" // Finishing its files before exiting
+	WorkerStatusStopped  WorkerStatus = "stopped"
+)
+
+// Worker is an ingestion process, reported by its heartbeat
+type Worker struct {
+	ID                 string       `json:"id" gorm:"type:varchar(255);primarykey"` // Also the owner of its leases
+	Hostname           string       `json:"hostname" gorm:"type:varchar(255)"`
+	Pid                int          `json:"pid"`
+	Mode               string       `json:"mode" gorm:"type:varchar(20)"`
+	Status             WorkerStatus `json:"status" gorm:"type:varchar(20);not null"`
+	ActiveFiles        int          `json:"activeFiles"`
+	MaxConcurrentFiles int          `json:"maxConcurrentFiles"`
+	StartedAt          time.Time    `json:"startedAt"`
+	HeartbeatAt        time.Time    `json:"heartbeatAt" gorm:"index"`
+	// A worker that isn't stopped but missed its heartbeats is most likely dead, not stored
+	Online bool `json:"online" gorm:"-"`
+}
@@ -1,11 +1,11 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
 	"iis-logs-parser/models"
 	"strings"
-
-	"github.com/rs/zerolog/log"
+	"time"
 )
 
 const (
@@ -14,9 +14,13 @@ const (
 
 var FIELDS_LEN = len(strings.Split(strings.Replace(FIELDS_DEF, "#Fields: ", "", 1), " "))
 
+// ErrUnsupportedFields is returned for a #Fields directive other than FIELDS_DEF, the lines following it can't be parsed
+var ErrUnsupportedFields = errors.New("incorrect fields format, must be: " + FIELDS_DEF)
+
 type ParseError struct {
-	Line    string
-	Message string
+	Line       string
+	LineNumber int64 // 1-based position of the line in its file, 0 if unknown
+	Message    string
 }
 
 func (e *ParseError) Error() string {
@@ -27,7 +31,7 @@ func ParseLogLine(line string) (*models.LogEntry, error) {
 	if strings.HasPrefix(line, "#") || len(strings.TrimSpace(line)) == 0 {
 		if strings.HasPrefix(line, "#Fields:") {
 			if line != FIELDS_DEF {
-				log.Fatal().Msgf("Incorrect fields format\nMust be: %v", FIELDS_DEF)
+				return nil, ErrUnsupportedFields
 			}
 		}
 		return nil, nil
@@ -42,7 +46,16 @@ func ParseLogLine(line string) (*models.LogEntry, error) {
 		}
 	}
 
+	timestamp, err := time.Parse(time.DateTime, fields[0]+" "+fields[1])
+	if err != nil {
+		return nil, &ParseError{
+			Line:    line,
+			Message: fmt.Sprintf("Invalid date and time: %s %s", fields[0], fields[1]),
+		}
+	}
+
 	entry := &models.LogEntry{
+		Timestamp:   timestamp,
 		Date:        fields[0],
 		Time:        fields[1],
 		ServerIP:    fields[2],
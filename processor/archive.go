@@ -0,0 +1,440 @@
+package processor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"iis-logs-parser/config"
+	"iis-logs-parser/models"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Entries restored per COPY
+	archiveRestoreBatchSize = 10000
+	// Temporary table the restored entries are copied to, before being added to log_entries
+	archiveRestoreTable = "archive_restore_entries"
+)
+
+// Archives hold the entries of a UTC day
+const archivePeriod = 24 * time.Hour
+
+// ArchiveEntries moves the entries older than the archive threshold of their domain to the archive store, a file per domain and UTC day.
+// Only the entries of completed or failed files are archived, and the days restored within ARCHIVE_RESTORE_KEEP_DAYS are left in the database.
+// Each day is exported and deleted in one transaction, and recorded in entry_archives.
+func ArchiveEntries(ctx context.Context, dbPool *pgxpool.Pool) error {
+	rows, err := dbPool.Query(ctx,
+		"SELECT id, COALESCE(archive_after_days, $1) FROM domains WHERE deleting_at IS NULL ORDER BY id",
+		config.GetArchiveAfterDays(),
+	)
+	if err != nil {
+		return err
+	}
+	var thresholds [][2]int
+	var domainId, days int
+	_, err = pgx.ForEachRow(rows, []any{&domainId, &days}, func() error {
+		if days > 0 {
+			thresholds = append(thresholds, [2]int{domainId, days})
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load archive thresholds: %w", err)
+	}
+
+	store := newArchiveStore()
+	today := time.Now().UTC().Truncate(archivePeriod)
+	var errs []error
+	for _, t := range thresholds {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := archiveDomain(ctx, dbPool, store, uint(t[0]), today.AddDate(0, 0, -t[1])); err != nil {
+			errs = append(errs, fmt.Errorf("domain %d: %w", t[0], err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func archiveDomain(ctx context.Context, dbPool *pgxpool.Pool, store archiveStore, domainId uint, cutoff time.Time) error {
+	restoredSince := time.Now().AddDate(0, 0, -config.GetArchiveRestoreKeepDaysOrDefault())
+	rows, err := dbPool.Query(ctx,
+		`SELECT DISTINCT date_trunc('day', e.timestamp) AS day FROM `+LogEntriesTable+` e
+		JOIN log_files f ON f.id = e.log_file_id
+		WHERE f.domain_id = $1 AND f.status IN ($3, $4) AND e.timestamp < $2
+		AND NOT EXISTS (
+			SELECT 1 FROM entry_archives a
+			WHERE a.domain_id = $1 AND a.day = date_trunc('day', e.timestamp) AND a.restored_at >= $5
+		)
+		ORDER BY day`,
+		domainId, cutoff, models.StatusCompleted, models.StatusFailed, restoredSince,
+	)
+	if err != nil {
+		return err
+	}
+	days, err := pgx.CollectRows(rows, pgx.RowTo[time.Time])
+	if err != nil {
+		return err
+	}
+
+	for _, d := range days {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := archiveDay(ctx, dbPool, store, domainId, d); err != nil {
+			return fmt.Errorf("day %s: %w", d.Format(time.DateOnly), err)
+		}
+	}
+	return nil
+}
+
+// archiveDay exports the entries of the day to a temporary file, stores it, then deletes them.
+// The repeatable read transaction deletes exactly the exported entries, a concurrent change to them fails it.
+func archiveDay(ctx context.Context, dbPool *pgxpool.Pool, store archiveStore, domainId uint, d time.Time) error {
+	tmp, err := os.CreateTemp("", "archive-*.ndjson.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	now := time.Now().UTC()
+	archive := models.EntryArchive{
+		DomainID:  domainId,
+		Day:       d,
+		Store:     store.Name(),
+		Key:       fmt.Sprintf("domain-%d/%s-%d.ndjson.gz", domainId, d.Format(time.DateOnly), now.Unix()),
+		CreatedAt: now,
+	}
+	stored := false
+	var replaced []models.EntryArchive
+
+	err = pgx.BeginTxFunc(ctx, dbPool, pgx.TxOptions{IsoLevel: pgx.RepeatableRead}, func(tx pgx.Tx) error {
+		writer, err := NewArchiveWriter(tmp, ArchiveHeader{DomainID: domainId, Day: d, CreatedAt: now})
+		if err != nil {
+			return err
+		}
+		rows, err := tx.Query(ctx,
+			`SELECT e.log_file_id, e.line_number, e.byte_offset, e.timestamp, e.date, e.time, e.server_ip, e.method, e.uri_stem, e.uri_query,
+				e.port, e.username, e.client_ip, e.user_agent, e.status, e.sub_status, e.win32_status, e.time_taken
+			FROM log_entries_resolved e
+			JOIN log_files f ON f.id = e.log_file_id
+			WHERE f.domain_id = $1 AND f.status IN ($4, $5) AND e.timestamp >= $2 AND e.timestamp < $3
+			ORDER BY e.log_file_id, e.line_number`,
+			domainId, d, d.Add(archivePeriod), models.StatusCompleted, models.StatusFailed,
+		)
+		if err != nil {
+			return err
+		}
+		var e models.LogEntry
+		fileEntries := map[uint]int64{}
+		_, err = pgx.ForEachRow(rows, []any{
+			&e.LogFileID, &e.LineNumber, &e.ByteOffset, &e.Timestamp, &e.Date, &e.Time, &e.ServerIP, &e.Method, &e.URIStem, &e.URIQuery,
+			&e.Port, &e.Username, &e.ClientIP, &e.UserAgent, &e.Status, &e.SubStatus, &e.Win32Status, &e.TimeTaken,
+		}, func() error {
+			fileEntries[e.LogFileID]++
+			return writer.Write(&e)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to export entries: %w", err)
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		if writer.Entries() == 0 {
+			return nil
+		}
+
+		archive.Entries, archive.Bytes, archive.SHA256 = writer.Entries(), writer.Bytes(), writer.SHA256()
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := store.Put(ctx, archive.Key, tmp, archive.Bytes, archive.SHA256); err != nil {
+			return fmt.Errorf("failed to store archive: %w", err)
+		}
+		stored = true
+
+		err = tx.QueryRow(ctx,
+			`INSERT INTO entry_archives (domain_id, day, entries, bytes, sha256, store, key, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+			archive.DomainID, archive.Day, archive.Entries, archive.Bytes, archive.SHA256, archive.Store, archive.Key, archive.CreatedAt,
+		).Scan(&archive.ID)
+		if err != nil {
+			return err
+		}
+
+		// The entries of the restored archives of the day are in the new one
+		rows, err = tx.Query(ctx,
+			"DELETE FROM entry_archives WHERE domain_id = $1 AND day = $2 AND restored_at IS NOT NULL RETURNING id, store, key",
+			domainId, d,
+		)
+		if err != nil {
+			return err
+		}
+		replaced, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (models.EntryArchive, error) {
+			var a models.EntryArchive
+			err := row.Scan(&a.ID, &a.Store, &a.Key)
+			return a, err
+		})
+		if err != nil {
+			return err
+		}
+
+		tag, err := tx.Exec(ctx,
+			`DELETE FROM `+LogEntriesTable+` e USING log_files f
+			WHERE f.id = e.log_file_id AND f.domain_id = $1 AND f.status IN ($4, $5) AND e.timestamp >= $2 AND e.timestamp < $3`,
+			domainId, d, d.Add(archivePeriod), models.StatusCompleted, models.StatusFailed,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to delete archived entries: %w", err)
+		}
+		if tag.RowsAffected() != archive.Entries {
+			return fmt.Errorf("deleted %d entries, but archived %d", tag.RowsAffected(), archive.Entries)
+		}
+		// Archived entries don't count against the entries quota
+		fileIds := make([]uint, 0, len(fileEntries))
+		counts := make([]int64, 0, len(fileEntries))
+		for fileId, count := range fileEntries {
+			fileIds = append(fileIds, fileId)
+			counts = append(counts, count)
+		}
+		_, err = tx.Exec(ctx,
+			`UPDATE log_files f SET entries = GREATEST(f.entries - c.count, 0)
+			FROM unnest($1::bigint[], $2::bigint[]) AS c(log_file_id, count)
+			WHERE f.id = c.log_file_id`,
+			fileIds, counts,
+		)
+		return err
+	})
+	if err != nil {
+		if stored {
+			if deleteErr := store.Delete(context.Background(), archive.Key); deleteErr != nil {
+				log.Err(deleteErr).Str("key", archive.Key).Msg("Archives: failed to delete the archive of a failed day")
+			}
+		}
+		return err
+	}
+	if !stored {
+		return nil
+	}
+
+	for _, a := range replaced {
+		deleteArchiveFile(ctx, store, a)
+	}
+	log.Info().Uint("domainId", domainId).Time("day", d).Int64("entries", archive.Entries).Int64("bytes", archive.Bytes).Str("key", archive.Key).
+		Msg("Archives: archived log entries")
+	return nil
+}
+
+// deleteArchiveFile deletes the file of an archive whose record is gone, a failure only leaves an orphan file
+func deleteArchiveFile(ctx context.Context, store archiveStore, a models.EntryArchive) {
+	if a.Store != store.Name() {
+		log.Warn().Uint("archiveId", a.ID).Str("store", a.Store).Str("key", a.Key).Msg("Archives: archive of another store left in place")
+		return
+	}
+	if err := store.Delete(ctx, a.Key); err != nil {
+		log.Err(err).Uint("archiveId", a.ID).Str("key", a.Key).Msg("Archives: failed to delete archive")
+	}
+}
+
+// removeDomainArchives deletes the archives of a domain, their records and its restores
+func removeDomainArchives(ctx context.Context, dbPool *pgxpool.Pool, domainId uint) error {
+	rows, err := dbPool.Query(ctx, "DELETE FROM entry_archives WHERE domain_id = $1 RETURNING id, store, key", domainId)
+	if err != nil {
+		return err
+	}
+	archives, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (models.EntryArchive, error) {
+		var a models.EntryArchive
+		err := row.Scan(&a.ID, &a.Store, &a.Key)
+		return a, err
+	})
+	if err != nil {
+		return err
+	}
+	store := newArchiveStore()
+	for _, a := range archives {
+		deleteArchiveFile(ctx, store, a)
+	}
+	_, err = dbPool.Exec(ctx, "DELETE FROM archive_restores WHERE domain_id = $1", domainId)
+	return err
+}
+
+// RestoreArchives runs the pending archive restores, oldest first, and returns how many completed.
+// Restores left running by an interrupted run are started again, the archives they restored are skipped.
+func RestoreArchives(ctx context.Context, dbPool *pgxpool.Pool) (int, error) {
+	// The job never runs twice at the same time, running restores are those of an interrupted run
+	_, err := dbPool.Exec(ctx, "UPDATE archive_restores SET status = $1 WHERE status = $2", models.RestorePending, models.RestoreRunning)
+	if err != nil {
+		return 0, err
+	}
+
+	store := newArchiveStore()
+	completed := 0
+	for ctx.Err() == nil {
+		var r models.ArchiveRestore
+		err := dbPool.QueryRow(ctx,
+			`UPDATE archive_restores SET status = $1, started_at = now()
+			WHERE id = (SELECT id FROM archive_restores WHERE status = $2 ORDER BY id LIMIT 1)
+			RETURNING id, domain_id, range_start, range_end`,
+			models.RestoreRunning, models.RestorePending,
+		).Scan(&r.ID, &r.DomainID, &r.RangeStart, &r.RangeEnd)
+		if errors.Is(err, pgx.ErrNoRows) {
+			break
+		}
+		if err != nil {
+			return completed, err
+		}
+
+		r.Status = models.RestoreCompleted
+		if err := restoreRange(ctx, dbPool, store, &r); err != nil {
+			if ctx.Err() != nil {
+				// Started again by the next run
+				return completed, ctx.Err()
+			}
+			log.Err(err).Uint("restoreId", r.ID).Uint("domainId", r.DomainID).Msg("Archives: restore failed")
+			r.Status, r.Error = models.RestoreFailed, err.Error()
+		} else {
+			completed++
+		}
+		_, err = dbPool.Exec(ctx,
+			"UPDATE archive_restores SET status = $2, entries = $3, skipped_entries = $4, error = NULLIF($5, ''), finished_at = now() WHERE id = $1",
+			r.ID, r.Status, r.Entries, r.SkippedEntries, r.Error,
+		)
+		if err != nil {
+			return completed, err
+		}
+	}
+	return completed, ctx.Err()
+}
+
+// restoreRange restores the archives of the days overlapping the range of the restore, one transaction each
+func restoreRange(ctx context.Context, dbPool *pgxpool.Pool, store archiveStore, r *models.ArchiveRestore) error {
+	rows, err := dbPool.Query(ctx,
+		`SELECT id, domain_id, day, entries, sha256, store, key FROM entry_archives
+		WHERE domain_id = $1 AND restored_at IS NULL AND day < $3 AND day + interval '1 day' > $2
+		ORDER BY day, id`,
+		r.DomainID, r.RangeStart, r.RangeEnd,
+	)
+	if err != nil {
+		return err
+	}
+	archives, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (models.EntryArchive, error) {
+		var a models.EntryArchive
+		err := row.Scan(&a.ID, &a.DomainID, &a.Day, &a.Entries, &a.SHA256, &a.Store, &a.Key)
+		return a, err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, a := range archives {
+		if a.Store != store.Name() {
+			return fmt.Errorf("archive %d is in the %s store, but the %s store is configured", a.ID, a.Store, store.Name())
+		}
+		restored, err := restoreArchive(ctx, dbPool, store, a)
+		if err != nil {
+			return fmt.Errorf("archive %d: %w", a.ID, err)
+		}
+		r.Entries += restored
+		r.SkippedEntries += a.Entries - restored
+		log.Info().Uint("archiveId", a.ID).Uint("domainId", a.DomainID).Time("day", a.Day).Int64("entries", restored).Msg("Archives: restored archive")
+	}
+	return nil
+}
+
+// restoreArchive adds the entries of the archive back to log_entries, except those of deleted log files and those already there,
+// e.g. when their file was reprocessed. The archive is verified against its checksum before the transaction commits.
+// Their rollups were never removed, only the entries are restored. Returns the number of restored entries.
+func restoreArchive(ctx context.Context, dbPool *pgxpool.Pool, store archiveStore, a models.EntryArchive) (int64, error) {
+	body, err := store.Get(ctx, a.Key)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	hash := sha256.New()
+	reader := io.TeeReader(body, hash)
+
+	var restored int64
+	err = pgx.BeginFunc(ctx, dbPool, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "CREATE TEMP TABLE "+archiveRestoreTable+" (LIKE "+LogEntriesTable+" INCLUDING DEFAULTS) ON COMMIT DROP")
+		if err != nil {
+			return err
+		}
+
+		batch := make([]*models.LogEntry, 0, archiveRestoreBatchSize)
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			if err := ensureBatchPartitions(ctx, dbPool, batch); err != nil {
+				return err
+			}
+			if err := encodeBatch(ctx, dbPool, batch); err != nil {
+				return err
+			}
+			if _, err := copyEntries(ctx, tx, archiveRestoreTable, batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+			return nil
+		}
+		header, err := ReadArchive(reader, func(entry *models.LogEntry) error {
+			batch = append(batch, entry)
+			if len(batch) == archiveRestoreBatchSize {
+				return flush()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if header.DomainID != a.DomainID || !header.Day.Equal(a.Day) {
+			return fmt.Errorf("archive holds day %s of domain %d", header.Day.Format(time.DateOnly), header.DomainID)
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.Discard, reader); err != nil {
+			return err
+		}
+		if checksum := hex.EncodeToString(hash.Sum(nil)); checksum != a.SHA256 {
+			return fmt.Errorf("checksum mismatch, got %s", checksum)
+		}
+
+		// The restored entries count against the entries quota again
+		columns := strings.Join(logEntryColumns, ", ")
+		err = tx.QueryRow(ctx,
+			`WITH inserted AS (
+				INSERT INTO `+LogEntriesTable+` (`+columns+`)
+				SELECT `+columns+` FROM `+archiveRestoreTable+` t
+				WHERE EXISTS (SELECT 1 FROM log_files f WHERE f.id = t.log_file_id AND f.status <> $1)
+				AND NOT EXISTS (SELECT 1 FROM `+LogEntriesTable+` e WHERE e.log_file_id = t.log_file_id AND e.line_number = t.line_number)
+				RETURNING log_file_id
+			), counts AS (
+				SELECT log_file_id, COUNT(*) AS count FROM inserted GROUP BY log_file_id
+			), counted AS (
+				UPDATE log_files f SET entries = f.entries + c.count FROM counts c WHERE f.id = c.log_file_id
+			)
+			SELECT COALESCE(SUM(count), 0) FROM counts`,
+			models.StatusDeleting,
+		).Scan(&restored)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, "UPDATE entry_archives SET restored_at = now() WHERE id = $1", a.ID)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return restored, nil
+}
@@ -0,0 +1,169 @@
+package processor
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"iis-logs-parser/models"
+	"io"
+	"time"
+)
+
+// An archive is a gzip-compressed stream of JSON lines: an ArchiveHeader, then an ArchivedEntry per entry.
+// The values are stored as text, so an archive can be read without the database it comes from.
+const (
+	ArchiveFormat        = "iis-logs-parser/log-entries"
+	ArchiveFormatVersion = 1
+)
+
+type ArchiveHeader struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	DomainID  uint      `json:"domainId"`
+	Day       time.Time `json:"day"` // UTC day of the entries
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type ArchivedEntry struct {
+	LogFileID   uint      `json:"logFileId"`
+	LineNumber  int64     `json:"lineNumber"`
+	ByteOffset  int64     `json:"byteOffset"`
+	Timestamp   time.Time `json:"timestamp"`
+	Date        string    `json:"date"`
+	Time        string    `json:"time"`
+	ServerIP    string    `json:"serverIp"`
+	Method      string    `json:"method"`
+	URIStem     string    `json:"uriStem"`
+	URIQuery    string    `json:"uriQuery"`
+	Port        string    `json:"port"`
+	Username    string    `json:"username"`
+	ClientIP    string    `json:"clientIp"`
+	UserAgent   string    `json:"userAgent"`
+	Status      string    `json:"status"`
+	SubStatus   string    `json:"subStatus"`
+	Win32Status string    `json:"win32Status"`
+	TimeTaken   string    `json:"timeTaken"`
+}
+
+// ArchiveWriter writes an archive, and computes the size and checksum of the compressed output
+type ArchiveWriter struct {
+	gzip    *gzip.Writer
+	encoder *json.Encoder
+	hash    hash.Hash
+	bytes   countingWriter
+	entries int64
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// NewArchiveWriter writes the header of the archive to w, Close must be called to complete it
+func NewArchiveWriter(w io.Writer, header ArchiveHeader) (*ArchiveWriter, error) {
+	header.Format = ArchiveFormat
+	header.Version = ArchiveFormatVersion
+	a := &ArchiveWriter{hash: sha256.New()}
+	a.gzip = gzip.NewWriter(io.MultiWriter(w, a.hash, &a.bytes))
+	a.encoder = json.NewEncoder(a.gzip)
+	if err := a.encoder.Encode(header); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *ArchiveWriter) Write(entry *models.LogEntry) error {
+	a.entries++
+	return a.encoder.Encode(ArchivedEntry{
+		LogFileID:   entry.LogFileID,
+		LineNumber:  entry.LineNumber,
+		ByteOffset:  entry.ByteOffset,
+		Timestamp:   entry.Timestamp,
+		Date:        entry.Date,
+		Time:        entry.Time,
+		ServerIP:    entry.ServerIP,
+		Method:      entry.Method,
+		URIStem:     entry.URIStem,
+		URIQuery:    entry.URIQuery,
+		Port:        entry.Port,
+		Username:    entry.Username,
+		ClientIP:    entry.ClientIP,
+		UserAgent:   entry.UserAgent,
+		Status:      entry.Status,
+		SubStatus:   entry.SubStatus,
+		Win32Status: entry.Win32Status,
+		TimeTaken:   entry.TimeTaken,
+	})
+}
+
+// Close flushes the compressed stream, the underlying writer is left open
+func (a *ArchiveWriter) Close() error {
+	return a.gzip.Close()
+}
+
+func (a *ArchiveWriter) Entries() int64 { return a.entries }
+
+// Bytes is the compressed size, once closed
+func (a *ArchiveWriter) Bytes() int64 { return a.bytes.n }
+
+// SHA256 is the hex checksum of the compressed output, once closed
+func (a *ArchiveWriter) SHA256() string { return hex.EncodeToString(a.hash.Sum(nil)) }
+
+// ReadArchive checks the header of the archive read from r, then calls each with its entries in order
+func ReadArchive(r io.Reader, each func(entry *models.LogEntry) error) (ArchiveHeader, error) {
+	var header ArchiveHeader
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return header, err
+	}
+	defer gz.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(gz))
+	if err := decoder.Decode(&header); err != nil {
+		return header, fmt.Errorf("invalid archive header: %w", err)
+	}
+	if header.Format != ArchiveFormat || header.Version != ArchiveFormatVersion {
+		return header, fmt.Errorf("unsupported archive format %q version %d", header.Format, header.Version)
+	}
+
+	for {
+		var e ArchivedEntry
+		if err := decoder.Decode(&e); errors.Is(err, io.EOF) {
+			return header, nil
+		} else if err != nil {
+			return header, fmt.Errorf("invalid archived entry: %w", err)
+		}
+		err := each(&models.LogEntry{
+			LogFileID:   e.LogFileID,
+			LineNumber:  e.LineNumber,
+			ByteOffset:  e.ByteOffset,
+			Timestamp:   e.Timestamp,
+			Date:        e.Date,
+			Time:        e.Time,
+			ServerIP:    e.ServerIP,
+			Method:      e.Method,
+			URIStem:     e.URIStem,
+			URIQuery:    e.URIQuery,
+			Port:        e.Port,
+			Username:    e.Username,
+			ClientIP:    e.ClientIP,
+			UserAgent:   e.UserAgent,
+			Status:      e.Status,
+			SubStatus:   e.SubStatus,
+			Win32Status: e.Win32Status,
+			TimeTaken:   e.TimeTaken,
+		})
+		if err != nil {
+			return header, err
+		}
+	}
+}
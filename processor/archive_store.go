@@ -0,0 +1,180 @@
+package processor
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"iis-logs-parser/config"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archiveStore keeps the entries archives, by key
+type archiveStore interface {
+	Name() string
+	// Put stores the size bytes of body, whose SHA-256 is checksum
+	Put(ctx context.Context, key string, body io.Reader, size int64, checksum string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete succeeds if the archive doesn't exist
+	Delete(ctx context.Context, key string) error
+}
+
+// newArchiveStore returns the S3 store when ARCHIVE_S3_BUCKET is set, the ARCHIVE_DIR directory otherwise
+func newArchiveStore() archiveStore {
+	if s3, ok := config.GetArchiveS3Config(); ok {
+		return &s3ArchiveStore{config: s3, client: &http.Client{}}
+	}
+	return localArchiveStore{dir: config.GetArchiveDirOrDefault()}
+}
+
+type localArchiveStore struct {
+	dir string
+}
+
+func (s localArchiveStore) Name() string { return "local" }
+
+// Put writes a temporary file renamed once complete, so a partial archive is never found under its key
+func (s localArchiveStore) Put(ctx context.Context, key string, body io.Reader, size int64, checksum string) error {
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, body)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s localArchiveStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.dir, filepath.FromSlash(key)))
+}
+
+func (s localArchiveStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(filepath.Join(s.dir, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// s3ArchiveStore stores the archives in a bucket of an S3-compatible service, with requests signed with AWS Signature Version 4
+type s3ArchiveStore struct {
+	config config.ArchiveS3Config
+	client *http.Client
+}
+
+// SHA-256 of an empty payload
+const emptyPayloadSHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s *s3ArchiveStore) Name() string { return "s3" }
+
+func (s *s3ArchiveStore) Put(ctx context.Context, key string, body io.Reader, size int64, checksum string) error {
+	res, err := s.do(ctx, http.MethodPut, key, body, size, checksum)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *s3ArchiveStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	res, err := s.do(ctx, http.MethodGet, key, nil, 0, emptyPayloadSHA256)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (s *s3ArchiveStore) Delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, http.MethodDelete, key, nil, 0, emptyPayloadSHA256)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// do sends a signed request for the object, and returns an error unless it succeeded
+func (s *s3ArchiveStore) do(ctx context.Context, method string, key string, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	segments := strings.Split(s.config.Bucket+"/"+key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	objectPath := "/" + strings.Join(segments, "/")
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(s.config.Endpoint, "/")+objectPath, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, objectPath, payloadHash, time.Now().UTC())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, res.Status, strings.TrimSpace(string(message)))
+	}
+	return res, nil
+}
+
+func (s *s3ArchiveStore) sign(req *http.Request, objectPath string, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	req.Header.Set("x-amz-date", amzDate)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		objectPath,
+		"", // No query string
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), date)
+	for _, part := range []string{s.config.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
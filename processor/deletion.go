@@ -0,0 +1,160 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iis-logs-parser/models"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+// PurgeDeletedFiles removes the log files marked as deleting, then the deleted domains left without log files and their archives.
+// The log_entries partitions only holding entries of deleting files are dropped, the other entries are deleted in batches.
+// Files still leased wait for their lease to expire, so the worker processing them has stopped writing.
+// Returns the number of removed files.
+func PurgeDeletedFiles(ctx context.Context, dbPool *pgxpool.Pool) (int, error) {
+	if err := dropDeletedPartitions(ctx, dbPool); err != nil {
+		return 0, fmt.Errorf("failed to drop partitions of deleted files: %w", err)
+	}
+
+	rows, err := dbPool.Query(ctx,
+		`SELECT id, name FROM log_files
+		WHERE status = $1 AND (lease_expires_at IS NULL OR lease_expires_at < now())
+		ORDER BY id`,
+		models.StatusDeleting,
+	)
+	if err != nil {
+		return 0, err
+	}
+	logFiles, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (models.LogFile, error) {
+		var logFile models.LogFile
+		err := row.Scan(&logFile.ID, &logFile.Name)
+		return logFile, err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	var errs []error
+	for _, logFile := range logFiles {
+		if ctx.Err() != nil {
+			return removed, ctx.Err()
+		}
+		if err := purgeLogFile(ctx, dbPool, logFile); err != nil {
+			errs = append(errs, fmt.Errorf("file %d: %w", logFile.ID, err))
+			continue
+		}
+		removed++
+	}
+
+	if err := purgeDeletedDomains(ctx, dbPool); err != nil {
+		errs = append(errs, fmt.Errorf("failed to remove deleted domains: %w", err))
+	}
+	return removed, errors.Join(errs...)
+}
+
+// purgeDeletedDomains removes the deleted domains left without log files, along with their archives
+func purgeDeletedDomains(ctx context.Context, dbPool *pgxpool.Pool) error {
+	rows, err := dbPool.Query(ctx,
+		`SELECT id FROM domains d WHERE deleting_at IS NOT NULL AND NOT EXISTS (SELECT 1 FROM log_files f WHERE f.domain_id = d.id)`,
+	)
+	if err != nil {
+		return err
+	}
+	domainIds, err := pgx.CollectRows(rows, pgx.RowTo[uint])
+	if err != nil {
+		return err
+	}
+
+	for _, domainId := range domainIds {
+		if err := removeDomainArchives(ctx, dbPool, domainId); err != nil {
+			return fmt.Errorf("domain %d: failed to remove archives: %w", domainId, err)
+		}
+		if _, err := dbPool.Exec(ctx, "DELETE FROM domains WHERE id = $1", domainId); err != nil {
+			return fmt.Errorf("domain %d: %w", domainId, err)
+		}
+		log.Info().Uint("domainId", domainId).Msg("Deletion: removed deleted domain")
+	}
+	return nil
+}
+
+func purgeLogFile(ctx context.Context, dbPool *pgxpool.Pool, logFile models.LogFile) error {
+	entries, err := deleteInBatches(ctx, dbPool,
+		`DELETE FROM `+LogEntriesTable+` WHERE (id, timestamp) IN (
+			SELECT id, timestamp FROM `+LogEntriesTable+` WHERE log_file_id = $1 LIMIT $2
+		)`,
+		logFile.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete entries: %w", err)
+	}
+	// Staged entries are those of an interrupted reprocessing, a batch at most
+	err = pgx.BeginFunc(ctx, dbPool, func(tx pgx.Tx) error {
+		return deleteFileRows(ctx, tx, logFile.ID, LogEntriesStagingTable, LogRollupsTable, LogRollupsStagingTable)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete staged entries and rollups: %w", err)
+	}
+
+	if _, _, err := removeStoredFiles(logFile); err != nil {
+		return fmt.Errorf("failed to remove stored file: %w", err)
+	}
+
+	// Its stats go along with it
+	if _, err := dbPool.Exec(ctx, "DELETE FROM log_files WHERE id = $1 AND status = $2", logFile.ID, models.StatusDeleting); err != nil {
+		return err
+	}
+	log.Info().Uint("fileId", logFile.ID).Int64("entries", entries).Msg("Deletion: removed deleted log file")
+	return nil
+}
+
+// dropDeletedPartitions drops the partitions overlapping deleting files and no other file with entries.
+// Files being processed or followed may write to any partition, none is dropped while there are some,
+// including deleted files whose worker may not have stopped yet.
+func dropDeletedPartitions(ctx context.Context, dbPool *pgxpool.Pool) error {
+	partitions, err := listPartitions(ctx, dbPool)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range partitions {
+		var deleting bool
+		err := dbPool.QueryRow(ctx,
+			"SELECT EXISTS (SELECT 1 FROM log_files WHERE status = $3 AND start_timestamp < $1 AND end_timestamp >= $2)",
+			p.end, p.start, models.StatusDeleting,
+		).Scan(&deleting)
+		if err != nil {
+			return err
+		}
+		if !deleting {
+			continue
+		}
+
+		// Files never processed and without entries have none in the partition, the others may have some unless their range says otherwise.
+		// Followed files are completed without being processed.
+		count, dropped, err := dropPartitionUnless(ctx, dbPool, p, func(tx pgx.Tx) (bool, error) {
+			var kept bool
+			err := tx.QueryRow(ctx,
+				`SELECT EXISTS (SELECT 1 FROM log_files WHERE status IN ($3, $4) OR (status = $5 AND lease_expires_at >= now()))
+				OR EXISTS (
+					SELECT 1 FROM log_files
+					WHERE status <> $5 AND (processed_at IS NOT NULL OR entries > 0)
+					AND (start_timestamp IS NULL OR end_timestamp IS NULL OR (start_timestamp < $1 AND end_timestamp >= $2))
+				)`,
+				p.end, p.start, models.StatusProcessing, models.StatusFollowing, models.StatusDeleting,
+			).Scan(&kept)
+			return kept, err
+		})
+		if err != nil {
+			return fmt.Errorf("partition %s: %w", p.name, err)
+		}
+		if dropped {
+			log.Info().Str("partition", p.name).Int64("entries", count).Msg("Deletion: dropped partition of deleted files")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package processor
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"iis-logs-parser/models"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// Values cached per dictionary, the cache is emptied once full so unusual files can't grow it forever
+	dictionaryCacheSize = 200000
+	// A value inserted by a concurrent batch can be invisible to the statement inserting it too, it's found on the next attempt
+	dictionaryResolveAttempts = 3
+)
+
+// dictionary maps the values of a repetitive log_entries column to their id in its lookup table.
+// The ids are cached for the life of the process, since values are never updated nor reused.
+type dictionary struct {
+	table string
+	mu    sync.RWMutex
+	ids   map[string]int32
+}
+
+func newDictionary(table string) *dictionary {
+	return &dictionary{table: table, ids: map[string]int32{}}
+}
+
+var (
+	serverIPs  = newDictionary("server_ips")
+	uriStems   = newDictionary("uri_stems")
+	userAgents = newDictionary("user_agents")
+)
+
+// encodeBatch sets the dictionary ids of the entries of the batch, adding the new values to the lookup tables
+func encodeBatch(ctx context.Context, dbPool *pgxpool.Pool, batch []*models.LogEntry) error {
+	columns := []struct {
+		dictionary *dictionary
+		value      func(*models.LogEntry) string
+		setId      func(*models.LogEntry, int32)
+	}{
+		{serverIPs, func(e *models.LogEntry) string { return e.ServerIP }, func(e *models.LogEntry, id int32) { e.ServerIPID = id }},
+		{uriStems, func(e *models.LogEntry) string { return e.URIStem }, func(e *models.LogEntry, id int32) { e.URIStemID = id }},
+		{userAgents, func(e *models.LogEntry) string { return e.UserAgent }, func(e *models.LogEntry, id int32) { e.UserAgentID = id }},
+	}
+
+	for _, column := range columns {
+		values := make([]string, len(batch))
+		for i, entry := range batch {
+			values[i] = column.value(entry)
+		}
+		ids, err := column.dictionary.resolve(ctx, dbPool, values)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", column.dictionary.table, err)
+		}
+		for _, entry := range batch {
+			column.setId(entry, ids[column.value(entry)])
+		}
+	}
+	return nil
+}
+
+// resolve returns the ids of the values, the missing ones are looked up or inserted in a single statement
+func (d *dictionary) resolve(ctx context.Context, dbPool *pgxpool.Pool, values []string) (map[string]int32, error) {
+	ids := make(map[string]int32, len(values))
+	var missing []string
+	d.mu.RLock()
+	for _, value := range values {
+		if _, seen := ids[value]; seen {
+			continue
+		}
+		id, ok := d.ids[value]
+		ids[value] = id
+		if !ok {
+			missing = append(missing, value)
+		}
+	}
+	d.mu.RUnlock()
+
+	for attempt := 0; len(missing) > 0; attempt++ {
+		if attempt == dictionaryResolveAttempts {
+			return nil, fmt.Errorf("%d values couldn't be added", len(missing))
+		}
+		found, err := d.lookupOrInsert(ctx, dbPool, missing)
+		if err != nil {
+			return nil, err
+		}
+
+		d.mu.Lock()
+		if len(d.ids)+len(found) > dictionaryCacheSize {
+			d.ids = map[string]int32{}
+		}
+		remaining := missing[:0]
+		for _, value := range missing {
+			if id, ok := found[value]; ok {
+				ids[value] = id
+				d.ids[value] = id
+			} else {
+				remaining = append(remaining, value)
+			}
+		}
+		d.mu.Unlock()
+		missing = remaining
+	}
+	return ids, nil
+}
+
+func (d *dictionary) lookupOrInsert(ctx context.Context, dbPool *pgxpool.Pool, values []string) (map[string]int32, error) {
+	hashes := make([][]byte, len(values))
+	for i, value := range values {
+		hash := sha256.Sum256([]byte(value))
+		hashes[i] = hash[:]
+	}
+
+	table := pgx.Identifier{d.table}.Sanitize()
+	rows, err := dbPool.Query(ctx,
+		`WITH input AS (
+			SELECT * FROM unnest($1::text[], $2::bytea[]) AS i(value, hash)
+		), inserted AS (
+			INSERT INTO `+table+` (value, hash) SELECT value, hash FROM input
+			ON CONFLICT (hash) DO NOTHING
+			RETURNING id, value
+		)
+		SELECT id, value FROM inserted
+		UNION ALL
+		SELECT d.id, d.value FROM `+table+` d JOIN input i ON i.hash = d.hash`,
+		values, hashes,
+	)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]int32, len(values))
+	var id int32
+	var value string
+	_, err = pgx.ForEachRow(rows, []any{&id, &value}, func() error {
+		found[value] = id
+		return nil
+	})
+	return found, err
+}
@@ -0,0 +1,285 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iis-logs-parser/config"
+	"iis-logs-parser/models"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	dropFolderScanInterval = 10 * time.Second
+	// Subfolders of a drop folder used to keep track of the ingested files, they are never scanned
+	dropFolderProcessingDir = "processing"
+	dropFolderDoneDir       = "done"
+	dropFolderFailedDir     = "failed"
+)
+
+// WatchDropFolders registers the stable files showing up in the drop folders as pending log files,
+// then moves them to the done or failed subfolders once processed, until ctx is cancelled.
+func WatchDropFolders(ctx context.Context, dbPool *pgxpool.Pool, folders []config.DropFolder) {
+	for _, folder := range folders {
+		go NewDropFolderWatcher(dbPool, folder).run(ctx)
+	}
+}
+
+// dropFolderFile is the last observed state of a file, used to detect files that are still being written
+type dropFolderFile struct {
+	size         int64
+	modTime      time.Time
+	unchangedFor time.Time // when the size and modification time were first observed
+}
+
+// DropFolderWatcher registers the files of a drop folder, see WatchDropFolders
+type DropFolderWatcher struct {
+	dbPool    *pgxpool.Pool
+	folder    config.DropFolder
+	seen      map[string]dropFolderFile
+	unmatched map[string]bool // files without a matching rule, only reported once
+}
+
+func NewDropFolderWatcher(dbPool *pgxpool.Pool, folder config.DropFolder) *DropFolderWatcher {
+	return &DropFolderWatcher{
+		dbPool:    dbPool,
+		folder:    folder,
+		seen:      map[string]dropFolderFile{},
+		unmatched: map[string]bool{},
+	}
+}
+
+func (w *DropFolderWatcher) run(ctx context.Context) {
+	log.Info().Str("path", w.folder.Path).Msg("Drop folder: watching")
+
+	ticker := time.NewTicker(dropFolderScanInterval)
+	defer ticker.Stop()
+	for {
+		if err := w.Scan(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			log.Err(err).Str("path", w.folder.Path).Msg("Drop folder: scan failed")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Scan moves the processed files out of the processing subfolder, then registers the files that stopped changing since the previous scans.
+// A file is registered on the first scan at least StableSecs after the one it was last seen changed.
+func (w *DropFolderWatcher) Scan(ctx context.Context) error {
+	// Replicas watching the same shared folder take turns, so a file is never registered twice
+	conn, err := w.dbPool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	lockKey := "drop-folder-" + w.folder.Path
+	var locked bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", lockKey).Scan(&locked); err != nil {
+		return err
+	}
+	if !locked {
+		return nil
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", lockKey)
+
+	if err := w.moveProcessedFiles(ctx); err != nil {
+		log.Err(err).Str("path", w.folder.Path).Msg("Drop folder: failed to move processed files")
+	}
+
+	now := time.Now()
+	stillThere := map[string]bool{}
+	err = filepath.WalkDir(w.folder.Path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(w.folder.Path, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if rel == dropFolderProcessingDir || rel == dropFolderDoneDir || rel == dropFolderFailedDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			// Moved or deleted since the directory was listed
+			return nil
+		}
+		stillThere[path] = true
+		if !w.isStable(path, info, now) {
+			return nil
+		}
+
+		domainId, ok := w.folder.MatchDomain(rel)
+		if !ok {
+			if !w.unmatched[path] {
+				log.Warn().Str("file", path).Msg("Drop folder: no rule matches the file, ignoring it")
+				w.unmatched[path] = true
+			}
+			return nil
+		}
+
+		if err := w.register(ctx, path, rel, info.Size(), domainId); err != nil {
+			log.Err(err).Str("file", path).Uint("domainId", domainId).Msg("Drop folder: failed to register file")
+			return nil
+		}
+		delete(w.seen, path)
+		return nil
+	})
+
+	for path := range w.seen {
+		if !stillThere[path] {
+			delete(w.seen, path)
+		}
+	}
+	for path := range w.unmatched {
+		if !stillThere[path] {
+			delete(w.unmatched, path)
+		}
+	}
+	return err
+}
+
+// isStable reports whether the file stopped changing for long enough to be considered completely written.
+// The modification time alone can't be trusted, robocopy preserves the original one.
+func (w *DropFolderWatcher) isStable(path string, info fs.FileInfo, now time.Time) bool {
+	previous, ok := w.seen[path]
+	if !ok || previous.size != info.Size() || !previous.modTime.Equal(info.ModTime()) {
+		w.seen[path] = dropFolderFile{size: info.Size(), modTime: info.ModTime(), unchangedFor: now}
+		return false
+	}
+	return now.Sub(previous.unchangedFor) >= time.Duration(w.folder.StableSecs)*time.Second
+}
+
+// register moves the file to the processing subfolder and creates its pending log file.
+// Its name there is suffixed with the file id, so the same name can be dropped again before it's processed.
+func (w *DropFolderWatcher) register(ctx context.Context, path string, rel string, size int64, domainId uint) error {
+	var processingPath string
+	err := pgx.BeginFunc(ctx, w.dbPool, func(tx pgx.Tx) error {
+		logFile := models.LogFile{Name: filepath.Base(path)}
+		err := tx.QueryRow(ctx,
+			"INSERT INTO log_files (created_at, updated_at, domain_id, name, size, stored_bytes, status) VALUES (now(), now(), $1, $2, $3, $3, $4) RETURNING id",
+			domainId, logFile.Name, size, models.StatusPending,
+		).Scan(&logFile.ID)
+		if err != nil {
+			return fmt.Errorf("failed to create log file: %w", err)
+		}
+
+		target := filepath.Join(w.folder.Path, dropFolderProcessingDir, rel) + "-" + strconv.FormatUint(uint64(logFile.ID), 10)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(path, target); err != nil {
+			return fmt.Errorf("failed to move file to the processing folder: %w", err)
+		}
+		processingPath = target
+
+		if _, err := tx.Exec(ctx, "UPDATE log_files SET source_path = $1 WHERE id = $2", processingPath, logFile.ID); err != nil {
+			return err
+		}
+		if err := copyFile(processingPath, logFile.StoragePath()); err != nil {
+			os.Remove(logFile.StoragePath())
+			return err
+		}
+		log.Info().Str("file", path).Uint("fileId", logFile.ID).Uint("domainId", domainId).Msg("Drop folder: registered file")
+		return nil
+	})
+	if err != nil && processingPath != "" {
+		// Put it back so it's picked up again on the next scan
+		if renameErr := os.Rename(processingPath, path); renameErr != nil {
+			log.Err(renameErr).Str("file", processingPath).Msg("Drop folder: failed to move file back")
+		}
+	}
+	return err
+}
+
+// moveProcessedFiles moves the files of the completed or failed log files out of the processing subfolder
+func (w *DropFolderWatcher) moveProcessedFiles(ctx context.Context) error {
+	processingDir := filepath.Join(w.folder.Path, dropFolderProcessingDir) + string(filepath.Separator)
+	rows, err := w.dbPool.Query(ctx,
+		"SELECT id, status, source_path FROM log_files WHERE starts_with(source_path, $1) AND status IN ($2, $3)",
+		processingDir, models.StatusCompleted, models.StatusFailed,
+	)
+	if err != nil {
+		return err
+	}
+
+	type processedFile struct {
+		id         uint
+		status     models.Status
+		sourcePath string
+	}
+	var processed []processedFile
+	var f processedFile
+	if _, err := pgx.ForEachRow(rows, []any{&f.id, &f.status, &f.sourcePath}, func() error {
+		processed = append(processed, f)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, f := range processed {
+		targetDir := dropFolderDoneDir
+		if f.status == models.StatusFailed {
+			targetDir = dropFolderFailedDir
+		}
+		// Still suffixed with the file id, so the files dropped with the same name are all kept
+		targetPath := filepath.Join(w.folder.Path, targetDir, strings.TrimPrefix(f.sourcePath, processingDir))
+
+		if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(f.sourcePath, targetPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if _, err := w.dbPool.Exec(ctx, "UPDATE log_files SET source_path = $1 WHERE id = $2", targetPath, f.id); err != nil {
+			return err
+		}
+		log.Info().Str("file", targetPath).Uint("fileId", f.id).Msg("Drop folder: moved processed file")
+	}
+	return nil
+}
+
+func copyFile(from string, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	src, err := os.Open(from)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer src.Close()
+
+	dst, err := os.Create(to)
+	if err != nil {
+		return fmt.Errorf("failed to create destination file: %w", err)
+	}
+	defer dst.Close()
+
+	if _, err = io.Copy(dst, src); err != nil {
+		return fmt.Errorf("failed to copy file contents: %w", err)
+	}
+	return dst.Sync()
+}
@@ -0,0 +1,473 @@
+package processor
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"iis-logs-parser/models"
+	"iis-logs-parser/parser"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// How often followed files are checked for new lines, this bounds the ingestion latency
+	followPollInterval = 2 * time.Second
+	// How often the followed domains are reloaded from the database
+	followReloadInterval = 30 * time.Second
+	followBatchSize      = 10000
+	// IIS names its daily log files u_exYYMMDD.log, so sorting them by name sorts them by date
+	iisLogFilePattern = "u_ex*.log"
+)
+
+// FollowDomains continuously ingests the log files configured in the domains' FollowPath,
+// until ctx is cancelled. Follow paths are resolved relative to rootDir and can't escape it, even through a symlink.
+func FollowDomains(ctx context.Context, dbPool *pgxpool.Pool, rootDir string) {
+	type runningFollower struct {
+		path   string
+		cancel context.CancelFunc
+	}
+	running := map[uint]runningFollower{}
+	defer func() {
+		for _, f := range running {
+			f.cancel()
+		}
+	}()
+
+	ticker := time.NewTicker(followReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		followPaths, err := loadFollowPaths(ctx, dbPool)
+		if err != nil {
+			log.Err(err).Msg("Follow: failed to load followed domains")
+		} else {
+			for domainId, f := range running {
+				if followPaths[domainId] != f.path {
+					log.Info().Uint("domainId", domainId).Str("path", f.path).Msg("Follow: stopping follower")
+					f.cancel()
+					delete(running, domainId)
+				}
+			}
+			for domainId, path := range followPaths {
+				if _, ok := running[domainId]; ok {
+					continue
+				}
+				resolvedPath, err := ResolveFollowPath(rootDir, path)
+				if err != nil {
+					log.Err(err).Uint("domainId", domainId).Str("path", path).Msg("Follow: invalid follow path")
+					continue
+				}
+				followerCtx, cancel := context.WithCancel(ctx)
+				running[domainId] = runningFollower{path: path, cancel: cancel}
+				go runFollower(followerCtx, dbPool, domainId, resolvedPath)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func loadFollowPaths(ctx context.Context, dbPool *pgxpool.Pool) (map[uint]string, error) {
+	rows, err := dbPool.Query(ctx, "SELECT id, follow_path FROM domains WHERE follow_path <> '' AND is_active AND deleted_at IS NULL")
+	if err != nil {
+		return nil, err
+	}
+
+	followPaths := map[uint]string{}
+	var domainId uint
+	var path string
+	_, err = pgx.ForEachRow(rows, []any{&domainId, &path}, func() error {
+		followPaths[domainId] = path
+		return nil
+	})
+	return followPaths, err
+}
+
+// ResolveFollowPath returns the file or directory the follow path of a domain points to, once its symlinks are resolved.
+// It must exist and be under rootDir.
+func ResolveFollowPath(rootDir string, path string) (string, error) {
+	root, err := filepath.EvalSymlinks(rootDir)
+	if err != nil {
+		return "", fmt.Errorf("invalid follow root directory: %w", err)
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(root, path))
+	if err != nil {
+		return "", fmt.Errorf("invalid follow path %q: %w", path, err)
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("follow path %q is outside of the follow root directory", path)
+	}
+	return resolved, nil
+}
+
+// runFollower follows a single domain, the advisory lock makes sure only one instance follows it
+func runFollower(ctx context.Context, dbPool *pgxpool.Pool, domainId uint, path string) {
+	conn, err := dbPool.Acquire(ctx)
+	if err != nil {
+		log.Err(err).Uint("domainId", domainId).Msg("Follow: failed to acquire connection")
+		return
+	}
+	defer conn.Release()
+
+	lockKey := fmt.Sprintf("follow-domain-%d", domainId)
+	var locked bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", lockKey).Scan(&locked); err != nil {
+		log.Err(err).Uint("domainId", domainId).Msg("Follow: failed to take follow lock")
+		return
+	}
+	if !locked {
+		log.Info().Uint("domainId", domainId).Msg("Follow: domain is already followed by another instance")
+		return
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", lockKey)
+
+	f := NewFollower(dbPool, domainId, path)
+	log.Info().Uint("domainId", domainId).Str("path", path).Msg("Follow: starting follower")
+
+	ticker := time.NewTicker(followPollInterval)
+	defer ticker.Stop()
+	for {
+		err := f.Poll(ctx)
+		if errors.Is(err, ErrFollowedFileDeleted) {
+			log.Warn().Uint("domainId", domainId).Str("file", f.currentPath).Msg("Follow: stopping follower, its log file was deleted")
+			return
+		}
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Err(err).Uint("domainId", domainId).Str("file", f.currentPath).Msg("Follow: failed to ingest new lines")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ErrFollowedFileDeleted is returned by Poll when the followed log file was deleted, the follower stops then
+var ErrFollowedFileDeleted = errors.New("followed log file was deleted")
+
+// Follower ingests the lines appended to the log files of a follow path of a domain, one log file at a time
+type Follower struct {
+	dbPool   *pgxpool.Pool
+	domainId uint
+	path     string // configured path, either a log file or a directory of u_exYYMMDD.log files
+
+	currentPath string // file being followed, empty until the first poll finds one
+	logFileId   uint
+	offset      int64 // offset right after the last ingested line
+	lineNumber  int64
+	metrics     *Metrics
+}
+
+// NewFollower follows path for the domain, a log file or a directory of u_exYYMMDD.log files.
+// Only one follower of a domain must run at a time.
+func NewFollower(dbPool *pgxpool.Pool, domainId uint, path string) *Follower {
+	return &Follower{dbPool: dbPool, domainId: domainId, path: path}
+}
+
+// Poll ingests the complete lines appended since the last poll,
+// then moves on to the next log file once the current one has been rolled over
+func (f *Follower) Poll(ctx context.Context) error {
+	if f.currentPath == "" {
+		if err := f.start(ctx); err != nil || f.currentPath == "" {
+			return err
+		}
+	}
+
+	info, err := os.Stat(f.currentPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat followed file: %w", err)
+	}
+
+	if info.Size() < f.offset {
+		// Truncated in place, the old content is gone so the file is ingested again as a new log file
+		log.Warn().Str("file", f.currentPath).Int64("size", info.Size()).Int64("offset", f.offset).Msg("Follow: file truncated")
+		if err := f.finish(ctx); err != nil {
+			return err
+		}
+		return f.open(ctx, f.currentPath)
+	}
+
+	if info.Size() > f.offset {
+		if err := f.ingest(ctx, info.Size(), false); err != nil || f.offset == info.Size() {
+			return err
+		}
+		// What's left is a line being written, unless the file was rolled over
+	}
+
+	next, err := f.nextFile()
+	if err != nil || next == "" {
+		return err
+	}
+
+	// Rolled over: IIS won't write to the current file anymore, so a trailing line without a newline is complete
+	if err := f.ingest(ctx, info.Size(), true); err != nil {
+		return err
+	}
+	if err := f.finish(ctx); err != nil {
+		return err
+	}
+	log.Info().Str("from", f.currentPath).Str("to", next).Msg("Follow: log file rolled over")
+	return f.open(ctx, next)
+}
+
+// start picks the file to follow, resuming the one that was followed before a restart if any
+func (f *Follower) start(ctx context.Context) error {
+	var logFileId uint
+	var name string
+	err := f.dbPool.QueryRow(ctx,
+		"SELECT id, name FROM log_files WHERE domain_id = $1 AND status = $2 AND deleted_at IS NULL ORDER BY id DESC LIMIT 1",
+		f.domainId, models.StatusFollowing,
+	).Scan(&logFileId, &name)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	if err == nil {
+		resumedPath := filepath.Join(f.dir(), name)
+		if _, statErr := os.Stat(resumedPath); statErr == nil {
+			return f.resume(ctx, resumedPath, logFileId)
+		}
+		// The file is gone, nothing more will be read from it
+		_, err := f.dbPool.Exec(ctx,
+			"UPDATE log_files SET status = $1, processed_at = now(), updated_at = now() WHERE id = $2 AND status = $3",
+			models.StatusCompleted, logFileId, models.StatusFollowing,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to stat follow path: %w", err)
+	}
+	if !info.IsDir() {
+		return f.open(ctx, f.path)
+	}
+
+	matches, err := filepath.Glob(filepath.Join(f.path, iisLogFilePattern))
+	if err != nil || len(matches) == 0 {
+		return err
+	}
+	sort.Strings(matches)
+	// Only the newest file is followed, older ones are expected to be uploaded
+	return f.open(ctx, matches[len(matches)-1])
+}
+
+// open starts following path from its beginning in a new log file
+func (f *Follower) open(ctx context.Context, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	var logFileId uint
+	err = f.dbPool.QueryRow(ctx,
+		"INSERT INTO log_files (created_at, updated_at, domain_id, name, size, status) VALUES (now(), now(), $1, $2, 0, $3) RETURNING id",
+		f.domainId, info.Name(), models.StatusFollowing,
+	).Scan(&logFileId)
+	if err != nil {
+		return fmt.Errorf("failed to create log file: %w", err)
+	}
+
+	f.currentPath = path
+	f.logFileId = logFileId
+	f.offset = 0
+	f.lineNumber = 0
+	f.metrics = newMetrics()
+	log.Info().Uint("domainId", f.domainId).Uint("fileId", logFileId).Str("file", path).Msg("Follow: following new file")
+	return nil
+}
+
+// resume continues following path right after the last line that was ingested from it
+func (f *Follower) resume(ctx context.Context, path string, logFileId uint) error {
+	var lastLine, lastOffset int64
+	err := f.dbPool.QueryRow(ctx,
+		"SELECT COALESCE(MAX(line_number), 0), COALESCE(MAX(byte_offset), -1) FROM "+LogEntriesTable+" WHERE log_file_id = $1",
+		logFileId,
+	).Scan(&lastLine, &lastOffset)
+	if err != nil {
+		return err
+	}
+
+	f.currentPath = path
+	f.logFileId = logFileId
+	f.offset = 0
+	f.lineNumber = 0
+	f.metrics = newMetrics()
+
+	if lastOffset >= 0 {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if _, err := file.Seek(lastOffset, io.SeekStart); err != nil {
+			return err
+		}
+		lastLineText, err := bufio.NewReader(file).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		f.offset = lastOffset + int64(len(lastLineText))
+		f.lineNumber = lastLine
+	}
+
+	log.Info().Uint("fileId", logFileId).Str("file", path).Int64("offset", f.offset).Msg("Follow: resuming file")
+	return nil
+}
+
+// ingest inserts the lines between the current offset and size
+func (f *Follower) ingest(ctx context.Context, size int64, includePartialLine bool) error {
+	if size <= f.offset {
+		return nil
+	}
+
+	// Nothing is added to a file deleted since the last poll
+	var following bool
+	err := f.dbPool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM log_files WHERE id = $1 AND status = $2)", f.logFileId, models.StatusFollowing).Scan(&following)
+	if err != nil {
+		return err
+	}
+	if !following {
+		return ErrFollowedFileDeleted
+	}
+
+	file, err := os.Open(f.currentPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(f.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReaderSize(io.LimitReader(file, size-f.offset), 64*1024)
+	batch := make([]*models.LogEntry, 0, followBatchSize)
+	offset, lineNumber := f.offset, f.lineNumber
+
+	flush := func() error {
+		if len(batch) > 0 {
+			if err := insertBatch(f.dbPool, LogEntriesTable, batch, f.metrics); err != nil {
+				return err
+			}
+			atomic.AddInt64(&f.metrics.BatchCount, 1)
+			batch = batch[:0]
+		}
+		// Lines are only considered ingested once their batch is committed
+		f.offset, f.lineNumber = offset, lineNumber
+		return nil
+	}
+
+	for {
+		text, readErr := reader.ReadString('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return readErr
+		}
+		isComplete := strings.HasSuffix(text, "\n")
+		if len(text) == 0 || (!isComplete && !includePartialLine) {
+			break
+		}
+
+		lineNumber++
+		entry, err := parser.ParseLogLine(strings.TrimRight(text, "\r\n"))
+		if err != nil {
+			log.Warn().Err(err).Str("file", f.currentPath).Int64("line_number", lineNumber).Msg("Follow: failed to parse log line")
+		} else if entry != nil {
+			entry.LogFileID = f.logFileId
+			entry.LineNumber = lineNumber
+			entry.ByteOffset = offset
+			entry.LineSize = int64(len(text))
+			atomic.AddInt64(&f.metrics.TotalRecords, 1)
+			f.metrics.CheckAndSetTimestamps(entry.Timestamp)
+			batch = append(batch, entry)
+		}
+		offset += int64(len(text))
+
+		if len(batch) >= followBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if errors.Is(readErr, io.EOF) {
+			break
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+	return f.updateLogFile(ctx, models.StatusFollowing)
+}
+
+// finish marks the current log file as completed and processed, nothing else will be appended to it
+func (f *Follower) finish(ctx context.Context) error {
+	return f.updateLogFile(ctx, models.StatusCompleted)
+}
+
+func (f *Follower) updateLogFile(ctx context.Context, status models.Status) error {
+	var startTimestamp, endTimestamp *time.Time
+	if atomic.LoadInt64(&f.metrics.TotalRecords) > 0 {
+		startTimestamp, endTimestamp = &f.metrics.StartTimestamp, &f.metrics.EndTimestamp
+	}
+	// A file deleted meanwhile stays deleting
+	tag, err := f.dbPool.Exec(ctx,
+		`UPDATE log_files SET status = $1, size = $2, updated_at = now(),
+			start_timestamp = LEAST(start_timestamp, $3), end_timestamp = GREATEST(end_timestamp, $4),
+			processed_at = CASE WHEN $1 = $6 THEN now() ELSE processed_at END
+		WHERE id = $5 AND status = $7`,
+		status, f.offset, startTimestamp, endTimestamp, f.logFileId, models.StatusCompleted, models.StatusFollowing,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrFollowedFileDeleted
+	}
+	return nil
+}
+
+// nextFile returns the log file IIS rolled over to after the current one, if any
+func (f *Follower) nextFile() (string, error) {
+	current := filepath.Base(f.currentPath)
+	if ok, _ := filepath.Match(iisLogFilePattern, current); !ok {
+		return "", nil
+	}
+
+	matches, err := filepath.Glob(filepath.Join(f.dir(), iisLogFilePattern))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(matches)
+	for _, match := range matches {
+		if filepath.Base(match) > current {
+			return match, nil
+		}
+	}
+	return "", nil
+}
+
+func (f *Follower) dir() string {
+	if info, err := os.Stat(f.path); err == nil && info.IsDir() {
+		return f.path
+	}
+	return filepath.Dir(f.path)
+}
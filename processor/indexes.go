@@ -0,0 +1,97 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iis-logs-parser/config"
+	db "iis-logs-parser/database"
+	"iis-logs-parser/models"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+// BuildEntryIndexes creates the db.EntryIndexes missing from the log_entries partitions, concurrently so the ingestion goes on.
+// In deferred mode it waits for a moment no file is being processed, so it doesn't slow down a bulk load.
+// An index left invalid by an interrupted build is dropped and built again.
+func BuildEntryIndexes(ctx context.Context, dbPool *pgxpool.Pool) error {
+	if config.GetEntryIndexesModeOrDefault() == "deferred" {
+		var processing bool
+		err := dbPool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM log_files WHERE status = $1)", models.StatusProcessing).Scan(&processing)
+		if err != nil {
+			return err
+		}
+		if processing {
+			log.Info().Msg("Indexes: files are being processed, deferring the log entries indexes")
+			return nil
+		}
+	}
+
+	partitions, err := listPartitions(ctx, dbPool)
+	if err != nil {
+		return fmt.Errorf("failed to list partitions: %w", err)
+	}
+	valid, err := partitionIndexes(ctx, dbPool)
+	if err != nil {
+		return fmt.Errorf("failed to list partition indexes: %w", err)
+	}
+
+	var errs []error
+	for _, p := range partitions {
+		for _, index := range db.EntryIndexes {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			name := index.Name(p.name)
+			isValid, exists := valid[name]
+			if isValid {
+				continue
+			}
+			if err := buildEntryIndex(ctx, dbPool, index, p.name, exists); err != nil {
+				errs = append(errs, fmt.Errorf("index %s: %w", name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func buildEntryIndex(ctx context.Context, dbPool *pgxpool.Pool, index db.EntryIndex, partition string, invalid bool) error {
+	name := index.Name(partition)
+	if invalid {
+		if _, err := dbPool.Exec(ctx, "DROP INDEX CONCURRENTLY IF EXISTS "+pgx.Identifier{name}.Sanitize()); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	if _, err := dbPool.Exec(ctx, index.CreateSQL(partition, true)); err != nil {
+		return err
+	}
+	log.Info().Str("index", name).Dur("duration", time.Since(start)).Msg("Indexes: built log entries index")
+	return nil
+}
+
+// partitionIndexes returns whether each index of the log_entries partitions is valid
+func partitionIndexes(ctx context.Context, dbPool *pgxpool.Pool) (map[string]bool, error) {
+	rows, err := dbPool.Query(ctx,
+		`SELECT c.relname, x.indisvalid FROM pg_index x
+		JOIN pg_class c ON c.oid = x.indexrelid
+		JOIN pg_inherits i ON i.inhrelid = x.indrelid
+		WHERE i.inhparent = $1::regclass`,
+		LogEntriesTable,
+	)
+	if err != nil {
+		return nil, err
+	}
+	valid := map[string]bool{}
+	var name string
+	var isValid bool
+	_, err = pgx.ForEachRow(rows, []any{&name, &isValid}, func() error {
+		valid[name] = isValid
+		return nil
+	})
+	return valid, err
+}
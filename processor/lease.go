@@ -0,0 +1,147 @@
+package processor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"iis-logs-parser/config"
+	"iis-logs-parser/models"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// A processing file whose lease isn't renewed for this long is considered abandoned by a dead worker
+	LeaseDuration     = 2 * time.Minute
+	heartbeatInterval = LeaseDuration / 4
+	// Suffix of the stored copy of a streamed upload until its body is completely received
+	PartialUploadSuffix = ".part"
+)
+
+// WorkerID identifies this process as the owner of the leases it holds
+var WorkerID = newWorkerID()
+
+func newWorkerID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+// HoldLease renews the lease of the log file every heartbeat until the returned cancel function is called.
+// The returned context is cancelled as soon as the lease is lost, meaning the file was handed to another worker.
+func HoldLease(ctx context.Context, dbPool *pgxpool.Pool, logFileId uint) (context.Context, context.CancelFunc) {
+	leaseCtx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-leaseCtx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			tag, err := dbPool.Exec(leaseCtx,
+				"UPDATE log_files SET lease_expires_at = now() + $1::interval WHERE id = $2 AND lease_owner = $3 AND status = $4",
+				LeaseDuration, logFileId, WorkerID, models.StatusProcessing,
+			)
+			if err != nil {
+				// Transient, the lease is only lost once it expires
+				log.Err(err).Uint("fileId", logFileId).Msg("Lease: failed to renew lease")
+				continue
+			}
+			if tag.RowsAffected() == 0 {
+				log.Warn().Uint("fileId", logFileId).Msg("Lease: lease lost, stopping")
+				cancel()
+				return
+			}
+		}
+	}()
+
+	return leaseCtx, cancel
+}
+
+// ReapExpiredLeases returns the processing files whose lease expired to the queue, after removing their partial entries.
+// Files whose stored copy is incomplete (e.g. a streamed upload interrupted by a crash) can't be processed again and are failed instead.
+// Returns the number of reaped files.
+func ReapExpiredLeases(ctx context.Context, dbPool *pgxpool.Pool) (int, error) {
+	reaped := 0
+	for {
+		found, err := reapNextExpiredLease(ctx, dbPool)
+		if err != nil {
+			return reaped, err
+		}
+		if !found {
+			return reaped, nil
+		}
+		reaped++
+	}
+}
+
+func reapNextExpiredLease(ctx context.Context, dbPool *pgxpool.Pool) (bool, error) {
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Files without a lease at all were left in processing before leases existed
+	var logFile models.LogFile
+	var leaseOwner string
+	var isReprocess bool
+	err = tx.QueryRow(ctx,
+		`SELECT id, name, size, attempts, COALESCE(lease_owner, ''), processed_at IS NOT NULL FROM log_files
+		WHERE status = $1 AND (lease_expires_at IS NULL OR lease_expires_at < now())
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED`,
+		models.StatusProcessing,
+	).Scan(&logFile.ID, &logFile.Name, &logFile.Size, &logFile.Attempts, &leaseOwner, &isReprocess)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := discardPartialEntries(ctx, tx, logFile.ID, isReprocess); err != nil {
+		return false, err
+	}
+
+	status := models.StatusPending
+	lastError := "processing interrupted, the worker stopped renewing its lease"
+	if info, err := os.Stat(logFile.StoragePath()); err != nil || info.Size() < int64(logFile.Size) {
+		status = models.StatusFailed
+		lastError = "upload interrupted, the stored file is incomplete"
+		if err := os.Remove(logFile.StoragePath() + PartialUploadSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Err(err).Uint("fileId", logFile.ID).Msg("Lease: failed to remove partial upload")
+		}
+	} else if logFile.Attempts >= config.GetMaxAttemptsOrDefault() {
+		status = models.StatusFailed
+	}
+
+	_, err = tx.Exec(ctx,
+		"UPDATE log_files SET status = $1, last_error = $2, lease_owner = NULL, lease_expires_at = NULL, updated_at = now() WHERE id = $3",
+		status, lastError, logFile.ID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	log.Warn().
+		Uint("fileId", logFile.ID).
+		Str("leaseOwner", leaseOwner).
+		Str("status", string(status)).
+		Msg("Lease: reaped file with an expired lease")
+	return true, tx.Commit(ctx)
+}
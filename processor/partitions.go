@@ -0,0 +1,189 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"iis-logs-parser/config"
+	db "iis-logs-parser/database"
+	"iis-logs-parser/models"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+// Partitions known to exist, keyed by their start, so most batches don't need to check them in the database
+var knownPartitions sync.Map
+
+// ensureBatchPartitions creates the log_entries partitions the entries of the batch are routed to
+func ensureBatchPartitions(ctx context.Context, dbPool *pgxpool.Pool, batch []*models.LogEntry) error {
+	var missing [][2]time.Time
+	seen := map[time.Time]bool{}
+	for _, entry := range batch {
+		start, end := db.PartitionRange(entry.Timestamp)
+		if seen[start] {
+			continue
+		}
+		seen[start] = true
+		if _, ok := knownPartitions.Load(start); !ok {
+			missing = append(missing, [2]time.Time{start, end})
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return createPartitions(ctx, dbPool, missing)
+}
+
+func forgetBatchPartitions(batch []*models.LogEntry) {
+	for _, entry := range batch {
+		start, _ := db.PartitionRange(entry.Timestamp)
+		knownPartitions.Delete(start)
+	}
+}
+
+func createPartitions(ctx context.Context, dbPool *pgxpool.Pool, ranges [][2]time.Time) error {
+	err := pgx.BeginFunc(ctx, dbPool, func(tx pgx.Tx) error {
+		if err := lockPartitions(ctx, tx); err != nil {
+			return err
+		}
+		immediateIndexes := config.GetEntryIndexesModeOrDefault() == "immediate"
+		for _, r := range ranges {
+			name := db.PartitionName(r[0])
+			var exists bool
+			if err := tx.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", name).Scan(&exists); err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			if _, err := tx.Exec(ctx, db.CreatePartitionSQL(r[0], r[1])); err != nil {
+				return err
+			}
+			// Indexing the new partition while it's empty is instant, existing partitions are left to BuildEntryIndexes
+			if !immediateIndexes {
+				continue
+			}
+			for _, index := range db.EntryIndexes {
+				if _, err := tx.Exec(ctx, index.CreateSQL(name, false)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, r := range ranges {
+		knownPartitions.Store(r[0], true)
+	}
+	return nil
+}
+
+// lockPartitions serializes the changes to the partitions until the end of the transaction
+func lockPartitions(ctx context.Context, tx pgx.Tx) error {
+	_, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", db.PartitionsLockKey)
+	return err
+}
+
+// Dropping a partition locks log_entries, the jobs dropping them give up until their next run rather than blocking the ingestion
+const dropPartitionLockTimeout = "10s"
+
+// dropPartitionUnless drops the partition, unless keep returns true once the partition is locked, so nothing can be written to it meanwhile.
+// Returns the number of dropped entries and whether it was dropped.
+func dropPartitionUnless(ctx context.Context, dbPool *pgxpool.Pool, p partition, keep func(tx pgx.Tx) (bool, error)) (int64, bool, error) {
+	var count int64
+	dropped := false
+	err := pgx.BeginFunc(ctx, dbPool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "SET LOCAL lock_timeout = '"+dropPartitionLockTimeout+"'"); err != nil {
+			return err
+		}
+		if err := lockPartitions(ctx, tx); err != nil {
+			return err
+		}
+		table := pgx.Identifier{p.name}.Sanitize()
+		if _, err := tx.Exec(ctx, "LOCK TABLE "+table+" IN ACCESS EXCLUSIVE MODE"); err != nil {
+			return err
+		}
+		if keep != nil {
+			if kept, err := keep(tx); err != nil || kept {
+				return err
+			}
+		}
+		if err := tx.QueryRow(ctx, "SELECT COUNT(*) FROM "+table).Scan(&count); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, "DROP TABLE "+table)
+		dropped = err == nil
+		return err
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	if dropped {
+		knownPartitions.Delete(p.start)
+	}
+	return count, dropped, nil
+}
+
+type partition struct {
+	name       string
+	start, end time.Time
+}
+
+var partitionBoundRegex = regexp.MustCompile(`FROM \('([^']+)'\) TO \('([^']+)'\)`)
+
+// listPartitions returns the existing log_entries partitions with their range
+func listPartitions(ctx context.Context, dbPool *pgxpool.Pool) ([]partition, error) {
+	rows, err := dbPool.Query(ctx,
+		`SELECT c.relname, pg_get_expr(c.relpartbound, c.oid) FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = $1::regclass
+		ORDER BY c.relname`,
+		LogEntriesTable,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var partitions []partition
+	var name, bound string
+	_, err = pgx.ForEachRow(rows, []any{&name, &bound}, func() error {
+		match := partitionBoundRegex.FindStringSubmatch(bound)
+		if match == nil {
+			return fmt.Errorf("unexpected bound of partition %s: %s", name, bound)
+		}
+		start, err := time.Parse(time.DateTime, match[1])
+		if err != nil {
+			return err
+		}
+		end, err := time.Parse(time.DateTime, match[2])
+		if err != nil {
+			return err
+		}
+		partitions = append(partitions, partition{name: name, start: start, end: end})
+		return nil
+	})
+	return partitions, err
+}
+
+// CreateFuturePartitions creates the log_entries partitions of the current period and of the ahead next ones,
+// so live ingestion never waits for a partition to be created
+func CreateFuturePartitions(ctx context.Context, dbPool *pgxpool.Pool, ahead int) error {
+	var ranges [][2]time.Time
+	start, end := db.PartitionRange(time.Now().UTC())
+	for range ahead + 1 {
+		ranges = append(ranges, [2]time.Time{start, end})
+		start, end = db.PartitionRange(end)
+	}
+
+	if err := createPartitions(ctx, dbPool, ranges); err != nil {
+		return err
+	}
+	log.Info().Time("until", ranges[len(ranges)-1][1]).Msg("Partitions: log entries partitions created in advance")
+	return nil
+}
@@ -3,16 +3,21 @@ package processor
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"iis-logs-parser/config"
 	"iis-logs-parser/models"
 	"iis-logs-parser/parser"
 	"iis-logs-parser/utils"
+	"io"
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -29,6 +34,50 @@ func init() {
 	// log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 }
 
+const (
+	LogEntriesTable        = "log_entries"
+	LogEntriesStagingTable = "log_entries_staging"
+)
+
+var logEntryColumns = []string{"log_file_id", "line_number", "byte_offset", "timestamp", "date", "time", "server_ip_id", "method", "uri_stem_id", "uri_query", "port", "username", "client_ip", "user_agent_id", "status", "sub_status", "win32_status", "time_taken"}
+
+// sourceLine is a raw line along with its position in the source file
+type sourceLine struct {
+	text   string
+	number int64 // 1-based
+	offset int64 // offset of the line's first byte
+	size   int64 // bytes of the line, including its terminator
+}
+
+// readLines sends every line of r to lines, stripped from its line terminator, and returns the number of lines and bytes read
+func readLines(ctx context.Context, r io.Reader, lines chan<- sourceLine) (int64, int64, error) {
+	reader := bufio.NewReaderSize(r, 64*1024)
+	var number, offset int64
+	for {
+		text, err := reader.ReadString('\n')
+		if len(text) > 0 {
+			number++
+			select {
+			case lines <- sourceLine{
+				text:   strings.TrimRight(text, "\r\n"),
+				number: number,
+				offset: offset,
+				size:   int64(len(text)),
+			}:
+			case <-ctx.Done():
+				return number - 1, offset, ctx.Err()
+			}
+			offset += int64(len(text))
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return number, offset, nil
+			}
+			return number, offset, err
+		}
+	}
+}
+
 type Metrics struct {
 	mu                 sync.Mutex
 	TotalRecords       int64
@@ -37,10 +86,47 @@ type Metrics struct {
 	StartTime          time.Time
 	BatchCount         int64 // For batch operations
 	LastError          error
-	TotalParsingTime   time.Duration
-	TotalInsertionTime time.Duration
+	TotalParsingTime   time.Duration // Summed over the parsing goroutines
+	TotalInsertionTime time.Duration // Summed over the batches
 	StartTimestamp     time.Time
 	EndTimestamp       time.Time
+	LinesRead          int64
+	BytesRead          int64
+	RejectedLines      int64 // Lines that couldn't be parsed
+	DuplicateLines     int64 // Lines identical to a previous line of the file, still inserted
+	// DuplicateLines is a lower bound, past DUPLICATE_LINES_TRACKED distinct lines only the duplicates of the first ones are counted
+	DuplicateLinesApproximate bool
+	Duration                  time.Duration
+	lineHashes                *lineHashSet
+	summary                   *summaryCollector
+	entriesQuota              entriesQuota
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		StartTime:      time.Now(),
+		StartTimestamp: time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC),
+		EndTimestamp:   time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC),
+		lineHashes:     newLineHashSet(config.GetDuplicateLinesTrackedOrDefault()),
+		summary:        newSummaryCollector(),
+	}
+}
+
+// mergeSummary adds the entries aggregated by a combiner to the file's summary
+func (m *Metrics) mergeSummary(collector *summaryCollector) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.summary.merge(collector)
+}
+
+// Summary returns the summary of the ingested entries, nil for metrics without one
+func (m *Metrics) Summary() *models.LogFileSummary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.summary == nil {
+		return nil
+	}
+	return m.summary.summary()
 }
 
 func (m *Metrics) AddParsingTime(duration time.Duration) {
@@ -55,12 +141,19 @@ func (m *Metrics) AddInsertionTime(duration time.Duration) {
 	m.TotalInsertionTime += duration
 }
 
-func (m *Metrics) CheckAndSetTimestamps(tsDate string, tsTime string) {
-	timestamp, err := time.Parse(time.DateTime, tsDate+" "+tsTime)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to parse timestamp")
-		return
-	}
+func (m *Metrics) SetLastError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.LastError = err
+}
+
+func (m *Metrics) GetLastError() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.LastError
+}
+
+func (m *Metrics) CheckAndSetTimestamps(timestamp time.Time) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if timestamp.Before(m.StartTimestamp) {
@@ -90,19 +183,22 @@ func combineBatchInsert(
 	wgCombiner *sync.WaitGroup,
 	results <-chan *models.LogEntry,
 	dbPool *pgxpool.Pool,
+	table string,
 	writer *utils.SyncWriter,
 	metrics *Metrics,
 ) {
-	startTime := time.Now()
 	defer wgCombiner.Done()
 	defer metrics.LogMetrics("batch_insert")
 
+	collector := newSummaryCollector()
+	defer metrics.mergeSummary(collector)
+
 	entriesBatchSize := 10000
 	entriesBatch := make([]*models.LogEntry, 0, entriesBatchSize)
 
 	for entry := range results {
 		atomic.AddInt64(&metrics.TotalRecords, 1)
-		metrics.CheckAndSetTimestamps(entry.Date, entry.Time)
+		metrics.CheckAndSetTimestamps(entry.Timestamp)
 
 		// Write to file using synchronized writer
 		if err := writer.WriteString(entry.String()); err != nil {
@@ -111,9 +207,10 @@ func combineBatchInsert(
 			continue
 		}
 
+		collector.add(entry)
 		entriesBatch = append(entriesBatch, entry)
 		if len(entriesBatch) >= entriesBatchSize {
-			if err := insertBatch(dbPool, entriesBatch, metrics); err != nil {
+			if err := insertBatch(dbPool, table, entriesBatch, metrics); err != nil {
 				log.Error().Err(err).Msg("Batch insertion failed")
 			}
 			atomic.AddInt64(&metrics.BatchCount, 1)
@@ -123,38 +220,105 @@ func combineBatchInsert(
 
 	// Final batch insert
 	if len(entriesBatch) > 0 {
-		if err := insertBatch(dbPool, entriesBatch, metrics); err != nil {
+		if err := insertBatch(dbPool, table, entriesBatch, metrics); err != nil {
 			log.Error().Err(err).Msg("Final batch insertion failed")
 		}
 		atomic.AddInt64(&metrics.BatchCount, 1)
 	}
-	metrics.AddInsertionTime(time.Since(startTime))
 }
 
-func insertBatch(dbPool *pgxpool.Pool, batch []*models.LogEntry, metrics *Metrics) error {
+func insertBatch(dbPool *pgxpool.Pool, table string, batch []*models.LogEntry, metrics *Metrics) error {
 	startTime := time.Now()
-	tx, err := dbPool.Begin(context.Background())
+	defer func() { metrics.AddInsertionTime(time.Since(startTime)) }()
+
+	// Staged entries end up in log_entries too, their partitions are created upfront as well
+	var count int64
+	err := ensureBatchPartitions(context.Background(), dbPool, batch)
+	charged := false
+	if err == nil {
+		// Staged entries replace the current entries of the file
+		err = metrics.entriesQuota.charge(context.Background(), dbPool, batch[0].LogFileID, int64(len(batch)), table == LogEntriesStagingTable)
+		charged = err == nil
+	}
+	if err == nil {
+		err = encodeBatch(context.Background(), dbPool, batch)
+	}
+	if err == nil {
+		count, err = copyBatch(dbPool, table, batch)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23514" { // check_violation, no partition for some rows
+			// One was dropped by another process since it was cached
+			forgetBatchPartitions(batch)
+			if err = ensureBatchPartitions(context.Background(), dbPool, batch); err == nil {
+				count, err = copyBatch(dbPool, table, batch)
+			}
+		}
+	}
 	if err != nil {
+		if charged {
+			metrics.entriesQuota.refund(int64(len(batch)))
+		}
+		atomic.AddInt64(&metrics.FailedWrites, int64(len(batch)))
+		metrics.SetLastError(err)
 		return err
 	}
 
-	count, err := tx.CopyFrom(
-		context.Background(),
-		pgx.Identifier{"log_entries"},
-		[]string{"log_file_id", "date", "time", "server_ip", "method", "uri_stem", "uri_query", "port", "username", "client_ip", "user_agent", "status", "sub_status", "win32_status", "time_taken"},
+	atomic.AddInt64(&metrics.SuccessfulWrites, count)
+
+	log.Debug().
+		Int("batch_size", len(batch)).
+		Dur("batch insertion duration", time.Since(startTime)).
+		Msg("Batch inserted successfully")
+
+	return nil
+}
+
+// copyBatch inserts the batch of a log file with COPY and adds it to the rollups, in its own transaction.
+// Entries inserted in log_entries are added to the entries counter of the file.
+func copyBatch(dbPool *pgxpool.Pool, table string, batch []*models.LogEntry) (int64, error) {
+	tx, err := dbPool.Begin(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(context.Background())
+
+	count, err := copyEntries(context.Background(), tx, table, batch)
+	if err != nil {
+		return 0, err
+	}
+	if err := upsertRollups(context.Background(), tx, rollupsTable(table), batch); err != nil {
+		return 0, err
+	}
+	if table == LogEntriesTable {
+		if _, err := tx.Exec(context.Background(), "UPDATE log_files SET entries = entries + $1 WHERE id = $2", count, batch[0].LogFileID); err != nil {
+			return 0, err
+		}
+	}
+	return count, tx.Commit(context.Background())
+}
+
+// copyEntries copies the dictionary-encoded entries into the table
+func copyEntries(ctx context.Context, tx pgx.Tx, table string, batch []*models.LogEntry) (int64, error) {
+	return tx.CopyFrom(
+		ctx,
+		pgx.Identifier{table},
+		logEntryColumns,
 		pgx.CopyFromSlice(len(batch), func(i int) ([]interface{}, error) {
 			return []interface{}{
 				batch[i].LogFileID,
+				batch[i].LineNumber,
+				batch[i].ByteOffset,
+				batch[i].Timestamp,
 				batch[i].Date,
 				batch[i].Time,
-				batch[i].ServerIP,
+				batch[i].ServerIPID,
 				batch[i].Method,
-				batch[i].URIStem,
+				batch[i].URIStemID,
 				batch[i].URIQuery,
 				batch[i].Port,
 				batch[i].Username,
 				batch[i].ClientIP,
-				batch[i].UserAgent,
+				batch[i].UserAgentID,
 				batch[i].Status,
 				batch[i].SubStatus,
 				batch[i].Win32Status,
@@ -162,37 +326,20 @@ func insertBatch(dbPool *pgxpool.Pool, batch []*models.LogEntry, metrics *Metric
 			}, nil
 		},
 		))
-
-	if err != nil {
-		atomic.AddInt64(&metrics.FailedWrites, int64(len(batch)))
-		metrics.LastError = err
-		tx.Rollback(context.Background())
-		return err
-	}
-
-	if err := tx.Commit(context.Background()); err != nil {
-		atomic.AddInt64(&metrics.FailedWrites, int64(len(batch)))
-		metrics.LastError = err
-	}
-
-	atomic.AddInt64(&metrics.SuccessfulWrites, count)
-
-	log.Debug().
-		Int("batch_size", len(batch)).
-		Dur("batch insertion duration", time.Since(startTime)).
-		Msg("Batch inserted successfully")
-
-	return nil
 }
 
-func combineNoDB(wgCombiner *sync.WaitGroup, results <-chan *models.LogEntry, writer *utils.SyncWriter) {
+func combineNoDB(wgCombiner *sync.WaitGroup, results <-chan *models.LogEntry, writer *utils.SyncWriter, fileMetrics *Metrics) {
 	defer wgCombiner.Done()
 
 	metrics := &Metrics{StartTime: time.Now()}
 	defer metrics.LogMetrics("no_db_processing")
 
+	collector := newSummaryCollector()
+	defer fileMetrics.mergeSummary(collector)
+
 	for entry := range results {
 		atomic.AddInt64(&metrics.TotalRecords, 1)
+		fileMetrics.CheckAndSetTimestamps(entry.Timestamp)
 
 		if err := writer.WriteString(entry.String()); err != nil {
 			atomic.AddInt64(&metrics.FailedWrites, 1)
@@ -202,6 +349,7 @@ func combineNoDB(wgCombiner *sync.WaitGroup, results <-chan *models.LogEntry, wr
 				Msg("Failed to write to output file")
 			continue
 		}
+		collector.add(entry)
 		atomic.AddInt64(&metrics.SuccessfulWrites, 1)
 	}
 }
@@ -216,11 +364,14 @@ func combinerBuilder(
 ) func() {
 	switch dbInsertionT {
 	case "batch":
-		return func() { combineBatchInsert(wgCombiner, results, dbPool, writer, metrics) }
+		return func() { combineBatchInsert(wgCombiner, results, dbPool, LogEntriesTable, writer, metrics) }
+	case "staging":
+		// Same as batch, but the entries only become visible after ReplaceStagedEntries is called
+		return func() { combineBatchInsert(wgCombiner, results, dbPool, LogEntriesStagingTable, writer, metrics) }
 	case "none":
-		return func() { combineNoDB(wgCombiner, results, writer) }
+		return func() { combineNoDB(wgCombiner, results, writer, metrics) }
 	default:
-		log.Fatal().Msg("Invalid combiner type, must be one of 'batch', or 'none'")
+		log.Fatal().Msg("Invalid combiner type, must be one of 'batch', 'staging' or 'none'")
 		return func() {}
 	}
 }
@@ -233,20 +384,39 @@ func ProcessLogFile(
 	dbInsertionT string,
 	logFileId uint,
 ) (int64, time.Time, time.Time, error) {
-
-	metrics := &Metrics{
-		StartTime:      time.Now(),
-		StartTimestamp: time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC),
-		EndTimestamp:   time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC),
-	}
-
 	file, err := os.Open(filename)
 	if err != nil {
+		metrics := newMetrics()
 		return 0, metrics.StartTimestamp, metrics.EndTimestamp, fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
 
-	lines := make(chan string)
+	metrics, err := ProcessLogReader(context.Background(), file, filename+"_"+"parsed_logs.txt", numWorkers, dbPool, dbInsertionT, logFileId)
+	if err != nil {
+		return 0, metrics.StartTimestamp, metrics.EndTimestamp, err
+	}
+	return metrics.Duration.Nanoseconds(), metrics.StartTimestamp, metrics.EndTimestamp, nil
+}
+
+// ProcessLogReader parses the log lines read from r and inserts them as entries of the log file,
+// it returns once r is fully consumed and all the entries are inserted.
+// The returned metrics are never nil, even on error.
+func ProcessLogReader(
+	ctx context.Context,
+	r io.Reader,
+	outputFilename string,
+	numWorkers int,
+	dbPool *pgxpool.Pool,
+	dbInsertionT string,
+	logFileId uint,
+) (*Metrics, error) {
+	metrics := newMetrics()
+
+	// Cancelled with the cause when the rest of the file can't be parsed
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	lines := make(chan sourceLine)
 	results := make(chan *models.LogEntry)
 	errorsChan := make(chan error)
 	done := make(chan bool)
@@ -258,26 +428,43 @@ func ProcessLogFile(
 	for i := 0; i < numWorkers; i++ {
 		wgWorkers.Add(1)
 		go func(id int) {
-			startTime := time.Now()
 			defer wgWorkers.Done()
+			var parsingTime time.Duration
+			defer func() { metrics.AddParsingTime(parsingTime) }()
 			for line := range lines {
-				entry, err := parser.ParseLogLine(line)
+				startTime := time.Now()
+				entry, err := parser.ParseLogLine(line.text)
+				parsingTime += time.Since(startTime)
+				if errors.Is(err, parser.ErrUnsupportedFields) {
+					cancel(fmt.Errorf("line %d: %w", line.number, err))
+					continue
+				}
 				if err != nil {
+					if parseErr, ok := err.(*parser.ParseError); ok {
+						parseErr.LineNumber = line.number
+					}
+					atomic.AddInt64(&metrics.RejectedLines, 1)
 					errorsChan <- err
 					continue
 				}
 				if entry != nil {
+					if metrics.lineHashes != nil && metrics.lineHashes.add(line.text) {
+						atomic.AddInt64(&metrics.DuplicateLines, 1)
+					}
 					entry.LogFileID = logFileId
+					entry.LineNumber = line.number
+					entry.ByteOffset = line.offset
+					entry.LineSize = line.size
 					results <- entry
 				}
 			}
-			metrics.AddParsingTime(time.Since(startTime))
 		}(i)
 	}
 
-	outputFile, err := os.Create(filename + "_" + "parsed_logs.txt")
+	outputFile, err := os.Create(outputFilename)
 	if err != nil {
-		return 0, metrics.StartTimestamp, metrics.EndTimestamp, fmt.Errorf("failed to create output file: %w", err)
+		close(lines)
+		return metrics, fmt.Errorf("failed to create output file: %w", err)
 	}
 	defer outputFile.Close()
 	syncWriter := utils.NewSyncWriter(outputFile)
@@ -285,7 +472,7 @@ func ProcessLogFile(
 
 	// Combiner - Fan-in - Merge
 	combine := combinerBuilder(dbInsertionT, &wgCombiner, results, dbPool, syncWriter, metrics)
-	for i := 0; i < (numWorkers / 2); i++ {
+	for i := 0; i < max(numWorkers/2, 1); i++ {
 		wgCombiner.Add(1)
 		go combine()
 	}
@@ -296,6 +483,7 @@ func ProcessLogFile(
 				log.Warn().
 					Str("error", parseErr.Message).
 					Str("line", parseErr.Line).
+					Int64("line_number", parseErr.LineNumber).
 					Msg("Failed to parse log line")
 			} else {
 				log.Error().Err(err).Msg("Unexpected error during parsing")
@@ -312,27 +500,119 @@ func ProcessLogFile(
 	}()
 
 	// Read and distribute lines to workers
-	scanner := bufio.NewScanner(file)
-	lineCount := 0
-	for scanner.Scan() {
-		lines <- scanner.Text()
-		lineCount++
-	}
+	lineCount, byteCount, readErr := readLines(ctx, r, lines)
 	close(lines)
 
-	if err := scanner.Err(); err != nil {
-		return 0, metrics.StartTimestamp, metrics.EndTimestamp, fmt.Errorf("error reading file: %w", err)
+	// Wait, even on read errors, so that no goroutine is left behind
+	<-done
+	metrics.LinesRead = lineCount
+	metrics.BytesRead = byteCount
+	metrics.Duration = time.Since(metrics.StartTime)
+	metrics.DuplicateLinesApproximate = !metrics.lineHashes.isExact()
+	// Not needed anymore, and possibly large
+	metrics.lineHashes = nil
+
+	if cause := context.Cause(ctx); cause != nil {
+		return metrics, cause
+	}
+	if readErr != nil {
+		return metrics, fmt.Errorf("error reading file: %w", readErr)
 	}
 
-	// Wait
-	<-done
+	if err := metrics.GetLastError(); err != nil {
+		return metrics, fmt.Errorf("failed to insert %d entries: %w", atomic.LoadInt64(&metrics.FailedWrites), err)
+	}
 
-	duration := time.Since(metrics.StartTime)
 	log.Info().
-		Int("total_lines", lineCount).
-		Float64("duration_seconds", duration.Seconds()).
-		Float64("lines_per_second", float64(lineCount)/duration.Seconds()).
+		Int64("total_lines", lineCount).
+		Float64("duration_seconds", metrics.Duration.Seconds()).
+		Float64("lines_per_second", float64(lineCount)/metrics.Duration.Seconds()).
 		Msg("Finished processing log file")
 
-	return duration.Nanoseconds(), metrics.StartTimestamp, metrics.EndTimestamp, nil
+	return metrics, nil
+}
+
+// ClearStagedEntries removes leftovers of a previous (failed) staging run of the log file
+func ClearStagedEntries(ctx context.Context, dbPool *pgxpool.Pool, logFileId uint) error {
+	return pgx.BeginFunc(ctx, dbPool, func(tx pgx.Tx) error {
+		return deleteFileRows(ctx, tx, logFileId, LogEntriesStagingTable, LogRollupsStagingTable)
+	})
+}
+
+// deleteFileRows deletes the rows of the log file from each table
+func deleteFileRows(ctx context.Context, tx pgx.Tx, logFileId uint, tables ...string) error {
+	for _, table := range tables {
+		if _, err := tx.Exec(ctx, "DELETE FROM "+table+" WHERE log_file_id = $1", logFileId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discardPartialEntries removes what an interrupted run of the log file inserted: its staged entries,
+// and its entries too unless it was successfully processed before, since those are then complete
+func discardPartialEntries(ctx context.Context, tx pgx.Tx, logFileId uint, isReprocess bool) error {
+	if err := deleteFileRows(ctx, tx, logFileId, LogEntriesStagingTable, LogRollupsStagingTable); err != nil {
+		return err
+	}
+	if !isReprocess {
+		if err := deleteFileRows(ctx, tx, logFileId, LogEntriesTable, LogRollupsTable); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, "UPDATE log_files SET entries = 0 WHERE id = $1", logFileId)
+		return err
+	}
+	return nil
+}
+
+// DiscardPartialEntries removes the entries inserted by a failed first run of the log file
+func DiscardPartialEntries(ctx context.Context, dbPool *pgxpool.Pool, logFileId uint) error {
+	return pgx.BeginFunc(ctx, dbPool, func(tx pgx.Tx) error {
+		return discardPartialEntries(ctx, tx, logFileId, false)
+	})
+}
+
+// ReplaceStagedEntries swaps the current entries and rollups of the log file with the staged ones in a single transaction,
+// so readers either see the old entries or the new ones, never a mix of both.
+// Returns the number of entries moved from the staging table.
+func ReplaceStagedEntries(ctx context.Context, dbPool *pgxpool.Pool, logFileId uint) (int64, error) {
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DELETE FROM "+LogEntriesTable+" WHERE log_file_id = $1", logFileId); err != nil {
+		return 0, fmt.Errorf("failed to delete old entries: %w", err)
+	}
+
+	columns := strings.Join(logEntryColumns, ", ")
+	tag, err := tx.Exec(ctx,
+		"INSERT INTO "+LogEntriesTable+" ("+columns+") SELECT "+columns+" FROM "+LogEntriesStagingTable+" WHERE log_file_id = $1",
+		logFileId,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to move staged entries: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, "DELETE FROM "+LogEntriesStagingTable+" WHERE log_file_id = $1", logFileId); err != nil {
+		return 0, fmt.Errorf("failed to clear staged entries: %w", err)
+	}
+	if _, err := tx.Exec(ctx, "UPDATE log_files SET entries = $1 WHERE id = $2", tag.RowsAffected(), logFileId); err != nil {
+		return 0, fmt.Errorf("failed to count entries: %w", err)
+	}
+
+	// The rollups are swapped along with the entries they count
+	if err := deleteFileRows(ctx, tx, logFileId, LogRollupsTable); err != nil {
+		return 0, fmt.Errorf("failed to delete old rollups: %w", err)
+	}
+	_, err = tx.Exec(ctx, "INSERT INTO "+LogRollupsTable+" ("+logRollupColumns+") SELECT "+logRollupColumns+" FROM "+LogRollupsStagingTable+" WHERE log_file_id = $1", logFileId)
+	if err != nil {
+		return 0, fmt.Errorf("failed to move staged rollups: %w", err)
+	}
+	if err := deleteFileRows(ctx, tx, logFileId, LogRollupsStagingTable); err != nil {
+		return 0, fmt.Errorf("failed to clear staged rollups: %w", err)
+	}
+
+	return tag.RowsAffected(), tx.Commit(ctx)
 }
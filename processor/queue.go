@@ -0,0 +1,345 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iis-logs-parser/config"
+	"iis-logs-parser/models"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Delay before reconnecting after the notifications connection is lost
+	listenRetryDelay = 5 * time.Second
+	// Time given to an interrupted file to be returned to the queue
+	checkpointTimeout = 10 * time.Second
+)
+
+// Queue processes the pending log files, several at a time.
+// Files are claimed with SELECT ... FOR UPDATE SKIP LOCKED, so any number of queues,
+// in the same process or in other replicas, can share the same database without processing a file twice.
+type Queue struct {
+	dbPool         *pgxpool.Pool
+	slots          chan struct{} // one per file being processed
+	workersPerFile int
+
+	// Files are processed until Shutdown gives up on them, independently of the claiming context
+	processCtx     context.Context
+	stopProcessing context.CancelFunc
+	mu             sync.Mutex
+	stopping       bool
+	active         sync.WaitGroup
+}
+
+// job is a claimed log file
+type job struct {
+	logFile     models.LogFile
+	isReprocess bool
+}
+
+// NewQueue creates a queue processing up to maxConcurrentFiles files at a time,
+// the workerBudget parsing goroutines are shared evenly between them.
+func NewQueue(dbPool *pgxpool.Pool, maxConcurrentFiles int, workerBudget int) *Queue {
+	maxConcurrentFiles = max(maxConcurrentFiles, 1)
+	processCtx, stopProcessing := context.WithCancel(context.Background())
+	return &Queue{
+		dbPool:         dbPool,
+		slots:          make(chan struct{}, maxConcurrentFiles),
+		workersPerFile: max(workerBudget/maxConcurrentFiles, 1),
+		processCtx:     processCtx,
+		stopProcessing: stopProcessing,
+	}
+}
+
+// ActiveFiles returns the number of files being processed
+func (q *Queue) ActiveFiles() int {
+	return len(q.slots)
+}
+
+// ProcessPending claims pending files as long as there are some and a slot is free,
+// it returns once no pending file is left, while the last claimed files may still be processing.
+func (q *Queue) ProcessPending(ctx context.Context) {
+	for {
+		select {
+		case q.slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+
+		job, err := q.claimNext(ctx)
+		if err != nil || job == nil {
+			<-q.slots
+			if err != nil {
+				log.Err(err).Msg("Queue: failed to claim a pending file")
+			}
+			return
+		}
+
+		q.mu.Lock()
+		if q.stopping {
+			q.mu.Unlock()
+			<-q.slots
+			q.checkpoint(job)
+			return
+		}
+		q.active.Add(1)
+		q.mu.Unlock()
+
+		go func() {
+			defer q.active.Done()
+			defer func() { <-q.slots }()
+			q.process(q.processCtx, job)
+		}()
+	}
+}
+
+// Shutdown stops claiming files and waits for the ones being processed to finish.
+// Files still processing once ctx is done are interrupted and returned to the queue, to be processed again by another worker.
+func (q *Queue) Shutdown(ctx context.Context) {
+	q.mu.Lock()
+	q.stopping = true
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+	log.Warn().Int("activeFiles", q.ActiveFiles()).Msg("Queue: shutdown deadline reached, interrupting the files being processed")
+	q.stopProcessing()
+	<-done
+}
+
+// claimNext atomically flips the first file of the log_files_queue view to processing and leases it to this worker,
+// returns nil if there is none. Rows locked by other claimers are skipped instead of waited for.
+func (q *Queue) claimNext(ctx context.Context) (*job, error) {
+	var j job
+	err := q.dbPool.QueryRow(ctx,
+		`UPDATE log_files SET status = $1, lease_owner = $3, lease_expires_at = now() + $4::interval,
+			attempts = attempts + 1, next_retry_at = NULL, updated_at = now()
+		WHERE id = (
+			SELECT f.id FROM log_files f
+			JOIN log_files_queue q ON q.id = f.id
+			WHERE f.status = $2
+			ORDER BY q.position
+			LIMIT 1
+			FOR UPDATE OF f SKIP LOCKED
+		)
+		RETURNING id, name, domain_id, attempts, processed_at IS NOT NULL`,
+		models.StatusProcessing, models.StatusPending, WorkerID, LeaseDuration,
+	).Scan(&j.logFile.ID, &j.logFile.Name, &j.logFile.DomainID, &j.logFile.Attempts, &j.isReprocess)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+func (q *Queue) process(ctx context.Context, j *job) {
+	fileId, fileName := j.logFile.ID, j.logFile.Name
+	log.Info().Msgf("Starting to process file: %s with id: %d", fileName, fileId)
+
+	leaseCtx, releaseLease := HoldLease(ctx, q.dbPool, fileId)
+	defer releaseLease()
+
+	metrics, err := q.ingest(leaseCtx, j)
+	if err != nil && ctx.Err() != nil {
+		log.Warn().Msgf("Interrupted processing file by shutdown: %s with id: %d", fileName, fileId)
+		q.checkpoint(j)
+		return
+	}
+	if leaseCtx.Err() != nil && ctx.Err() == nil {
+		// The lease was lost, the file is not ours to update anymore
+		log.Warn().Msgf("Abandoned file after losing its lease: %s with id: %d", fileName, fileId)
+		return
+	}
+	// The outcome is recorded even if the queue is shutting down meanwhile
+	ctx = context.WithoutCancel(ctx)
+	if metrics != nil {
+		if err := SaveFileStats(ctx, q.dbPool, fileId, metrics); err != nil {
+			log.Err(err).Msgf("Failed to save stats of file: %s with id: %d", fileName, fileId)
+		}
+	}
+	if err != nil {
+		log.Err(err).Msgf("Failed to process file: %s with id: %d", fileName, fileId)
+		if err := q.fail(ctx, j, err); err != nil {
+			log.Err(err).Msgf("Failed to update file status to failed: %s with id: %d", fileName, fileId)
+		}
+		return
+	}
+
+	log.Info().Msgf("Finished processing file: %s with id: %d", fileName, fileId)
+	_, err = q.dbPool.Exec(ctx,
+		`UPDATE log_files SET status = $1, start_timestamp = $2, end_timestamp = $3, parsing_time = $4, processed_at = now(),
+			last_error = '', lease_owner = NULL, lease_expires_at = NULL, updated_at = now()
+		WHERE id = $5 AND lease_owner = $6`,
+		models.StatusCompleted, metrics.StartTimestamp, metrics.EndTimestamp, metrics.Duration.Nanoseconds(), fileId, WorkerID,
+	)
+	if err != nil {
+		log.Err(err).Msgf("Failed to update file status to completed: %s with id: %d", fileName, fileId)
+	}
+}
+
+// checkpoint returns an interrupted file to the queue after discarding its partial entries, the attempt isn't counted
+func (q *Queue) checkpoint(j *job) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkpointTimeout)
+	defer cancel()
+
+	err := pgx.BeginFunc(ctx, q.dbPool, func(tx pgx.Tx) error {
+		if err := discardPartialEntries(ctx, tx, j.logFile.ID, j.isReprocess); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx,
+			`UPDATE log_files SET status = $1, attempts = GREATEST(attempts - 1, 0), last_error = $2,
+				lease_owner = NULL, lease_expires_at = NULL, updated_at = now()
+			WHERE id = $3 AND lease_owner = $4`,
+			models.StatusPending, "processing interrupted by a worker shutdown", j.logFile.ID, WorkerID,
+		)
+		return err
+	})
+	if err != nil {
+		// The lease expires and the reaper requeues it anyway
+		log.Err(err).Uint("fileId", j.logFile.ID).Msg("Queue: failed to return interrupted file to the queue")
+		return
+	}
+	log.Info().Uint("fileId", j.logFile.ID).Msg("Queue: returned interrupted file to the queue")
+}
+
+// fail discards the partial entries of the file, then schedules a retry with backoff for transient errors,
+// or marks the file as failed for good
+func (q *Queue) fail(ctx context.Context, j *job, processErr error) error {
+	status := models.StatusFailed
+	var nextRetryAt *time.Time
+	if IsTransientError(processErr) && j.logFile.Attempts < config.GetMaxAttemptsOrDefault() {
+		status = models.StatusPending
+		retryAt := time.Now().Add(RetryBackoff(j.logFile.Attempts))
+		nextRetryAt = &retryAt
+		log.Info().Uint("fileId", j.logFile.ID).Time("nextRetryAt", retryAt).Msg("Queue: transient failure, retrying later")
+	}
+
+	return pgx.BeginFunc(ctx, q.dbPool, func(tx pgx.Tx) error {
+		if err := discardPartialEntries(ctx, tx, j.logFile.ID, j.isReprocess); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx,
+			`UPDATE log_files SET status = $1, last_error = $2, next_retry_at = $3, lease_owner = NULL, lease_expires_at = NULL, updated_at = now()
+			WHERE id = $4 AND lease_owner = $5`,
+			status, processErr.Error(), nextRetryAt, j.logFile.ID, WorkerID,
+		)
+		return err
+	})
+}
+
+func (q *Queue) ingest(ctx context.Context, j *job) (*Metrics, error) {
+	fileId := j.logFile.ID
+
+	// Already processed files are loaded in the staging table and swapped at the end,
+	// so their old entries stay visible until the new ones are complete
+	dbInsertionT := "batch"
+	if j.isReprocess {
+		dbInsertionT = "staging"
+		if err := ClearStagedEntries(ctx, q.dbPool, fileId); err != nil {
+			return nil, fmt.Errorf("failed to clear staged entries: %w", err)
+		}
+	}
+
+	file, err := os.Open(j.logFile.StoragePath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	metrics, err := ProcessLogReader(ctx, file, j.logFile.StoragePath()+"_"+"parsed_logs.txt", q.workersPerFile, q.dbPool, dbInsertionT, fileId)
+	if err != nil {
+		return metrics, err
+	}
+
+	if j.isReprocess {
+		if _, err := ReplaceStagedEntries(ctx, q.dbPool, fileId); err != nil {
+			return metrics, err
+		}
+	}
+	return metrics, nil
+}
+
+// Listen processes the pending files as soon as they are notified on channel, until ctx is cancelled.
+// Notifications received while files are being claimed are coalesced into a single new claiming round.
+// The queue is also polled every pollInterval, to catch up on missed notifications and retries coming due.
+func (q *Queue) Listen(ctx context.Context, channel string, pollInterval time.Duration) {
+	wake := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-wake:
+			case <-ticker.C:
+			}
+			q.ProcessPending(ctx)
+		}
+	}()
+
+	for {
+		err := q.listen(ctx, channel, notify)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Err(err).Str("channel", channel).Msg("Queue: lost the notifications connection, reconnecting")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(listenRetryDelay):
+		}
+	}
+}
+
+func (q *Queue) listen(ctx context.Context, channel string, notify func()) error {
+	poolConn, err := q.dbPool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// The connection keeps listening for as long as we wait on it, so it's taken out of the pool for good
+	conn := poolConn.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		return err
+	}
+	log.Info().Str("channel", channel).Msg("Queue: listening for pending files")
+
+	// Catch up on the files queued while we weren't listening
+	notify()
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		log.Debug().Str("fileId", notification.Payload).Msg("Queue: notified of a pending file")
+		notify()
+	}
+}
@@ -0,0 +1,189 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"iis-logs-parser/config"
+	"iis-logs-parser/models"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Quotas, as named in QuotaError
+const (
+	QuotaMaxFileSize      = "maxFileSize"
+	QuotaMaxStoredBytes   = "maxStoredBytes"
+	QuotaMaxEntries       = "maxEntries"
+	QuotaMaxUploadsPerDay = "maxUploadsPerDay"
+)
+
+// QuotaError is returned when a quota of a user or domain would be exceeded
+type QuotaError struct {
+	Scope string // "user" or "domain"
+	Quota string
+	Limit int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s quota %s of %d exceeded", e.Scope, e.Quota, e.Limit)
+}
+
+// Current UTC day of the daily_uploads counters
+const uploadsDaySQL = "(now() AT TIME ZONE 'UTC')::date"
+
+// LoadQuotaUsage returns the quotas and usage of the user, and of each of its domains
+func LoadQuotaUsage(ctx context.Context, dbPool *pgxpool.Pool, userId uint) (models.QuotaUsage, []models.DomainQuotaUsage, error) {
+	var user models.QuotaUsage
+	err := dbPool.QueryRow(ctx,
+		`SELECT COALESCE(quota_max_file_size, $2), COALESCE(quota_max_stored_bytes, $3), COALESCE(quota_max_entries, $4), COALESCE(quota_max_uploads_per_day, $5),
+			(SELECT COALESCE(SUM(uploads), 0) FROM daily_uploads WHERE user_id = $1 AND day = `+uploadsDaySQL+`)
+		FROM users WHERE id = $1`,
+		userId, config.GetQuotaMaxFileSize(), config.GetQuotaMaxStoredBytes(), config.GetQuotaMaxEntries(), config.GetQuotaMaxUploadsPerDay(),
+	).Scan(&user.Limits.MaxFileSize, &user.Limits.MaxStoredBytes, &user.Limits.MaxEntries, &user.Limits.MaxUploadsPerDay, &user.Usage.UploadsToday)
+	if err != nil {
+		return user, nil, err
+	}
+
+	rows, err := dbPool.Query(ctx,
+		`SELECT d.id, d.domain_name,
+			COALESCE(d.quota_max_file_size, 0), COALESCE(d.quota_max_stored_bytes, 0), COALESCE(d.quota_max_entries, 0), COALESCE(d.quota_max_uploads_per_day, 0),
+			COALESCE(SUM(f.stored_bytes), 0), COALESCE(SUM(f.entries), 0), COALESCE(MAX(u.uploads), 0)
+		FROM domains d
+		LEFT JOIN log_files f ON f.domain_id = d.id AND f.status <> $2
+		LEFT JOIN daily_uploads u ON u.domain_id = d.id AND u.day = `+uploadsDaySQL+`
+		WHERE d.user_id = $1 AND d.deleted_at IS NULL
+		GROUP BY d.id
+		ORDER BY d.id`,
+		userId, models.StatusDeleting,
+	)
+	if err != nil {
+		return user, nil, err
+	}
+	var domains []models.DomainQuotaUsage
+	var d models.DomainQuotaUsage
+	_, err = pgx.ForEachRow(rows, []any{
+		&d.DomainID, &d.DomainName,
+		&d.Limits.MaxFileSize, &d.Limits.MaxStoredBytes, &d.Limits.MaxEntries, &d.Limits.MaxUploadsPerDay,
+		&d.Usage.StoredBytes, &d.Usage.Entries, &d.Usage.UploadsToday,
+	}, func() error {
+		domains = append(domains, d)
+		user.Usage.StoredBytes += d.Usage.StoredBytes
+		user.Usage.Entries += d.Usage.Entries
+		return nil
+	})
+	return user, domains, err
+}
+
+// CheckUploadQuotas returns a *QuotaError if uploading files of these sizes exceeds a quota of the scope.
+// No more files can be uploaded once the entries quota is reached, since they couldn't be ingested.
+func CheckUploadQuotas(scope string, q models.QuotaUsage, sizes []int64) error {
+	var total int64
+	for _, size := range sizes {
+		if q.Limits.MaxFileSize > 0 && size > q.Limits.MaxFileSize {
+			return &QuotaError{Scope: scope, Quota: QuotaMaxFileSize, Limit: q.Limits.MaxFileSize}
+		}
+		total += size
+	}
+	switch {
+	case q.Limits.MaxStoredBytes > 0 && q.Usage.StoredBytes+total > q.Limits.MaxStoredBytes:
+		return &QuotaError{Scope: scope, Quota: QuotaMaxStoredBytes, Limit: q.Limits.MaxStoredBytes}
+	case q.Limits.MaxEntries > 0 && q.Usage.Entries >= q.Limits.MaxEntries:
+		return &QuotaError{Scope: scope, Quota: QuotaMaxEntries, Limit: q.Limits.MaxEntries}
+	case q.Limits.MaxUploadsPerDay > 0 && q.Usage.UploadsToday+int64(len(sizes)) > q.Limits.MaxUploadsPerDay:
+		return &QuotaError{Scope: scope, Quota: QuotaMaxUploadsPerDay, Limit: q.Limits.MaxUploadsPerDay}
+	}
+	return nil
+}
+
+// entriesQuota is the headroom of a log file under the entries quotas of its domain and user.
+// It's loaded with the first batch of the file then charged with each batch, and loaded again when a batch doesn't fit,
+// in case a quota was raised or entries were deleted meanwhile.
+type entriesQuota struct {
+	mu          sync.Mutex
+	loaded      bool
+	domainLimit int64 // 0 is no limit
+	domainLeft  int64
+	userLimit   int64 // 0 is no limit
+	userLeft    int64
+	charged     int64 // Entries charged so far
+}
+
+// charge takes entries from the headroom before they are added to the log file, or returns a *QuotaError if they don't fit.
+// The current entries of the file don't count when they are to be replaced, by a reprocessing.
+func (q *entriesQuota) charge(ctx context.Context, dbPool *pgxpool.Pool, logFileId uint, entries int64, replacesFile bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.loaded || q.exceeded(entries) != nil {
+		if err := q.load(ctx, dbPool, logFileId, replacesFile); err != nil {
+			return err
+		}
+	}
+	if err := q.exceeded(entries); err != nil {
+		return err
+	}
+	q.domainLeft -= entries
+	q.userLeft -= entries
+	q.charged += entries
+	return nil
+}
+
+// refund gives back the headroom of entries that were charged but couldn't be added
+func (q *entriesQuota) refund(entries int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.domainLeft += entries
+	q.userLeft += entries
+	q.charged -= entries
+}
+
+func (q *entriesQuota) exceeded(entries int64) error {
+	if q.domainLimit > 0 && entries > q.domainLeft {
+		return &QuotaError{Scope: "domain", Quota: QuotaMaxEntries, Limit: q.domainLimit}
+	}
+	if q.userLimit > 0 && entries > q.userLeft {
+		return &QuotaError{Scope: "user", Quota: QuotaMaxEntries, Limit: q.userLimit}
+	}
+	return nil
+}
+
+func (q *entriesQuota) load(ctx context.Context, dbPool *pgxpool.Pool, logFileId uint, replacesFile bool) error {
+	var domainUsage, userUsage, fileEntries int64
+	err := dbPool.QueryRow(ctx,
+		`SELECT COALESCE(d.quota_max_entries, 0),
+			(SELECT COALESCE(SUM(entries), 0) FROM log_files WHERE domain_id = d.id AND status <> $3),
+			COALESCE(u.quota_max_entries, $2),
+			(SELECT COALESCE(SUM(lf.entries), 0) FROM log_files lf JOIN domains ud ON ud.id = lf.domain_id WHERE ud.user_id = u.id AND lf.status <> $3),
+			f.entries
+		FROM log_files f
+		JOIN domains d ON d.id = f.domain_id
+		JOIN users u ON u.id = d.user_id
+		WHERE f.id = $1`,
+		logFileId, config.GetQuotaMaxEntries(), models.StatusDeleting,
+	).Scan(&q.domainLimit, &domainUsage, &q.userLimit, &userUsage, &fileEntries)
+	if err != nil {
+		return err
+	}
+
+	// Staged entries aren't counted by the file until they replace its current ones
+	if replacesFile {
+		domainUsage += q.charged - fileEntries
+		userUsage += q.charged - fileEntries
+	}
+	q.domainLeft = q.domainLimit - domainUsage
+	q.userLeft = q.userLimit - userUsage
+	q.loaded = true
+	return nil
+}
+
+// recountFileEntries sets the entries counter of the files matching the condition on log_files f, after entries were deleted in bulk
+func recountFileEntries(ctx context.Context, dbPool *pgxpool.Pool, condition string, args ...any) error {
+	_, err := dbPool.Exec(ctx,
+		`UPDATE log_files f SET entries = (SELECT COUNT(*) FROM `+LogEntriesTable+` e WHERE e.log_file_id = f.id)
+		WHERE f.entries > 0 AND `+condition,
+		args...,
+	)
+	return err
+}
@@ -0,0 +1,285 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iis-logs-parser/config"
+	"iis-logs-parser/models"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+// domainRetention holds the retention periods in days of a domain, the global defaults applied, 0 keeps the data forever
+type domainRetention struct {
+	domainId  uint
+	entries   int
+	files     int
+	summaries int
+}
+
+// ApplyRetention removes the data older than the retention periods of its domain, and records what was removed in retention_purges.
+// Whole log_entries partitions are dropped once they are past the retention of every domain,
+// everything else is deleted in batches of RETENTION_BATCH_SIZE rows.
+func ApplyRetention(ctx context.Context, dbPool *pgxpool.Pool) error {
+	retentions, err := loadRetentions(ctx, dbPool)
+	if err != nil {
+		return fmt.Errorf("failed to load retention periods: %w", err)
+	}
+
+	now := time.Now().UTC()
+	if err := dropExpiredPartitions(ctx, dbPool, retentions, now); err != nil {
+		return fmt.Errorf("failed to drop expired partitions: %w", err)
+	}
+
+	var errs []error
+	for _, r := range retentions {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := purgeDomain(ctx, dbPool, r, now); err != nil {
+			errs = append(errs, fmt.Errorf("domain %d: %w", r.domainId, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// loadRetentions includes deleted domains, their data is only kept until the end of their retention
+func loadRetentions(ctx context.Context, dbPool *pgxpool.Pool) ([]domainRetention, error) {
+	rows, err := dbPool.Query(ctx,
+		`SELECT id, COALESCE(entries_retention_days, $1), COALESCE(files_retention_days, $2), COALESCE(summaries_retention_days, $3)
+		FROM domains ORDER BY id`,
+		config.GetEntriesRetentionDays(), config.GetFilesRetentionDays(), config.GetSummariesRetentionDays(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var retentions []domainRetention
+	var r domainRetention
+	_, err = pgx.ForEachRow(rows, []any{&r.domainId, &r.entries, &r.files, &r.summaries}, func() error {
+		retentions = append(retentions, r)
+		return nil
+	})
+	return retentions, err
+}
+
+func retentionCutoff(now time.Time, days int) time.Time {
+	return now.AddDate(0, 0, -days)
+}
+
+func dropExpiredPartitions(ctx context.Context, dbPool *pgxpool.Pool, retentions []domainRetention, now time.Time) error {
+	if len(retentions) == 0 {
+		return nil
+	}
+	longest := 0
+	for _, r := range retentions {
+		if r.entries == 0 {
+			return nil
+		}
+		longest = max(longest, r.entries)
+	}
+	cutoff := retentionCutoff(now, longest)
+
+	partitions, err := listPartitions(ctx, dbPool)
+	if err != nil {
+		return err
+	}
+	for _, p := range partitions {
+		if p.end.After(cutoff) {
+			continue
+		}
+		if err := dropPartition(ctx, dbPool, p, cutoff); err != nil {
+			return fmt.Errorf("partition %s: %w", p.name, err)
+		}
+	}
+	return nil
+}
+
+func dropPartition(ctx context.Context, dbPool *pgxpool.Pool, p partition, cutoff time.Time) error {
+	count, _, err := dropPartitionUnless(ctx, dbPool, p, nil)
+	if err != nil {
+		return err
+	}
+	if err := recountFileEntries(ctx, dbPool, "(f.start_timestamp IS NULL OR f.start_timestamp < $1)", p.end); err != nil {
+		return fmt.Errorf("failed to count entries: %w", err)
+	}
+	recordPurge(ctx, dbPool, models.RetentionPurge{Target: models.RetentionEntries, Partition: p.name, Cutoff: cutoff, Rows: count})
+	return nil
+}
+
+func purgeDomain(ctx context.Context, dbPool *pgxpool.Pool, r domainRetention, now time.Time) error {
+	var errs []error
+	if r.entries > 0 {
+		cutoff := retentionCutoff(now, r.entries)
+		deleted, err := deleteInBatches(ctx, dbPool,
+			`DELETE FROM `+LogEntriesTable+` WHERE (id, timestamp) IN (
+				SELECT e.id, e.timestamp FROM `+LogEntriesTable+` e
+				JOIN log_files f ON f.id = e.log_file_id
+				WHERE f.domain_id = $1 AND e.timestamp < $2
+				LIMIT $3
+			)`,
+			r.domainId, cutoff,
+		)
+		if deleted > 0 {
+			recordPurge(ctx, dbPool, models.RetentionPurge{Target: models.RetentionEntries, DomainID: &r.domainId, Cutoff: cutoff, Rows: deleted})
+			countErr := recountFileEntries(ctx, dbPool, "f.domain_id = $1 AND (f.start_timestamp IS NULL OR f.start_timestamp < $2)", r.domainId, cutoff)
+			if countErr != nil {
+				errs = append(errs, fmt.Errorf("failed to count entries: %w", countErr))
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to purge entries: %w", err))
+		}
+	}
+
+	if r.files > 0 {
+		cutoff := retentionCutoff(now, r.files)
+		removed, bytes, err := purgeUploadedFiles(ctx, dbPool, r.domainId, cutoff)
+		if removed > 0 {
+			recordPurge(ctx, dbPool, models.RetentionPurge{Target: models.RetentionFiles, DomainID: &r.domainId, Cutoff: cutoff, Rows: removed, Bytes: bytes})
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to purge uploaded files: %w", err))
+		}
+	}
+
+	if r.summaries > 0 {
+		cutoff := retentionCutoff(now, r.summaries)
+		deleted, err := deleteInBatches(ctx, dbPool,
+			`DELETE FROM log_file_stats WHERE log_file_id IN (
+				SELECT s.log_file_id FROM log_file_stats s
+				JOIN log_files f ON f.id = s.log_file_id
+				WHERE f.domain_id = $1 AND COALESCE(f.end_timestamp, f.created_at AT TIME ZONE 'UTC') < $2
+				LIMIT $3
+			)`,
+			r.domainId, cutoff,
+		)
+		if err == nil {
+			var rollups int64
+			rollups, err = deleteInBatches(ctx, dbPool,
+				`DELETE FROM `+LogRollupsTable+` WHERE (log_file_id, granularity, bucket) IN (
+					SELECT log_file_id, granularity, bucket FROM `+LogRollupsTable+`
+					WHERE domain_id = $1 AND bucket < $2
+					LIMIT $3
+				)`,
+				r.domainId, cutoff,
+			)
+			deleted += rollups
+		}
+		if deleted > 0 {
+			recordPurge(ctx, dbPool, models.RetentionPurge{Target: models.RetentionSummaries, DomainID: &r.domainId, Cutoff: cutoff, Rows: deleted})
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to purge summaries: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deleteInBatches runs the delete statement until it deletes less than a batch, the batch size is passed as its last argument.
+// Returns the number of deleted rows, including those of the batches done before an error.
+func deleteInBatches(ctx context.Context, dbPool *pgxpool.Pool, sql string, args ...any) (int64, error) {
+	args = append(args, config.RETENTION_BATCH_SIZE)
+	var total int64
+	for {
+		tag, err := dbPool.Exec(ctx, sql, args...)
+		if err != nil {
+			return total, err
+		}
+		total += tag.RowsAffected()
+		if tag.RowsAffected() < config.RETENTION_BATCH_SIZE {
+			return total, nil
+		}
+	}
+}
+
+// purgeUploadedFiles removes the stored copies of the finished files uploaded before cutoff, their entries are kept.
+// Returns the number of removed files and their size.
+func purgeUploadedFiles(ctx context.Context, dbPool *pgxpool.Pool, domainId uint, cutoff time.Time) (int64, int64, error) {
+	var removed, bytes int64
+	for {
+		rows, err := dbPool.Query(ctx,
+			`SELECT id, name FROM log_files
+			WHERE domain_id = $1 AND created_at < $2 AND file_purged_at IS NULL AND status IN ($3, $4)
+			ORDER BY id LIMIT $5`,
+			domainId, cutoff, models.StatusCompleted, models.StatusFailed, config.RETENTION_BATCH_SIZE,
+		)
+		if err != nil {
+			return removed, bytes, err
+		}
+		var ids []uint
+		var logFile models.LogFile
+		_, err = pgx.ForEachRow(rows, []any{&logFile.ID, &logFile.Name}, func() error {
+			ids = append(ids, logFile.ID)
+			// Follow mode files have no stored copy, they are only marked as purged
+			found, size, err := removeStoredFiles(logFile)
+			if found {
+				removed++
+			}
+			bytes += size
+			return err
+		})
+		if err != nil {
+			return removed, bytes, err
+		}
+		if len(ids) == 0 {
+			return removed, bytes, nil
+		}
+
+		if _, err := dbPool.Exec(ctx, "UPDATE log_files SET file_purged_at = now(), stored_bytes = 0 WHERE id = ANY($1)", ids); err != nil {
+			return removed, bytes, err
+		}
+		if len(ids) < config.RETENTION_BATCH_SIZE {
+			return removed, bytes, nil
+		}
+	}
+}
+
+// removeStoredFiles removes the stored copy of an uploaded file and its parsed logs, if they exist.
+// Returns whether the stored copy existed and the size of the removed files.
+func removeStoredFiles(logFile models.LogFile) (bool, int64, error) {
+	found := false
+	var bytes int64
+	for _, path := range []string{logFile.StoragePath(), logFile.StoragePath() + "_" + "parsed_logs.txt"} {
+		info, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return found, bytes, err
+		}
+		if err := os.Remove(path); err != nil {
+			return found, bytes, err
+		}
+		if path == logFile.StoragePath() {
+			found = true
+		}
+		bytes += info.Size()
+	}
+	return found, bytes, nil
+}
+
+// recordPurge logs the purge and keeps it in retention_purges, a failure to record it doesn't undo the purge
+func recordPurge(ctx context.Context, dbPool *pgxpool.Pool, purge models.RetentionPurge) {
+	event := log.Info().Str("target", string(purge.Target)).Time("cutoff", purge.Cutoff).Int64("rows", purge.Rows).Int64("bytes", purge.Bytes)
+	if purge.DomainID != nil {
+		event = event.Uint("domainId", *purge.DomainID)
+	}
+	if purge.Partition != "" {
+		event = event.Str("partition", purge.Partition)
+	}
+	event.Msg("Retention: purged expired data")
+
+	_, err := dbPool.Exec(context.WithoutCancel(ctx),
+		`INSERT INTO retention_purges (target, domain_id, partition, cutoff, rows, bytes, purged_at) VALUES ($1, $2, $3, $4, $5, $6, now())`,
+		purge.Target, purge.DomainID, purge.Partition, purge.Cutoff, purge.Rows, purge.Bytes,
+	)
+	if err != nil {
+		log.Err(err).Str("target", string(purge.Target)).Msg("Retention: failed to record purge")
+	}
+}
@@ -0,0 +1,87 @@
+package processor
+
+import (
+	"context"
+	"iis-logs-parser/models"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	LogRollupsTable        = "log_rollups"
+	LogRollupsStagingTable = "log_rollups_staging"
+)
+
+// rollupsTable returns where the rollups of the entries inserted in entriesTable go,
+// staged entries have staged rollups swapped along with them
+func rollupsTable(entriesTable string) string {
+	if entriesTable == LogEntriesStagingTable {
+		return LogRollupsStagingTable
+	}
+	return LogRollupsTable
+}
+
+const logRollupColumns = "log_file_id, granularity, bucket, domain_id, requests, status1xx, status2xx, status3xx, status4xx, status5xx, " +
+	"log_bytes, timed_requests, time_taken_sum, time_taken_min, time_taken_max, latency_histogram"
+
+type rollupKey struct {
+	logFileId   uint
+	granularity models.RollupGranularity
+	bucket      time.Time
+}
+
+// rollupBatch aggregates the entries of a batch at every granularity
+func rollupBatch(batch []*models.LogEntry) map[rollupKey]*models.LogRollup {
+	rollups := map[rollupKey]*models.LogRollup{}
+	for _, entry := range batch {
+		for granularity, size := range models.RollupGranularities {
+			key := rollupKey{entry.LogFileID, granularity, entry.Timestamp.Truncate(size)}
+			rollup, ok := rollups[key]
+			if !ok {
+				rollup = &models.LogRollup{LogFileID: key.logFileId, Granularity: granularity, Bucket: key.bucket}
+				rollups[key] = rollup
+			}
+			rollup.Add(entry)
+		}
+	}
+	return rollups
+}
+
+// upsertRollups adds the rollups of the batch to the existing ones, in the transaction inserting its entries
+func upsertRollups(ctx context.Context, tx pgx.Tx, table string, batch []*models.LogEntry) error {
+	sql := `INSERT INTO ` + table + ` AS r (` + logRollupColumns + `)
+		SELECT f.id, $2::varchar, $3::timestamp, f.domain_id, $4::bigint, $5::bigint, $6::bigint, $7::bigint, $8::bigint, $9::bigint,
+			$10::bigint, $11::bigint, $12::bigint, $13::bigint, $14::bigint, $15::bigint[]
+		FROM log_files f WHERE f.id = $1
+		ON CONFLICT (log_file_id, granularity, bucket) DO UPDATE SET
+			requests = r.requests + EXCLUDED.requests,
+			status1xx = r.status1xx + EXCLUDED.status1xx,
+			status2xx = r.status2xx + EXCLUDED.status2xx,
+			status3xx = r.status3xx + EXCLUDED.status3xx,
+			status4xx = r.status4xx + EXCLUDED.status4xx,
+			status5xx = r.status5xx + EXCLUDED.status5xx,
+			log_bytes = r.log_bytes + EXCLUDED.log_bytes,
+			timed_requests = r.timed_requests + EXCLUDED.timed_requests,
+			time_taken_sum = r.time_taken_sum + EXCLUDED.time_taken_sum,
+			time_taken_min = LEAST(r.time_taken_min, EXCLUDED.time_taken_min),
+			time_taken_max = GREATEST(r.time_taken_max, EXCLUDED.time_taken_max),
+			latency_histogram = ARRAY(
+				SELECT COALESCE(a, 0) + COALESCE(b, 0)
+				FROM unnest(r.latency_histogram, EXCLUDED.latency_histogram) WITH ORDINALITY AS h(a, b, i)
+				ORDER BY i
+			)`
+
+	var queries pgx.Batch
+	for _, r := range rollupBatch(batch) {
+		histogram := []int64(r.LatencyHistogram)
+		if histogram == nil {
+			histogram = []int64{}
+		}
+		queries.Queue(sql,
+			r.LogFileID, r.Granularity, r.Bucket, r.Requests, r.Status1xx, r.Status2xx, r.Status3xx, r.Status4xx, r.Status5xx,
+			r.LogBytes, r.TimedRequests, r.TimeTakenSum, r.TimeTakenMin, r.TimeTakenMax, histogram,
+		)
+	}
+	return tx.SendBatch(ctx, &queries).Close()
+}
@@ -0,0 +1,98 @@
+package processor
+
+import (
+	"context"
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const lineHashShards = 64
+
+// lineHashSet detects duplicate lines by remembering a 64 bits hash of up to limit distinct lines, a few tens of bytes per line.
+// Once it's full, only the duplicates of the remembered lines are detected.
+// It's sharded so the parsing goroutines rarely wait for each other.
+type lineHashSet struct {
+	seed    maphash.Seed
+	limit   int64
+	size    atomic.Int64
+	dropped atomic.Bool // a line wasn't recorded since the set was full
+	shards  [lineHashShards]struct {
+		mu     sync.Mutex
+		hashes map[uint64]struct{}
+	}
+}
+
+// newLineHashSet returns nil when limit is 0, duplicate lines are then not detected
+func newLineHashSet(limit int) *lineHashSet {
+	if limit == 0 {
+		return nil
+	}
+	s := &lineHashSet{seed: maphash.MakeSeed(), limit: int64(limit)}
+	for i := range s.shards {
+		s.shards[i].hashes = map[uint64]struct{}{}
+	}
+	return s
+}
+
+// add records the line if the set isn't full, and reports whether it's a duplicate of a recorded line
+func (s *lineHashSet) add(line string) bool {
+	hash := maphash.String(s.seed, line)
+	shard := &s.shards[hash%lineHashShards]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if _, ok := shard.hashes[hash]; ok {
+		return true
+	}
+	if s.size.Load() < s.limit {
+		shard.hashes[hash] = struct{}{}
+		s.size.Add(1)
+	} else {
+		s.dropped.Store(true)
+	}
+	return false
+}
+
+// isExact reports whether every duplicate line was detected, which a nil set never does
+func (s *lineHashSet) isExact() bool {
+	return s != nil && !s.dropped.Load()
+}
+
+// SaveFileStats records the metrics of the last processing attempt of the log file, replacing the previous ones
+func SaveFileStats(ctx context.Context, dbPool *pgxpool.Pool, logFileId uint, metrics *Metrics) error {
+	linesPerSecond, bytesPerSecond := 0.0, 0.0
+	if seconds := metrics.Duration.Seconds(); seconds > 0 {
+		linesPerSecond = float64(metrics.LinesRead) / seconds
+		bytesPerSecond = float64(metrics.BytesRead) / seconds
+	}
+
+	_, err := dbPool.Exec(ctx,
+		`INSERT INTO log_file_stats (log_file_id, lines_read, entries_inserted, rejected_lines, duplicate_lines, duplicate_lines_approximate, failed_writes, batch_count,
+			bytes_read, lines_per_second, bytes_per_second, duration_ms, parsing_time_ms, insertion_time_ms, summary, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, now())
+		ON CONFLICT (log_file_id) DO UPDATE SET
+			lines_read = EXCLUDED.lines_read, entries_inserted = EXCLUDED.entries_inserted, rejected_lines = EXCLUDED.rejected_lines,
+			duplicate_lines = EXCLUDED.duplicate_lines, duplicate_lines_approximate = EXCLUDED.duplicate_lines_approximate, failed_writes = EXCLUDED.failed_writes, batch_count = EXCLUDED.batch_count,
+			bytes_read = EXCLUDED.bytes_read, lines_per_second = EXCLUDED.lines_per_second, bytes_per_second = EXCLUDED.bytes_per_second,
+			duration_ms = EXCLUDED.duration_ms, parsing_time_ms = EXCLUDED.parsing_time_ms, insertion_time_ms = EXCLUDED.insertion_time_ms,
+			summary = EXCLUDED.summary, updated_at = EXCLUDED.updated_at`,
+		logFileId,
+		metrics.LinesRead,
+		atomic.LoadInt64(&metrics.SuccessfulWrites),
+		atomic.LoadInt64(&metrics.RejectedLines),
+		atomic.LoadInt64(&metrics.DuplicateLines),
+		metrics.DuplicateLinesApproximate,
+		atomic.LoadInt64(&metrics.FailedWrites),
+		atomic.LoadInt64(&metrics.BatchCount),
+		metrics.BytesRead,
+		linesPerSecond,
+		bytesPerSecond,
+		metrics.Duration.Milliseconds(),
+		metrics.TotalParsingTime.Milliseconds(),
+		metrics.TotalInsertionTime.Milliseconds(),
+		metrics.Summary(),
+	)
+	return err
+}
@@ -0,0 +1,207 @@
+package processor
+
+import (
+	"cmp"
+	"fmt"
+	"iis-logs-parser/models"
+	tableStr "iis-logs-parser/table_string"
+	"iis-logs-parser/utils"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	summaryTopSize = 10
+	// Distinct stems and IPs counted exactly per combiner, beyond that the rarest ones are dropped,
+	// so the top values stay right but their counts may be slightly low for files with a huge number of distinct values
+	topCounterCapacity = 10000
+)
+
+// summaryCollector aggregates the entries seen by a single combiner, so it needs no locking
+type summaryCollector struct {
+	entries       int64
+	statusCodes   map[string]int64
+	methods       map[string]int64
+	uriStems      *topCounter
+	clientIPs     *topCounter
+	clientErrors  int64
+	serverErrors  int64
+	timeTakenMin  int64
+	timeTakenMax  int64
+	timeTakenSum  int64
+	timeTakenSeen int64
+}
+
+func newSummaryCollector() *summaryCollector {
+	return &summaryCollector{
+		statusCodes: map[string]int64{},
+		methods:     map[string]int64{},
+		uriStems:    newTopCounter(topCounterCapacity),
+		clientIPs:   newTopCounter(topCounterCapacity),
+	}
+}
+
+func (c *summaryCollector) add(entry *models.LogEntry) {
+	c.entries++
+	c.statusCodes[entry.Status]++
+	c.methods[entry.Method]++
+	c.uriStems.add(entry.URIStem, 1)
+	c.clientIPs.add(entry.ClientIP, 1)
+
+	if strings.HasPrefix(entry.Status, "4") {
+		c.clientErrors++
+	} else if strings.HasPrefix(entry.Status, "5") {
+		c.serverErrors++
+	}
+
+	if timeTaken, err := strconv.ParseInt(entry.TimeTaken, 10, 64); err == nil {
+		if c.timeTakenSeen == 0 || timeTaken < c.timeTakenMin {
+			c.timeTakenMin = timeTaken
+		}
+		if c.timeTakenSeen == 0 || timeTaken > c.timeTakenMax {
+			c.timeTakenMax = timeTaken
+		}
+		c.timeTakenSum += timeTaken
+		c.timeTakenSeen++
+	}
+}
+
+func (c *summaryCollector) merge(other *summaryCollector) {
+	c.entries += other.entries
+	for k, v := range other.statusCodes {
+		c.statusCodes[k] += v
+	}
+	for k, v := range other.methods {
+		c.methods[k] += v
+	}
+	for k, v := range other.uriStems.counts {
+		c.uriStems.add(k, v)
+	}
+	for k, v := range other.clientIPs.counts {
+		c.clientIPs.add(k, v)
+	}
+	c.clientErrors += other.clientErrors
+	c.serverErrors += other.serverErrors
+	if other.timeTakenSeen > 0 {
+		if c.timeTakenSeen == 0 || other.timeTakenMin < c.timeTakenMin {
+			c.timeTakenMin = other.timeTakenMin
+		}
+		if c.timeTakenSeen == 0 || other.timeTakenMax > c.timeTakenMax {
+			c.timeTakenMax = other.timeTakenMax
+		}
+		c.timeTakenSum += other.timeTakenSum
+		c.timeTakenSeen += other.timeTakenSeen
+	}
+}
+
+func (c *summaryCollector) summary() *models.LogFileSummary {
+	s := &models.LogFileSummary{
+		Entries:      c.entries,
+		StatusCodes:  c.statusCodes,
+		Methods:      c.methods,
+		TopURIStems:  c.uriStems.top(summaryTopSize),
+		TopClientIPs: c.clientIPs.top(summaryTopSize),
+		ClientErrors: c.clientErrors,
+		ServerErrors: c.serverErrors,
+		TimeTakenMin: c.timeTakenMin,
+		TimeTakenMax: c.timeTakenMax,
+	}
+	if c.entries > 0 {
+		s.ErrorRate = float64(c.clientErrors+c.serverErrors) / float64(c.entries)
+	}
+	if c.timeTakenSeen > 0 {
+		s.TimeTakenAvg = float64(c.timeTakenSum) / float64(c.timeTakenSeen)
+	}
+	return s
+}
+
+// topCounter counts values, keeping at most capacity of them by dropping the least frequent half when full
+type topCounter struct {
+	capacity int
+	counts   map[string]int64
+}
+
+func newTopCounter(capacity int) *topCounter {
+	return &topCounter{capacity: capacity, counts: map[string]int64{}}
+}
+
+func (t *topCounter) add(value string, count int64) {
+	if _, ok := t.counts[value]; !ok && len(t.counts) >= t.capacity {
+		t.prune()
+	}
+	t.counts[value] += count
+}
+
+func (t *topCounter) prune() {
+	for _, vc := range t.sorted()[t.capacity/2:] {
+		delete(t.counts, vc.Value)
+	}
+}
+
+func (t *topCounter) top(n int) []models.ValueCount {
+	sorted := t.sorted()
+	return sorted[:min(n, len(sorted))]
+}
+
+func (t *topCounter) sorted() []models.ValueCount {
+	values := make([]models.ValueCount, 0, len(t.counts))
+	for value, count := range t.counts {
+		values = append(values, models.ValueCount{Value: value, Count: count})
+	}
+	slices.SortFunc(values, func(a, b models.ValueCount) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Value, b.Value))
+	})
+	return values
+}
+
+// RenderSummary renders the summary as plain text tables
+func RenderSummary(s *models.LogFileSummary) (string, error) {
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "Entries: %d\n", s.Entries)
+	fmt.Fprintf(&sb, "Error rate: %.2f%% (4xx: %d, 5xx: %d)\n", s.ErrorRate*100, s.ClientErrors, s.ServerErrors)
+	fmt.Fprintf(&sb, "Time taken (ms): min %d, avg %.1f, max %d\n", s.TimeTakenMin, s.TimeTakenAvg, s.TimeTakenMax)
+	if s.Entries == 0 {
+		return sb.String(), nil
+	}
+
+	statusCodes, err := utils.MapToTableLogMsg(&s.StatusCodes)
+	if err != nil {
+		return "", err
+	}
+	sb.WriteString(statusCodes)
+
+	methods := make([]models.ValueCount, 0, len(s.Methods))
+	for _, method := range slices.Sorted(maps.Keys(s.Methods)) {
+		methods = append(methods, models.ValueCount{Value: method, Count: s.Methods[method]})
+	}
+
+	for _, table := range []struct {
+		header string
+		rows   []models.ValueCount
+	}{
+		{"Method", methods},
+		{"URI Stem", s.TopURIStems},
+		{"Client IP", s.TopClientIPs},
+	} {
+		rendered, err := renderValueCounts(table.header, table.rows)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(rendered)
+	}
+	return sb.String(), nil
+}
+
+func renderValueCounts(header string, valueCounts []models.ValueCount) (string, error) {
+	rows := make([][]string, 0, len(valueCounts))
+	for _, vc := range valueCounts {
+		rows = append(rows, []string{vc.Value, strconv.FormatInt(vc.Count, 10)})
+	}
+
+	t := tableStr.New()
+	t.SetHeaders([]string{header, "Number of Occurrences"})
+	t.SetRows(rows)
+	return t.String()
+}
@@ -0,0 +1,65 @@
+package processor
+
+import (
+	"context"
+	"iis-logs-parser/models"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	WorkerHeartbeatInterval = 30 * time.Second
+	// Stopped or dead workers are forgotten after this long without a heartbeat
+	workerRetention = 7 * 24 * time.Hour
+)
+
+// ReportWorker records this process in the workers table, then refreshes its heartbeat
+// and the queue occupation until ctx is cancelled
+func ReportWorker(ctx context.Context, dbPool *pgxpool.Pool, mode string, queue *Queue) {
+	hostname, _ := os.Hostname()
+	_, err := dbPool.Exec(ctx,
+		`INSERT INTO workers (id, hostname, pid, mode, status, active_files, max_concurrent_files, started_at, heartbeat_at)
+		VALUES ($1, $2, $3, $4, $5, 0, $6, now(), now())`,
+		WorkerID, hostname, os.Getpid(), mode, models.WorkerStatusRunning, cap(queue.slots),
+	)
+	if err != nil {
+		log.Err(err).Str("workerId", WorkerID).Msg("Worker: failed to register worker")
+	}
+
+	ticker := time.NewTicker(WorkerHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		_, err := dbPool.Exec(ctx,
+			"UPDATE workers SET active_files = $1, heartbeat_at = now() WHERE id = $2",
+			queue.ActiveFiles(), WorkerID,
+		)
+		if err != nil {
+			log.Err(err).Str("workerId", WorkerID).Msg("Worker: failed to send heartbeat")
+			continue
+		}
+
+		if _, err := dbPool.Exec(ctx, "DELETE FROM workers WHERE heartbeat_at < now() - $1::interval", workerRetention); err != nil {
+			log.Err(err).Msg("Worker: failed to forget old workers")
+		}
+	}
+}
+
+// SetWorkerStatus updates the status of this process in the workers table
+func SetWorkerStatus(ctx context.Context, dbPool *pgxpool.Pool, status models.WorkerStatus) {
+	_, err := dbPool.Exec(ctx,
+		"UPDATE workers SET status = $1, heartbeat_at = now() WHERE id = $2",
+		status, WorkerID,
+	)
+	if err != nil {
+		log.Err(err).Str("workerId", WorkerID).Str("status", string(status)).Msg("Worker: failed to update worker status")
+	}
+}
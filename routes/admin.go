@@ -0,0 +1,125 @@
+package routes
+
+import (
+	"errors"
+	db "iis-logs-parser/database"
+	"iis-logs-parser/models"
+	"iis-logs-parser/processor"
+	"iis-logs-parser/scheduler"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	jobRunsHistoryLimit      = 50
+	retentionPurgesListLimit = 100
+)
+
+func handleGetJobs(ctx *gin.Context) {
+	jobs, err := scheduler.Default.Status(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to get jobs status")
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Something went wrong",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"jobs": jobs,
+	})
+}
+
+func handleGetJobRuns(ctx *gin.Context) {
+	var runs []models.JobRun
+	res := db.GormDB.
+		Where("name = ?", ctx.Param("name")).
+		Order("started_at DESC").
+		Limit(jobRunsHistoryLimit).
+		Find(&runs)
+	if res.Error != nil {
+		log.Err(res.Error).Msg("Failed to get job runs")
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Something went wrong",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"runs": runs,
+	})
+}
+
+func handleRunJob(ctx *gin.Context) {
+	name := ctx.Param("name")
+	runId, err := scheduler.Default.Trigger(name)
+	if err != nil {
+		switch {
+		case errors.Is(err, scheduler.ErrUnknownJob):
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error": "Job not found",
+			})
+		case errors.Is(err, scheduler.ErrJobRunning):
+			ctx.JSON(http.StatusConflict, gin.H{
+				"error": "Job is already running",
+			})
+		default:
+			log.Err(err).Str("job", name).Msg("Failed to trigger job")
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Couldn't start the job",
+			})
+		}
+		return
+	}
+
+	log.Info().Str("job", name).Uint("runId", runId).Uint("userId", ctx.GetUint("userId")).Msg("Job triggered manually")
+	ctx.JSON(http.StatusAccepted, gin.H{
+		"message": "Job started",
+		"runId":   runId,
+	})
+}
+
+func handleGetWorkers(ctx *gin.Context) {
+	var workers []models.Worker
+	if err := db.GormDB.Order("started_at DESC").Find(&workers).Error; err != nil {
+		log.Err(err).Msg("Failed to get workers")
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Something went wrong",
+		})
+		return
+	}
+
+	// A few missed heartbeats are tolerated before considering a worker dead
+	cutoff := time.Now().Add(-3 * processor.WorkerHeartbeatInterval)
+	for i := range workers {
+		workers[i].Online = workers[i].Status != models.WorkerStatusStopped && workers[i].HeartbeatAt.After(cutoff)
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"workers": workers,
+	})
+}
+
+// handleGetRetentionPurges lists the last purges of the retention job, optionally of a single domain
+func handleGetRetentionPurges(ctx *gin.Context) {
+	query := db.GormDB.Order("purged_at DESC, id DESC").Limit(retentionPurgesListLimit)
+	if domainId := ctx.Query("domainId"); domainId != "" {
+		query = query.Where("domain_id = ?", domainId)
+	}
+
+	var purges []models.RetentionPurge
+	if err := query.Find(&purges).Error; err != nil {
+		log.Err(err).Msg("Failed to get retention purges")
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Something went wrong",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"purges": purges,
+	})
+}
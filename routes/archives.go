@@ -0,0 +1,109 @@
+package routes
+
+import (
+	db "iis-logs-parser/database"
+	"iis-logs-parser/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Restores returned at most along with the archives of a domain, the most recent first
+const archiveRestoresListLimit = 50
+
+type archiveRestoreRequest struct {
+	From time.Time `json:"from" binding:"required"` // RFC 3339
+	To   time.Time `json:"to" binding:"required"`
+}
+
+// handleGetDomainArchives returns the archives of a domain by day, and its recent restores
+func handleGetDomainArchives(ctx *gin.Context) {
+	userId := ctx.GetUint("userId")
+	domainId, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid domain ID",
+		})
+		return
+	}
+	if !checkDomainOwnership(ctx, userId, domainId) {
+		return
+	}
+
+	var archives []models.EntryArchive
+	if res := db.GormDB.Where("domain_id = ?", domainId).Order("day, id").Find(&archives); res.Error != nil {
+		log.Err(res.Error).Int64("domainId", domainId).Msg("Failed to get archives")
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Something went wrong",
+		})
+		return
+	}
+	var restores []models.ArchiveRestore
+	res := db.GormDB.Where("domain_id = ?", domainId).Order("id DESC").Limit(archiveRestoresListLimit).Find(&restores)
+	if res.Error != nil {
+		log.Err(res.Error).Int64("domainId", domainId).Msg("Failed to get archive restores")
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Something went wrong",
+		})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"archives": archives,
+		"restores": restores,
+	})
+}
+
+// handleRestoreDomainArchives queues the restore of the archived entries between from and to,
+// the restore-archives job reloads the whole days overlapping the range
+func handleRestoreDomainArchives(ctx *gin.Context) {
+	userId := ctx.GetUint("userId")
+	domainId, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid domain ID",
+		})
+		return
+	}
+
+	var request archiveRestoreRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request, from and to must be RFC 3339 dates",
+		})
+		return
+	}
+	if !request.From.Before(request.To) {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid range, from must be before to",
+		})
+		return
+	}
+
+	if !checkDomainOwnership(ctx, userId, domainId) {
+		return
+	}
+
+	restore := models.ArchiveRestore{
+		DomainID:   uint(domainId),
+		RangeStart: request.From.UTC(),
+		RangeEnd:   request.To.UTC(),
+		Status:     models.RestorePending,
+	}
+	if res := db.GormDB.Create(&restore); res.Error != nil {
+		log.Err(res.Error).Int64("domainId", domainId).Msg("Failed to create archive restore")
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Something went wrong",
+		})
+		return
+	}
+
+	log.Info().Uint("restoreId", restore.ID).Int64("domainId", domainId).Uint("userId", userId).Msg("Archive restore requested")
+	ctx.JSON(http.StatusAccepted, gin.H{
+		"message": "Restore queued",
+		"restore": restore,
+	})
+}
@@ -2,10 +2,13 @@ package routes
 
 import (
 	"errors"
+	"iis-logs-parser/config"
 	db "iis-logs-parser/database"
 	"iis-logs-parser/models"
+	"iis-logs-parser/processor"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
@@ -25,6 +28,8 @@ func handleCreateDomain(ctx *gin.Context) {
 	// Add defaults
 	newDomain.IsActive = true
 	newDomain.UserID = ctx.GetUint("userId")
+	// Only admins can follow local files, see handleUpdateDomainFollowPath
+	newDomain.FollowPath = ""
 
 	if err := newDomain.Validate(); err != nil {
 		log.Error().Err(err).Msg("error binding json")
@@ -149,11 +154,83 @@ func handleDeleteDomain(ctx *gin.Context) {
 		return
 	}
 
-	// In spite of having a constraint set, .Select must be called here to cascade deleting, very weird behavior
-	if result := db.GormDB.Select("LogFiles").Delete(&existingDomain); result.Error != nil {
+	// Its log files, including the ones already deleted, are removed by the purge-deleted-files job, then the domain
+	err = db.GormDB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("domain_id = ?", existingDomain.ID).Delete(&models.LogRollup{}).Error; err != nil {
+			return err
+		}
+		err := tx.Unscoped().Model(&models.LogFile{}).Where("domain_id = ?", existingDomain.ID).Updates(map[string]any{
+			"status":      models.StatusDeleting,
+			"lease_owner": nil,
+			"deleted_at":  gorm.Expr("COALESCE(deleted_at, now())"),
+		}).Error
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		return tx.Model(&existingDomain).Updates(map[string]any{"deleting_at": now, "deleted_at": now}).Error
+	})
+	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete domain"})
 		return
 	}
 
-	ctx.JSON(http.StatusOK, gin.H{"message": "Domain deleted successfully"})
+	ctx.JSON(http.StatusAccepted, gin.H{"message": "Domain is being deleted"})
+}
+
+// handleUpdateDomainFollowPath sets the local log file or directory followed for a domain, an empty path stops following.
+// Any domain could be made to ingest the files of another one, so only admins can set it.
+func handleUpdateDomainFollowPath(ctx *gin.Context) {
+	domainId, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid domain ID",
+		})
+		return
+	}
+
+	var request struct {
+		FollowPath string `json:"followPath"`
+	}
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if request.FollowPath != "" {
+		rootDir := config.GetFollowRootDir()
+		if rootDir == "" {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error": "Follow mode is disabled, FOLLOW_ROOT_DIR isn't set",
+			})
+			return
+		}
+		if _, err := processor.ResolveFollowPath(rootDir, request.FollowPath); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+
+	res := db.GormDB.Model(&models.Domain{}).Where("id = ? AND deleting_at IS NULL", domainId).Update("follow_path", request.FollowPath)
+	if res.Error != nil {
+		log.Err(res.Error).Uint64("domainId", domainId).Msg("Failed to update domain follow path")
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Something went wrong",
+		})
+		return
+	}
+	if res.RowsAffected == 0 {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"error": "Domain not found",
+		})
+		return
+	}
+
+	log.Info().Uint64("domainId", domainId).Str("followPath", request.FollowPath).Uint("adminId", ctx.GetUint("userId")).Msg("Domain follow path updated")
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "Follow path updated",
+	})
 }
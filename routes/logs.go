@@ -1,16 +1,22 @@
 package routes
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"iis-logs-parser/config"
 	db "iis-logs-parser/database"
 	"iis-logs-parser/models"
+	"iis-logs-parser/processor"
 	"io"
+	"io/fs"
+	"maps"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
@@ -48,14 +54,16 @@ func saveFile(file *multipart.FileHeader, path string) error {
 	return nil
 }
 
-func processFile(tx *gorm.DB, file *multipart.FileHeader, domainId int64) (UploadResponse, error) {
+func processFile(tx *gorm.DB, file *multipart.FileHeader, domainId int64, priority int) (UploadResponse, error) {
 	filename := filepath.Base(file.Filename)
 
 	logFileEntry := models.LogFile{
-		Name:     filename,
-		Size:     uint(file.Size),
-		Status:   models.StatusPending,
-		DomainID: uint(domainId),
+		Name:        filename,
+		Size:        uint(file.Size),
+		StoredBytes: file.Size,
+		Status:      models.StatusPending,
+		DomainID:    uint(domainId),
+		Priority:    priority,
 	}
 
 	if err := tx.Create(&logFileEntry).Error; err != nil {
@@ -66,8 +74,7 @@ func processFile(tx *gorm.DB, file *multipart.FileHeader, domainId int64) (Uploa
 		}, err
 	}
 
-	savedFileName := filepath.Join("uploaded_logs", filename+"-"+strconv.FormatUint(uint64(logFileEntry.ID), 10))
-	if err := saveFile(file, savedFileName); err != nil {
+	if err := saveFile(file, logFileEntry.StoragePath()); err != nil {
 		return UploadResponse{
 			Success: false,
 			Message: "Failed to save file",
@@ -82,6 +89,28 @@ func processFile(tx *gorm.DB, file *multipart.FileHeader, domainId int64) (Uploa
 	}, nil
 }
 
+// checkDomainOwnership responds with an error and returns false if the domain doesn't belong to the user
+func checkDomainOwnership(ctx *gin.Context, userId uint, domainId int64) bool {
+	log.Info().Uint("userId", userId).Int64("userEnteredDomainId", domainId).Msg("Checking user domain ownership")
+	res := db.GormDB.First(&models.Domain{}, "id = ? AND user_id = ?", domainId, userId)
+	if res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			log.Err(res.Error).Msg("Domain not found for user")
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error": "Domain not found",
+			})
+			return false
+		}
+		log.Err(res.Error).Msg("Error finding domain")
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Error finding domain",
+		})
+		return false
+	}
+	log.Info().Uint("userId", userId).Int64("userEnteredDomainId", domainId).Msg("Domain found")
+	return true
+}
+
 func handleUploadLogFiles(ctx *gin.Context) {
 	userId := ctx.GetUint("userId")
 	domainStr := ctx.PostForm("domain")
@@ -95,23 +124,20 @@ func handleUploadLogFiles(ctx *gin.Context) {
 		})
 		return
 	}
-	log.Info().Uint("userId", userId).Int64("userEnteredDomainId", domainId).Msg("Checking user domain ownership")
-	res := db.GormDB.First(&models.Domain{}, "id = ? AND user_id = ?", domainId, userId)
-	if res.Error != nil {
-		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
-			log.Err(res.Error).Msg("Domain not found for user")
-			ctx.JSON(http.StatusNotFound, gin.H{
-				"error": "Domain not found",
+	if !checkDomainOwnership(ctx, userId, domainId) {
+		return
+	}
+
+	priority := 0
+	if priorityStr := ctx.PostForm("priority"); priorityStr != "" {
+		priority, err = strconv.Atoi(priorityStr)
+		if err != nil || priority < -config.MAX_FILE_PRIORITY || priority > config.MAX_FILE_PRIORITY {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("Invalid priority, must be between %d and %d", -config.MAX_FILE_PRIORITY, config.MAX_FILE_PRIORITY),
 			})
 			return
 		}
-		log.Err(res.Error).Msg("Error finding domain")
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Error finding domain",
-		})
-		return
 	}
-	log.Info().Uint("userId", userId).Int64("userEnteredDomainId", domainId).Msg("Domain found")
 	////
 
 	// Get uploaded files
@@ -120,6 +146,7 @@ func handleUploadLogFiles(ctx *gin.Context) {
 		ctx.JSON(http.StatusBadRequest, gin.H{
 			"error": "No files uploaded",
 		})
+		return
 	}
 	files := form.File["logfiles"]
 	////
@@ -134,8 +161,17 @@ func handleUploadLogFiles(ctx *gin.Context) {
 		}
 	}()
 
+	sizes := make([]int64, len(files))
+	for i, file := range files {
+		sizes[i] = file.Size
+	}
+	if _, ok := checkUploadQuotas(ctx, tx, userId, domainId, sizes); !ok {
+		tx.Rollback()
+		return
+	}
+
 	for _, file := range files {
-		response, err := processFile(tx, file, domainId)
+		response, err := processFile(tx, file, domainId, priority)
 
 		responses = append(responses, response)
 		if err != nil {
@@ -148,6 +184,15 @@ func handleUploadLogFiles(ctx *gin.Context) {
 		}
 	}
 
+	if err := countUploads(tx, userId, domainId, len(files)); err != nil {
+		tx.Rollback()
+		log.Err(err).Msg("Couldn't count uploads")
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Couldn't save db entry",
+		})
+		return
+	}
+
 	if err := tx.Commit().Error; err != nil {
 		log.Err(err).Msg("Couldn't commit transaction")
 		ctx.JSON(http.StatusInternalServerError, gin.H{
@@ -162,12 +207,48 @@ func handleUploadLogFiles(ctx *gin.Context) {
 	})
 }
 
+// fillQueuePositions sets the queue position of the pending files, among the files of every user
+func fillQueuePositions(logFiles []models.LogFile) error {
+	var pendingIds []uint
+	for _, logFile := range logFiles {
+		if logFile.Status == models.StatusPending {
+			pendingIds = append(pendingIds, logFile.ID)
+		}
+	}
+	if len(pendingIds) == 0 {
+		return nil
+	}
+
+	var positions []struct {
+		ID       uint
+		Position int64
+	}
+	if err := db.GormDB.Raw("SELECT id, position FROM log_files_queue WHERE id IN ?", pendingIds).Scan(&positions).Error; err != nil {
+		return err
+	}
+
+	positionById := make(map[uint]int64, len(positions))
+	for _, p := range positions {
+		positionById[p.ID] = p.Position
+	}
+	for i := range logFiles {
+		// Files waiting for a retry aren't in the queue yet
+		if position, ok := positionById[logFiles[i].ID]; ok {
+			logFiles[i].QueuePosition = &position
+		}
+	}
+	return nil
+}
+
 func handleGetAllLogFilesForUser(ctx *gin.Context) {
 	userId := ctx.GetUint("userId")
 	log.Warn().Uint("userId", userId).Msg("userId")
 
 	var logFiles []models.LogFile
 	err := db.GormDB.Joins("JOIN domains ON domains.id = log_files.domain_id").Where("domains.user_id = ?", userId).Find(&logFiles).Error
+	if err == nil {
+		err = fillQueuePositions(logFiles)
+	}
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Couldn't get log files",
@@ -186,6 +267,9 @@ func handleGetDomainLogFiles(ctx *gin.Context) {
 
 	var logFiles []models.LogFile
 	err := db.GormDB.Joins("JOIN domains ON domains.id = log_files.domain_id").Where("domains.user_id = ? AND domains.id = ?", userId, domainId).Find(&logFiles).Error
+	if err == nil {
+		err = fillQueuePositions(logFiles)
+	}
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Couldn't get log files",
@@ -198,6 +282,68 @@ func handleGetDomainLogFiles(ctx *gin.Context) {
 	})
 }
 
+func handleGetLogFile(ctx *gin.Context) {
+	fileId := ctx.Param("id")
+	userId := ctx.GetUint("userId")
+
+	var logFile models.LogFile
+	err := db.GormDB.Joins("JOIN domains ON domains.id = log_files.domain_id").Where("domains.user_id = ?", userId).First(&logFile, fileId).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error": "Log file not found",
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Something went wrong",
+		})
+		return
+	}
+
+	logFiles := []models.LogFile{logFile}
+	if err := fillQueuePositions(logFiles); err != nil {
+		log.Err(err).Uint("fileId", logFile.ID).Msg("Failed to get queue position")
+	}
+
+	// Files that were never processed have no stats yet
+	var stats *models.LogFileStats
+	var fileStats models.LogFileStats
+	res := db.GormDB.Limit(1).Find(&fileStats, "log_file_id = ?", logFile.ID)
+	if res.Error != nil {
+		log.Err(res.Error).Uint("fileId", logFile.ID).Msg("Failed to get log file stats")
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Something went wrong",
+		})
+		return
+	}
+	if res.RowsAffected > 0 {
+		stats = &fileStats
+	}
+
+	if ctx.Query("format") == "text" {
+		if stats == nil || stats.Summary == nil {
+			ctx.String(http.StatusOK, "No summary yet, the file wasn't processed\n")
+			return
+		}
+		summary, err := processor.RenderSummary(stats.Summary)
+		if err != nil {
+			log.Err(err).Uint("fileId", logFile.ID).Msg("Failed to render log file summary")
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Something went wrong",
+			})
+			return
+		}
+		ctx.String(http.StatusOK, summary)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"result": logFiles[0],
+		"stats":  stats,
+	})
+}
+
 func handleDeleteLogFile(ctx *gin.Context) {
 	fileId := ctx.Param("id")
 	userId := ctx.GetUint("userId")
@@ -217,14 +363,277 @@ func handleDeleteLogFile(ctx *gin.Context) {
 		return
 	}
 
-	err = db.GormDB.Select("LogEntries").Delete(&logFile).Error
+	// The entries are removed by the purge-deleted-files job. Taking the lease away stops the worker processing the file,
+	// and the job waits for the lease to expire.
+	err = db.GormDB.Transaction(func(tx *gorm.DB) error {
+		// Rollups have no soft delete, the deleted file stops counting in its domain's rollups right away
+		if err := tx.Where("log_file_id = ?", logFile.ID).Delete(&models.LogRollup{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&logFile).Updates(map[string]any{
+			"status":      models.StatusDeleting,
+			"lease_owner": nil,
+			"deleted_at":  time.Now(),
+		}).Error
+	})
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{
 			"message": "Couldn't delete log file",
 		})
 		return
 	}
+	ctx.JSON(http.StatusAccepted, gin.H{
+		"message": "File is being deleted",
+	})
+}
+
+func handleReprocessLogFile(ctx *gin.Context) {
+	fileId := ctx.Param("id")
+	userId := ctx.GetUint("userId")
+
+	var logFile models.LogFile
+	err := db.GormDB.Joins("JOIN domains ON domains.id = log_files.domain_id").Where("domains.user_id = ?", userId).First(&logFile, fileId).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error": "Log file not found",
+			})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Something went wrong",
+		})
+		return
+	}
+
+	if logFile.Status == models.StatusPending || logFile.Status == models.StatusProcessing {
+		ctx.JSON(http.StatusConflict, gin.H{
+			"error": "Log file is already queued for processing",
+		})
+		return
+	}
+
+	if logFile.Status == models.StatusFollowing {
+		ctx.JSON(http.StatusConflict, gin.H{
+			"error": "Log file is still being followed",
+		})
+		return
+	}
+
+	if logFile.FilePurgedAt != nil {
+		ctx.JSON(http.StatusGone, gin.H{
+			"error": "Uploaded file was deleted by the retention policy, please upload it again",
+		})
+		return
+	}
+
+	if _, err := os.Stat(logFile.StoragePath()); err != nil {
+		log.Err(err).Uint("fileId", logFile.ID).Msg("Uploaded file is not available for reprocessing")
+		ctx.JSON(http.StatusGone, gin.H{
+			"error": "Uploaded file is no longer available, please upload it again",
+		})
+		return
+	}
+
+	// Only flip finished files, in case a worker picked the file in the meantime
+	res := db.GormDB.Model(&logFile).
+		Where("status IN ?", []models.Status{models.StatusCompleted, models.StatusFailed}).
+		Updates(map[string]any{
+			"status":        models.StatusPending,
+			"attempts":      0,
+			"last_error":    "",
+			"next_retry_at": nil,
+		})
+	if res.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Couldn't queue log file for reprocessing",
+		})
+		return
+	}
+	if res.RowsAffected == 0 {
+		ctx.JSON(http.StatusConflict, gin.H{
+			"error": "Log file is already queued for processing",
+		})
+		return
+	}
+
 	ctx.JSON(http.StatusOK, gin.H{
-		"message": "File deleted",
+		"message": "File queued for reprocessing",
+		"file_id": logFile.ID,
+	})
+}
+
+// handleStreamUploadLogFile ingests the raw request body while it's being received,
+// and saves it at the same time so it can be reprocessed later.
+// The file id is sent back before the body is read, its status tells when the ingestion is done.
+func handleStreamUploadLogFile(ctx *gin.Context) {
+	userId := ctx.GetUint("userId")
+
+	domainId, err := strconv.ParseInt(ctx.Query("domain"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid domain",
+		})
+		return
+	}
+
+	filename := filepath.Base(ctx.Query("name"))
+	if filename == "." || filename == string(filepath.Separator) {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid file name",
+		})
+		return
+	}
+
+	if !checkDomainOwnership(ctx, userId, domainId) {
+		return
+	}
+
+	// Leased like queued files, so a crash during the upload doesn't leave the file in processing forever
+	leaseExpiresAt := time.Now().Add(processor.LeaseDuration)
+	logFile := models.LogFile{
+		Name:           filename,
+		Size:           uint(max(ctx.Request.ContentLength, 0)),
+		Status:         models.StatusProcessing,
+		DomainID:       uint(domainId),
+		LeaseOwner:     processor.WorkerID,
+		LeaseExpiresAt: &leaseExpiresAt,
+	}
+	// The size may be unknown until the body is read, which is then cut at the size left by the quotas
+	var maxSize int64
+	rejected := false
+	err = db.GormDB.Transaction(func(tx *gorm.DB) error {
+		var ok bool
+		if maxSize, ok = checkUploadQuotas(ctx, tx, userId, domainId, []int64{int64(logFile.Size)}); !ok {
+			rejected = true
+			return errUploadRejected
+		}
+		if err := tx.Create(&logFile).Error; err != nil {
+			return err
+		}
+		return countUploads(tx, userId, domainId, 1)
+	})
+	if rejected {
+		return
+	}
+	if err != nil {
+		log.Err(err).Msg("Failed to create log file")
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Couldn't save db entry",
+		})
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(logFile.StoragePath()), 0755); err != nil {
+		log.Err(err).Msg("Failed to create upload directory")
+	}
+	// The body is saved aside until it's completely received, so an interrupted upload never leaves an incomplete copy to reprocess
+	partPath := logFile.StoragePath() + processor.PartialUploadSuffix
+	dst, err := os.Create(partPath)
+	if err != nil {
+		log.Err(err).Uint("fileId", logFile.ID).Msg("Failed to create destination file")
+		db.GormDB.Model(&logFile).Update("status", models.StatusFailed)
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to save file",
+		})
+		return
+	}
+
+	// Reply before consuming the body, which HTTP/1.1 only allows in full duplex mode
+	if err := http.NewResponseController(ctx.Writer).EnableFullDuplex(); err != nil {
+		log.Debug().Err(err).Msg("Full duplex not supported, the response may only be received after the upload")
+	}
+	ctx.JSON(http.StatusAccepted, gin.H{
+		"message": "File upload started, it's ingested while being received",
+		"file_id": logFile.ID,
 	})
+	ctx.Writer.Flush()
+
+	leaseCtx, releaseLease := processor.HoldLease(ctx.Request.Context(), db.PgxPool, logFile.ID)
+	defer releaseLease()
+
+	var body io.Reader = ctx.Request.Body
+	if maxSize >= 0 {
+		body = &quotaLimitedReader{r: body, remaining: maxSize}
+	}
+	received := &eofReader{r: body}
+	metrics, err := processor.ProcessLogReader(
+		leaseCtx,
+		io.TeeReader(received, dst),
+		logFile.StoragePath()+"_"+"parsed_logs.txt",
+		config.PROCESSOR_NUM_WORKERS,
+		db.PgxPool,
+		"batch",
+		logFile.ID,
+	)
+	size, _ := dst.Seek(0, io.SeekCurrent)
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	// The declared size is kept when the body isn't completely received, the stored copy is then removed
+	stored := false
+	if received.eof && closeErr == nil {
+		if renameErr := os.Rename(partPath, logFile.StoragePath()); renameErr != nil {
+			log.Err(renameErr).Uint("fileId", logFile.ID).Msg("Failed to store streamed file")
+		} else {
+			stored = true
+		}
+	}
+	fileUpdates := map[string]any{"stored_bytes": 0}
+	if stored {
+		fileUpdates = map[string]any{"size": size, "stored_bytes": size}
+	} else if err := os.Remove(partPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Err(err).Uint("fileId", logFile.ID).Msg("Failed to remove partial upload")
+	}
+
+	if statsErr := processor.SaveFileStats(context.Background(), db.PgxPool, logFile.ID, metrics); statsErr != nil {
+		log.Err(statsErr).Uint("fileId", logFile.ID).Msg("Failed to save file stats")
+	}
+
+	if err != nil {
+		log.Err(err).Uint("fileId", logFile.ID).Msg("Failed to ingest streamed file")
+		if err := processor.DiscardPartialEntries(context.Background(), db.PgxPool, logFile.ID); err != nil {
+			log.Err(err).Uint("fileId", logFile.ID).Msg("Failed to discard partial entries")
+		}
+		maps.Copy(fileUpdates, map[string]any{
+			"status":           models.StatusFailed,
+			"last_error":       err.Error(),
+			"lease_owner":      nil,
+			"lease_expires_at": nil,
+		})
+		db.GormDB.Model(&logFile).Where("lease_owner = ?", processor.WorkerID).Updates(fileUpdates)
+		return
+	}
+
+	maps.Copy(fileUpdates, map[string]any{
+		"lease_owner":      nil,
+		"lease_expires_at": nil,
+		"status":           models.StatusCompleted,
+		"size":             size,
+		"start_timestamp":  metrics.StartTimestamp,
+		"end_timestamp":    metrics.EndTimestamp,
+		"parsing_time":     metrics.Duration.Nanoseconds(),
+		"processed_at":     time.Now(),
+	})
+	err = db.GormDB.Model(&logFile).Where("lease_owner = ?", processor.WorkerID).Updates(fileUpdates).Error
+	if err != nil {
+		log.Err(err).Uint("fileId", logFile.ID).Msg("Failed to update file status to completed")
+	}
+	log.Info().Uint("fileId", logFile.ID).Int64("size", size).Msg("Finished ingesting streamed file")
+}
+
+// eofReader records whether r was read up to its end
+type eofReader struct {
+	r   io.Reader
+	eof bool
+}
+
+func (e *eofReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if errors.Is(err, io.EOF) {
+		e.eof = true
+	}
+	return n, err
 }
@@ -0,0 +1,183 @@
+package routes
+
+import (
+	"errors"
+	db "iis-logs-parser/database"
+	"iis-logs-parser/models"
+	"iis-logs-parser/processor"
+	"iis-logs-parser/utils"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// errUploadRejected rolls back an upload transaction once the response is sent
+var errUploadRejected = errors.New("upload rejected")
+
+// Response status of an exceeded quota
+var quotaErrorStatus = map[string]int{
+	processor.QuotaMaxFileSize:      http.StatusRequestEntityTooLarge,
+	processor.QuotaMaxStoredBytes:   http.StatusInsufficientStorage,
+	processor.QuotaMaxEntries:       http.StatusInsufficientStorage,
+	processor.QuotaMaxUploadsPerDay: http.StatusTooManyRequests,
+}
+
+// checkUploadQuotas responds with an error and returns false if uploading files of these sizes to the domain exceeds a quota.
+// The user is locked until tx ends, so its concurrent uploads are checked one after the other.
+// Returns the size a single file can have within the quotas, -1 when unlimited.
+func checkUploadQuotas(ctx *gin.Context, tx *gorm.DB, userId uint, domainId int64, sizes []int64) (int64, bool) {
+	err := tx.Exec("SELECT id FROM users WHERE id = ? FOR UPDATE", userId).Error
+	var user models.QuotaUsage
+	var domains []models.DomainQuotaUsage
+	if err == nil {
+		user, domains, err = processor.LoadQuotaUsage(ctx, db.PgxPool, userId)
+	}
+	if err != nil {
+		log.Err(err).Uint("userId", userId).Msg("Failed to load quota usage")
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Something went wrong",
+		})
+		return 0, false
+	}
+
+	usages := map[string]models.QuotaUsage{"user": user}
+	for _, d := range domains {
+		if int64(d.DomainID) == domainId {
+			usages["domain"] = d.QuotaUsage
+		}
+	}
+	maxSize := int64(-1)
+	for _, scope := range []string{"user", "domain"} {
+		usage, ok := usages[scope]
+		if !ok {
+			continue
+		}
+		var quotaErr *processor.QuotaError
+		if err := processor.CheckUploadQuotas(scope, usage, sizes); errors.As(err, &quotaErr) {
+			log.Info().Uint("userId", userId).Int64("domainId", domainId).Str("quota", quotaErr.Quota).Msg("Upload rejected by quota")
+			ctx.JSON(quotaErrorStatus[quotaErr.Quota], gin.H{
+				"error": "Upload exceeds the " + quotaErr.Scope + " quota",
+				"quota": quotaErr.Quota,
+				"limit": quotaErr.Limit,
+				"usage": usage.Usage,
+			})
+			return 0, false
+		}
+		if usage.Limits.MaxFileSize > 0 {
+			maxSize = minSize(maxSize, usage.Limits.MaxFileSize)
+		}
+		if usage.Limits.MaxStoredBytes > 0 {
+			maxSize = minSize(maxSize, usage.Limits.MaxStoredBytes-usage.Usage.StoredBytes)
+		}
+	}
+	return maxSize, true
+}
+
+// minSize returns the smallest size, -1 being unlimited
+func minSize(a int64, b int64) int64 {
+	if a < 0 {
+		return b
+	}
+	return min(a, b)
+}
+
+// countUploads adds the uploaded files to the uploads of the day of the domain
+func countUploads(tx *gorm.DB, userId uint, domainId int64, uploads int) error {
+	return tx.Exec(
+		`INSERT INTO daily_uploads (domain_id, day, user_id, uploads) VALUES (?, (now() AT TIME ZONE 'UTC')::date, ?, ?)
+		ON CONFLICT (domain_id, day) DO UPDATE SET uploads = daily_uploads.uploads + excluded.uploads`,
+		domainId, userId, uploads,
+	).Error
+}
+
+// quotaLimitedReader fails once more than remaining bytes are read, for bodies of unknown size
+type quotaLimitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *quotaLimitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, errors.New("upload exceeds the size left by the quotas")
+	}
+	return n, err
+}
+
+// handleGetUserUsage returns the quotas of the user and of its domains, along with their current usage
+func handleGetUserUsage(ctx *gin.Context) {
+	userId := ctx.GetUint("userId")
+	user, domains, err := processor.LoadQuotaUsage(ctx, db.PgxPool, userId)
+	if err != nil {
+		log.Err(err).Uint("userId", userId).Msg("Failed to load quota usage")
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Something went wrong",
+		})
+		return
+	}
+	if domains == nil {
+		domains = []models.DomainQuotaUsage{}
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"limits":  user.Limits,
+		"usage":   user.Usage,
+		"domains": domains,
+	})
+}
+
+// handleUpdateUserQuotas replaces the quotas of a user, nil quotas apply the QUOTA_* defaults
+func handleUpdateUserQuotas(ctx *gin.Context) {
+	userId, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid user ID",
+		})
+		return
+	}
+
+	var quotas models.Quotas
+	if err := ctx.ShouldBindJSON(&quotas); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err := utils.Validate.Struct(quotas); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	res := db.GormDB.Model(&models.User{}).Where("id = ?", userId).Updates(map[string]any{
+		"quota_max_file_size":       quotas.MaxFileSize,
+		"quota_max_stored_bytes":    quotas.MaxStoredBytes,
+		"quota_max_entries":         quotas.MaxEntries,
+		"quota_max_uploads_per_day": quotas.MaxUploadsPerDay,
+	})
+	if res.Error != nil {
+		log.Err(res.Error).Uint64("userId", userId).Msg("Failed to update user quotas")
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Something went wrong",
+		})
+		return
+	}
+	if res.RowsAffected == 0 {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"error": "User not found",
+		})
+		return
+	}
+
+	log.Info().Uint64("userId", userId).Uint("adminId", ctx.GetUint("userId")).Msg("User quotas updated")
+	ctx.JSON(http.StatusOK, gin.H{
+		"message": "Quotas updated",
+		"quotas":  quotas,
+	})
+}
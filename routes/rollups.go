@@ -0,0 +1,96 @@
+package routes
+
+import (
+	"fmt"
+	db "iis-logs-parser/database"
+	"iis-logs-parser/models"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Buckets returned at most by a rollups request
+const maxRollupBuckets = 5000
+
+// handleGetDomainRollups returns the rollups of a domain summed over its log files,
+// for ?granularity=minute|hour|day (hour by default) between ?from and ?to (RFC 3339, the last 24 hours by default)
+func handleGetDomainRollups(ctx *gin.Context) {
+	userId := ctx.GetUint("userId")
+	domainId, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid domain ID",
+		})
+		return
+	}
+
+	granularity := models.RollupGranularity(ctx.DefaultQuery("granularity", string(models.RollupHour)))
+	size, ok := models.RollupGranularities[granularity]
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid granularity, must be one of: minute, hour, day",
+		})
+		return
+	}
+
+	to, from := time.Now().UTC(), time.Now().UTC().Add(-24*time.Hour)
+	for param, value := range map[string]*time.Time{"from": &from, "to": &to} {
+		if s := ctx.Query(param); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{
+					"error": fmt.Sprintf("Invalid %s, must be an RFC 3339 date", param),
+				})
+				return
+			}
+			*value = t.UTC()
+		}
+	}
+	if !from.Before(to) || to.Sub(from)/size > maxRollupBuckets {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("Invalid range, from must be before to and span at most %d buckets", maxRollupBuckets),
+		})
+		return
+	}
+
+	if !checkDomainOwnership(ctx, userId, domainId) {
+		return
+	}
+
+	var fileRollups []models.LogRollup
+	res := db.GormDB.
+		Where("domain_id = ? AND granularity = ? AND bucket >= ? AND bucket < ?", domainId, granularity, from.Truncate(size), to).
+		Find(&fileRollups)
+	if res.Error != nil {
+		log.Err(res.Error).Int64("domainId", domainId).Msg("Failed to get rollups")
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Something went wrong",
+		})
+		return
+	}
+
+	byBucket := map[time.Time]*models.LogRollup{}
+	for _, fileRollup := range fileRollups {
+		rollup, ok := byBucket[fileRollup.Bucket]
+		if !ok {
+			rollup = &models.LogRollup{DomainID: fileRollup.DomainID, Granularity: granularity, Bucket: fileRollup.Bucket}
+			byBucket[fileRollup.Bucket] = rollup
+		}
+		rollup.Merge(&fileRollup)
+	}
+	rollups := make([]*models.LogRollup, 0, len(byBucket))
+	for _, rollup := range byBucket {
+		rollups = append(rollups, rollup)
+	}
+	slices.SortFunc(rollups, func(a, b *models.LogRollup) int { return a.Bucket.Compare(b.Bucket) })
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"granularity":   granularity,
+		"latencyBounds": models.RollupLatencyBounds,
+		"rollups":       rollups,
+	})
+}
@@ -14,6 +14,7 @@ func RegisterRoutes(server *gin.Engine) {
 			usersV1.POST("/register", handleRegisterUser)
 			usersV1.POST("/login", handleLoginUser)
 			usersV1.GET("/verify", handleVerifyUser)
+			usersV1.GET("/usage", middleware.Authenticate, handleGetUserUsage)
 		}
 
 		domainsV1 := v1.Group("/domains")
@@ -23,6 +24,9 @@ func RegisterRoutes(server *gin.Engine) {
 			domainsV1.POST("/", handleCreateDomain)
 			domainsV1.PUT("/:id", handleUpdateDomain)
 			domainsV1.DELETE("/:id", handleDeleteDomain)
+			domainsV1.GET("/:id/rollups", handleGetDomainRollups)
+			domainsV1.GET("/:id/archives", handleGetDomainArchives)
+			domainsV1.POST("/:id/archives/restore", handleRestoreDomainArchives)
 		}
 
 		logsV1 := v1.Group("/logs")
@@ -30,9 +34,24 @@ func RegisterRoutes(server *gin.Engine) {
 		{
 			logsV1.GET("/", handleGetAllLogFilesForUser)
 			logsV1.GET("/domain/:id", handleGetDomainLogFiles)
+			logsV1.GET("/:id", handleGetLogFile)
 			logsV1.POST("/upload", handleUploadLogFiles)
+			logsV1.POST("/upload/stream", handleStreamUploadLogFile)
+			logsV1.POST("/:id/reprocess", handleReprocessLogFile)
 			logsV1.DELETE("/:id", handleDeleteLogFile)
 		}
+
+		adminV1 := v1.Group("/admin")
+		adminV1.Use(middleware.Authenticate, middleware.RequireAdmin)
+		{
+			adminV1.GET("/jobs", handleGetJobs)
+			adminV1.GET("/jobs/:name/runs", handleGetJobRuns)
+			adminV1.POST("/jobs/:name/run", handleRunJob)
+			adminV1.GET("/workers", handleGetWorkers)
+			adminV1.GET("/retention/purges", handleGetRetentionPurges)
+			adminV1.PUT("/users/:id/quotas", handleUpdateUserQuotas)
+			adminV1.PUT("/domains/:id/follow-path", handleUpdateDomainFollowPath)
+		}
 	}
 
 }
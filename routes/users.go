@@ -24,6 +24,7 @@ func handleRegisterUser(ctx *gin.Context) {
 	//Add defaults
 	user.Role = "user"
 	user.Verified = false
+	user.Quotas = models.Quotas{}
 
 	if err := user.Validate(); err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{
@@ -0,0 +1,271 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iis-logs-parser/models"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrUnknownJob = errors.New("unknown job")
+	ErrJobRunning = errors.New("job is already running")
+	// The run time was already handled by another replica
+	errAlreadyRan = errors.New("job already ran for this schedule")
+)
+
+// Default is the scheduler of the running server, used by the admin routes
+var Default *Scheduler
+
+// JobFunc does the work of a job, its context is cancelled when the scheduler stops
+type JobFunc func(ctx context.Context) error
+
+type job struct {
+	name     string
+	schedule Schedule
+	run      JobFunc
+}
+
+// Scheduler runs named jobs on their schedule.
+// A job never runs twice at the same time, nor twice for the same run time, even across replicas:
+// runs hold a Postgres advisory lock on the job name, and are recorded in job_runs, unique per job and run time.
+type Scheduler struct {
+	dbPool   *pgxpool.Pool
+	workerID string
+	jobs     []*job
+	ctx      context.Context
+}
+
+// JobStatus is a registered job with its last runs
+type JobStatus struct {
+	Name      string         `json:"name"`
+	Schedule  string         `json:"schedule"`
+	NextRunAt time.Time      `json:"nextRunAt"`
+	LastRun   *models.JobRun `json:"lastRun"`
+	LastError string         `json:"lastError"` // Error of the last failed run, even if the job succeeded since
+}
+
+// New creates a scheduler recording its runs as workerID
+func New(dbPool *pgxpool.Pool, workerID string) *Scheduler {
+	return &Scheduler{dbPool: dbPool, workerID: workerID, ctx: context.Background()}
+}
+
+// Register adds a job, it must be called before Start
+func (s *Scheduler) Register(name string, schedule Schedule, run JobFunc) {
+	s.jobs = append(s.jobs, &job{name: name, schedule: schedule, run: run})
+}
+
+// Start runs the registered jobs on their schedule until ctx is cancelled
+func (s *Scheduler) Start(ctx context.Context) {
+	s.ctx = ctx
+	for _, j := range s.jobs {
+		log.Info().Str("job", j.name).Str("schedule", j.schedule.String()).Msg("Scheduler: job registered")
+		go s.loop(ctx, j)
+	}
+}
+
+func (s *Scheduler) loop(ctx context.Context, j *job) {
+	for {
+		next := j.schedule.Next(time.Now())
+		if next.IsZero() {
+			log.Warn().Str("job", j.name).Msg("Scheduler: job will never run again")
+			return
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		runId, release, err := s.begin(ctx, j, models.JobTriggerSchedule, &next)
+		if errors.Is(err, errAlreadyRan) || errors.Is(err, ErrJobRunning) {
+			log.Debug().Str("job", j.name).Err(err).Msg("Scheduler: skipping run")
+			continue
+		}
+		if err != nil {
+			log.Err(err).Str("job", j.name).Msg("Scheduler: failed to start run")
+			continue
+		}
+		// Runs are sequential, a slow job skips the run times it overlaps with
+		s.execute(ctx, j, runId, release)
+	}
+}
+
+// Trigger starts a manual run of the job in the background and returns its run id
+func (s *Scheduler) Trigger(name string) (uint, error) {
+	j := s.find(name)
+	if j == nil {
+		return 0, ErrUnknownJob
+	}
+
+	runId, release, err := s.begin(s.ctx, j, models.JobTriggerManual, nil)
+	if err != nil {
+		return 0, err
+	}
+	go s.execute(s.ctx, j, runId, release)
+	return runId, nil
+}
+
+func (s *Scheduler) find(name string) *job {
+	for _, j := range s.jobs {
+		if j.name == name {
+			return j
+		}
+	}
+	return nil
+}
+
+// begin takes the job's lock and records the run, the returned function releases the lock
+func (s *Scheduler) begin(ctx context.Context, j *job, trigger models.JobTrigger, scheduledAt *time.Time) (uint, func(), error) {
+	conn, err := s.dbPool.Acquire(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	lockKey := "job-" + j.name
+	var locked bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", lockKey).Scan(&locked); err != nil {
+		conn.Release()
+		return 0, nil, err
+	}
+	if !locked {
+		conn.Release()
+		return 0, nil, ErrJobRunning
+	}
+	release := func() {
+		conn.Exec(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", lockKey)
+		conn.Release()
+	}
+
+	var runId uint
+	err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		// Holding the lock, any run still marked running was interrupted by a crash
+		_, err := tx.Exec(ctx,
+			"UPDATE job_runs SET status = $1, error = $2, finished_at = now() WHERE name = $3 AND status = $4",
+			models.JobRunFailed, "interrupted, the worker stopped while running the job", j.name, models.JobRunRunning,
+		)
+		if err != nil {
+			return err
+		}
+
+		err = tx.QueryRow(ctx,
+			`INSERT INTO job_runs (name, scheduled_at, trigger, status, worker_id, started_at) VALUES ($1, $2, $3, $4, $5, now())
+			ON CONFLICT DO NOTHING
+			RETURNING id`,
+			j.name, scheduledAt, trigger, models.JobRunRunning, s.workerID,
+		).Scan(&runId)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errAlreadyRan
+		}
+		return err
+	})
+	if err != nil {
+		release()
+		return 0, nil, err
+	}
+	return runId, release, nil
+}
+
+func (s *Scheduler) execute(ctx context.Context, j *job, runId uint, release func()) {
+	defer release()
+
+	log.Info().Str("job", j.name).Uint("runId", runId).Msg("Scheduler: job started")
+	start := time.Now()
+	err := runJob(ctx, j)
+
+	status, errMsg := models.JobRunSucceeded, ""
+	if err != nil {
+		status, errMsg = models.JobRunFailed, err.Error()
+		log.Err(err).Str("job", j.name).Uint("runId", runId).Dur("duration", time.Since(start)).Msg("Scheduler: job failed")
+	} else {
+		log.Info().Str("job", j.name).Uint("runId", runId).Dur("duration", time.Since(start)).Msg("Scheduler: job succeeded")
+	}
+
+	// The run is recorded even if the scheduler is stopping
+	_, err = s.dbPool.Exec(context.Background(),
+		"UPDATE job_runs SET status = $1, error = $2, finished_at = now() WHERE id = $3",
+		status, errMsg, runId,
+	)
+	if err != nil {
+		log.Err(err).Str("job", j.name).Uint("runId", runId).Msg("Scheduler: failed to record job run")
+	}
+}
+
+func runJob(ctx context.Context, j *job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return j.run(ctx)
+}
+
+// Status returns the registered jobs with their last runs
+func (s *Scheduler) Status(ctx context.Context) ([]JobStatus, error) {
+	lastRuns := map[string]*models.JobRun{}
+	rows, err := s.dbPool.Query(ctx,
+		`SELECT DISTINCT ON (name) id, name, scheduled_at, trigger, status, COALESCE(worker_id, ''), started_at, finished_at, COALESCE(error, '')
+		FROM job_runs ORDER BY name, started_at DESC`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var run models.JobRun
+	_, err = pgx.ForEachRow(rows,
+		[]any{&run.ID, &run.Name, &run.ScheduledAt, &run.Trigger, &run.Status, &run.WorkerID, &run.StartedAt, &run.FinishedAt, &run.Error},
+		func() error {
+			lastRun := run
+			lastRuns[run.Name] = &lastRun
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	lastErrors := map[string]string{}
+	rows, err = s.dbPool.Query(ctx,
+		"SELECT DISTINCT ON (name) name, error FROM job_runs WHERE status = $1 ORDER BY name, started_at DESC",
+		models.JobRunFailed,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var name, lastError string
+	if _, err := pgx.ForEachRow(rows, []any{&name, &lastError}, func() error {
+		lastErrors[name] = lastError
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	statuses := make([]JobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		statuses = append(statuses, JobStatus{
+			Name:      j.name,
+			Schedule:  j.schedule.String(),
+			NextRunAt: j.schedule.Next(now),
+			LastRun:   lastRuns[j.name],
+			LastError: lastErrors[j.name],
+		})
+	}
+	return statuses, nil
+}
+
+// PruneRuns deletes the finished runs older than maxAge, returns the number of deleted runs
+func (s *Scheduler) PruneRuns(ctx context.Context, maxAge time.Duration) (int64, error) {
+	tag, err := s.dbPool.Exec(ctx,
+		"DELETE FROM job_runs WHERE status <> $1 AND started_at < now() - $2::interval",
+		models.JobRunRunning, maxAge,
+	)
+	return tag.RowsAffected(), err
+}
@@ -0,0 +1,314 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"iis-logs-parser/models"
+	"iis-logs-parser/parser"
+	"iis-logs-parser/processor"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// benchmarkLogLines is the size of the generated benchmark log, a bit less than a day of a busy site
+const benchmarkLogLines = 200000
+
+// benchmarkLog returns a log of n lines on 2002-01-01, a day no other test writes to.
+// Like in a real log, its server IPs, URI stems and user agents are few and repeated on most lines.
+func benchmarkLog(n int) string {
+	statuses := []string{"200", "200", "200", "200", "304", "302", "404", "500"}
+	start := time.Date(2002, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var sb strings.Builder
+	sb.WriteString(parser.FIELDS_DEF + "\n")
+	for i := 0; i < n; i++ {
+		timestamp := start.Add(time.Duration(i) * 24 * time.Hour / time.Duration(n))
+		fmt.Fprintf(&sb, "%s 10.0.0.%d GET /app/module%d/page%d.aspx id=%d 443 - 192.168.%d.%d Mozilla/5.0+(Windows+NT+10.0;+Win64;+x64)+AppleWebKit/537.36+(KHTML,+like+Gecko)+Chrome/%d.0.0.0+Safari/537.36 %s 0 0 %d\n",
+			timestamp.Format(time.DateTime), i%3+1, i%7, i%211, i, i%13, i%251, 100+i%17, statuses[i%len(statuses)], i%997,
+		)
+	}
+	return sb.String()
+}
+
+// resetBenchmarkEntries empties the partitions of 2002, which only hold the entries of the benchmark log
+func resetBenchmarkEntries(b *testing.B, testDB *pgxpool.Pool, logFileId uint) {
+	ctx := context.Background()
+	for _, partition := range benchmarkPartitions(b, testDB) {
+		if _, err := testDB.Exec(ctx, "TRUNCATE "+partition); err != nil {
+			b.Fatalf("failed to truncate partition: %v", err)
+		}
+	}
+	if _, err := testDB.Exec(ctx, "UPDATE log_files SET entries = 0 WHERE id = $1", logFileId); err != nil {
+		b.Fatalf("failed to reset log file: %v", err)
+	}
+}
+
+func benchmarkPartitions(b *testing.B, testDB *pgxpool.Pool) []string {
+	rows, err := testDB.Query(context.Background(),
+		"SELECT inhrelid::regclass::text FROM pg_inherits WHERE inhparent = 'log_entries'::regclass AND inhrelid::regclass::text LIKE 'log_entries_p2002%'",
+	)
+	if err != nil {
+		b.Fatalf("failed to list partitions: %v", err)
+	}
+	partitions, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		b.Fatalf("failed to list partitions: %v", err)
+	}
+	return partitions
+}
+
+// ingestBenchmarkLog inserts the entries of content through the processor, and returns how long the insertion took
+func ingestBenchmarkLog(b *testing.B, testDB *pgxpool.Pool, logFileId uint, content string) time.Duration {
+	outputFile := filepath.Join(b.TempDir(), "parsed_logs.txt")
+	metrics, err := processor.ProcessLogReader(context.Background(), strings.NewReader(content), outputFile, 8, testDB, "batch", logFileId)
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	return metrics.TotalInsertionTime
+}
+
+// plainEntriesTableSQL is log_entries as it was before the dictionary encoding, with the values stored as text in every entry
+const plainEntriesTableSQL = `CREATE TABLE log_entries_plain_bench (
+	id bigserial NOT NULL,
+	log_file_id bigint NOT NULL,
+	line_number bigint,
+	byte_offset bigint,
+	timestamp timestamp NOT NULL,
+	date text,
+	time text,
+	server_ip text,
+	method text,
+	uri_stem text,
+	uri_query text,
+	port text,
+	username text,
+	client_ip text,
+	user_agent text,
+	status text,
+	sub_status text,
+	win32_status text,
+	time_taken text,
+	PRIMARY KEY (id, timestamp)
+);
+CREATE INDEX ON log_entries_plain_bench (log_file_id)`
+
+// copyPlainEntries parses content and copies its entries in log_entries_plain_bench by batches like the processor,
+// and returns how long the insertion took
+func copyPlainEntries(b *testing.B, testDB *pgxpool.Pool, logFileId uint, content string) time.Duration {
+	ctx := context.Background()
+	columns := []string{
+		"log_file_id", "line_number", "byte_offset", "timestamp", "date", "time", "server_ip", "method", "uri_stem", "uri_query",
+		"port", "username", "client_ip", "user_agent", "status", "sub_status", "win32_status", "time_taken",
+	}
+	var inserted time.Duration
+	insert := func(batch []*models.LogEntry) {
+		startTime := time.Now()
+		_, err := testDB.CopyFrom(ctx, pgx.Identifier{"log_entries_plain_bench"}, columns,
+			pgx.CopyFromSlice(len(batch), func(i int) ([]any, error) {
+				e := batch[i]
+				return []any{
+					e.LogFileID, e.LineNumber, e.ByteOffset, e.Timestamp, e.Date, e.Time, e.ServerIP, e.Method, e.URIStem, e.URIQuery,
+					e.Port, e.Username, e.ClientIP, e.UserAgent, e.Status, e.SubStatus, e.Win32Status, e.TimeTaken,
+				}, nil
+			}),
+		)
+		if err != nil {
+			b.Fatalf("failed to copy entries: %v", err)
+		}
+		inserted += time.Since(startTime)
+	}
+
+	batch := make([]*models.LogEntry, 0, 10000)
+	for i, line := range strings.Split(content, "\n") {
+		entry, err := parser.ParseLogLine(line)
+		if err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+		if entry == nil {
+			continue
+		}
+		entry.LogFileID = logFileId
+		entry.LineNumber = int64(i + 1)
+		batch = append(batch, entry)
+		if len(batch) == cap(batch) {
+			insert(batch)
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		insert(batch)
+	}
+	return inserted
+}
+
+// BenchmarkDictionaryEncoding compares the entries stored with their values as text, as before the dictionary encoding,
+// to the dictionary-encoded entries. The encoded entries are inserted by the processor, their rollups included.
+// Run it with -benchtime=1x, each iteration inserts the whole log.
+func BenchmarkDictionaryEncoding(b *testing.B) {
+	content := benchmarkLog(benchmarkLogLines)
+
+	b.Run("plain", func(b *testing.B) {
+		ctx := context.Background()
+		testDB, logFileId, cleanup := setupTestDB()
+		defer cleanup()
+		if _, err := testDB.Exec(ctx, plainEntriesTableSQL); err != nil {
+			b.Fatalf("failed to create table: %v", err)
+		}
+		defer testDB.Exec(context.Background(), "DROP TABLE log_entries_plain_bench")
+
+		var inserted time.Duration
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			if _, err := testDB.Exec(ctx, "TRUNCATE log_entries_plain_bench"); err != nil {
+				b.Fatalf("failed to truncate table: %v", err)
+			}
+			b.StartTimer()
+			inserted += copyPlainEntries(b, testDB, logFileId, content)
+		}
+		b.StopTimer()
+
+		var bytes int64
+		if err := testDB.QueryRow(ctx, "SELECT pg_total_relation_size('log_entries_plain_bench')").Scan(&bytes); err != nil {
+			b.Fatalf("failed to measure storage: %v", err)
+		}
+		reportIngestion(b, inserted, bytes)
+	})
+
+	b.Run("encoded", func(b *testing.B) {
+		testDB, logFileId, cleanup := setupTestDB()
+		defer cleanup()
+
+		var inserted time.Duration
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			resetBenchmarkEntries(b, testDB, logFileId)
+			b.StartTimer()
+			inserted += ingestBenchmarkLog(b, testDB, logFileId, content)
+		}
+		b.StopTimer()
+
+		// The values are stored once in the lookup tables, only the rows of the log's values are counted
+		var bytes int64
+		err := testDB.QueryRow(context.Background(),
+			`SELECT $1::bigint
+				+ (SELECT COALESCE(SUM(pg_column_size(d.*)), 0) FROM server_ips d WHERE id IN (SELECT server_ip_id FROM log_entries WHERE log_file_id = $2))
+				+ (SELECT COALESCE(SUM(pg_column_size(d.*)), 0) FROM uri_stems d WHERE id IN (SELECT uri_stem_id FROM log_entries WHERE log_file_id = $2))
+				+ (SELECT COALESCE(SUM(pg_column_size(d.*)), 0) FROM user_agents d WHERE id IN (SELECT user_agent_id FROM log_entries WHERE log_file_id = $2))`,
+			benchmarkPartitionsSize(b, testDB), logFileId,
+		).Scan(&bytes)
+		if err != nil {
+			b.Fatalf("failed to measure storage: %v", err)
+		}
+		reportIngestion(b, inserted, bytes)
+	})
+}
+
+// reportIngestion reports the insertion time of an iteration, and the bytes per entry of the benchmark log
+func reportIngestion(b *testing.B, inserted time.Duration, bytes int64) {
+	b.ReportMetric(float64(inserted.Milliseconds())/float64(b.N), "insert-ms/op")
+	b.ReportMetric(float64(benchmarkLogLines)*float64(b.N)/b.Elapsed().Seconds(), "entries/s")
+	b.ReportMetric(float64(bytes)/float64(benchmarkLogLines), "bytes/entry")
+}
+
+// benchmarkPartitionsSize returns the disk space of the partitions of the benchmark log, their indexes included
+func benchmarkPartitionsSize(b *testing.B, testDB *pgxpool.Pool) int64 {
+	var bytes int64
+	err := testDB.QueryRow(context.Background(),
+		"SELECT COALESCE(SUM(pg_total_relation_size(p::regclass)), 0) FROM unnest($1::text[]) AS p",
+		benchmarkPartitions(b, testDB),
+	).Scan(&bytes)
+	if err != nil {
+		b.Fatalf("failed to measure storage: %v", err)
+	}
+	return bytes
+}
+
+// BenchmarkCopyEntries inserts the generated log with and without the partition indexes, to measure what maintaining them costs the COPY.
+// Run it with -benchtime=1x, each iteration inserts the whole log.
+func BenchmarkCopyEntries(b *testing.B) {
+	content := benchmarkLog(benchmarkLogLines)
+
+	for _, indexes := range []bool{true, false} {
+		name := "indexes"
+		if !indexes {
+			name = "no-indexes"
+		}
+		b.Run(name, func(b *testing.B) {
+			testDB, logFileId, cleanup := setupTestDB()
+			defer cleanup()
+			// A first insertion creates the partitions of the log, then their indexes are built or dropped
+			ingestBenchmarkLog(b, testDB, logFileId, content)
+			setEntryIndexes(b, testDB, indexes)
+
+			var inserted time.Duration
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				resetBenchmarkEntries(b, testDB, logFileId)
+				b.StartTimer()
+				inserted += ingestBenchmarkLog(b, testDB, logFileId, content)
+			}
+			b.StopTimer()
+			reportIngestion(b, inserted, benchmarkPartitionsSize(b, testDB))
+		})
+	}
+}
+
+// BenchmarkQueryEntries runs the usual entry filters over the generated log, with and without index scans
+func BenchmarkQueryEntries(b *testing.B) {
+	ctx := context.Background()
+	testDB, logFileId, cleanup := setupTestDB()
+	defer cleanup()
+	resetBenchmarkEntries(b, testDB, logFileId)
+	ingestBenchmarkLog(b, testDB, logFileId, benchmarkLog(benchmarkLogLines))
+	setEntryIndexes(b, testDB, true)
+	if _, err := testDB.Exec(ctx, "ANALYZE log_entries, uri_stems"); err != nil {
+		b.Fatalf("failed to analyze: %v", err)
+	}
+
+	start := time.Date(2002, 1, 1, 12, 0, 0, 0, time.UTC)
+	queries := []struct {
+		name string
+		sql  string
+		args []any
+	}{
+		{"log-file", "SELECT COUNT(*) FROM log_entries WHERE log_file_id = $1", []any{logFileId}},
+		{"status", "SELECT COUNT(*) FROM log_entries WHERE status = '500'", nil},
+		{"time-range", "SELECT COUNT(*) FROM log_entries WHERE timestamp >= $1 AND timestamp < $2", []any{start, start.Add(time.Hour)}},
+		// Matches a few of the URI stems, through the trigram index of uri_stems
+		{"uri-search", "SELECT COUNT(*) FROM log_entries_resolved WHERE uri_stem ILIKE '%module3/page12%'", nil},
+	}
+
+	for _, indexes := range []bool{true, false} {
+		conn, err := testDB.Acquire(ctx)
+		if err != nil {
+			b.Fatalf("failed to acquire connection: %v", err)
+		}
+		suffix := "-indexes"
+		if !indexes {
+			suffix = "-no-indexes"
+			conn.Exec(ctx, "SET enable_indexscan = off; SET enable_bitmapscan = off; SET enable_indexonlyscan = off")
+		}
+
+		for _, q := range queries {
+			b.Run(q.name+suffix, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					var count int64
+					if err := conn.QueryRow(ctx, q.sql, q.args...).Scan(&count); err != nil {
+						b.Fatalf("unexpected error: %v", err)
+					}
+				}
+			})
+		}
+		conn.Exec(ctx, "RESET ALL")
+		conn.Release()
+	}
+}
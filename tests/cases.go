@@ -28,6 +28,7 @@ var Cases = map[CaseType]Case{
 			return &models.LogEntry{
 				Date:        "2023-10-10",
 				Time:        "12:00:00",
+				Timestamp:   time.Date(2023, 10, 10, 12, 0, 0, 0, time.UTC),
 				ServerIP:    "192.168.1.1",
 				Method:      "GET",
 				URIStem:     "/index.html",
@@ -62,12 +63,16 @@ func GetProcessLogFileTC1() ProcessLogFileTC {
 	return ProcessLogFileTC{
 		logFileContent: `#Fields: date time s-ip cs-method cs-uri-stem cs-uri-query s-port cs-username c-ip cs(User-Agent) sc-status sc-substatus sc-win32-status time-taken
 2023-10-10 12:00:00 192.168.1.1 GET /index.html - 80 - 192.168.1.100 Mozilla/5.0 200 0 0 123
-2023-10-10 12:00:01 192.168.1.1 GET /about.html - 80 - 192.168.1.101 Mozilla/5.0 404 0 0 456
+2023-10-10 12:00:01 192.168.1.1 GET /à-propos.html - 80 - 192.168.1.101 Mozilla/5.0 404 0 0 456
 2023-10-10 12:00:02 192.168.1.1 GET /contact.html - 80 - 192.168.1.102 Mozilla/5.0 500 0 0 789`,
 		parsedEntries: []*models.LogEntry{
 			{
+				LineNumber:  2,
+				ByteOffset:  148,
+				LineSize:    93,
 				Date:        "2023-10-10",
 				Time:        "12:00:00",
+				Timestamp:   time.Date(2023, 10, 10, 12, 0, 0, 0, time.UTC),
 				ServerIP:    "192.168.1.1",
 				Method:      "GET",
 				URIStem:     "/index.html",
@@ -82,11 +87,15 @@ func GetProcessLogFileTC1() ProcessLogFileTC {
 				TimeTaken:   "123",
 			},
 			{
+				LineNumber:  3,
+				ByteOffset:  241,
+				LineSize:    97, // à takes 2 bytes
 				Date:        "2023-10-10",
 				Time:        "12:00:01",
+				Timestamp:   time.Date(2023, 10, 10, 12, 0, 1, 0, time.UTC),
 				ServerIP:    "192.168.1.1",
 				Method:      "GET",
-				URIStem:     "/about.html",
+				URIStem:     "/à-propos.html",
 				URIQuery:    "-",
 				Port:        "80",
 				Username:    "-",
@@ -98,8 +107,12 @@ func GetProcessLogFileTC1() ProcessLogFileTC {
 				TimeTaken:   "456",
 			},
 			{
+				LineNumber:  4,
+				ByteOffset:  338, // after the multi-byte line
+				LineSize:    94,
 				Date:        "2023-10-10",
 				Time:        "12:00:02",
+				Timestamp:   time.Date(2023, 10, 10, 12, 0, 2, 0, time.UTC),
 				ServerIP:    "192.168.1.1",
 				Method:      "GET",
 				URIStem:     "/contact.html",
@@ -0,0 +1,109 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"iis-logs-parser/models"
+	"iis-logs-parser/parser"
+	"iis-logs-parser/processor"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// deletionLine returns a log line of 2001-01-01, in a partition no other test writes to
+func deletionLine(second int, uri string) string {
+	return fmt.Sprintf("2001-01-01 12:00:%02d 192.168.1.1 GET %s - 80 - 192.168.1.100 Mozilla/5.0 200 0 0 123\n", second, uri)
+}
+
+func countFileEntries(t *testing.T, dbPool *pgxpool.Pool, logFileId uint) int64 {
+	t.Helper()
+	var count int64
+	err := dbPool.QueryRow(context.Background(), "SELECT COUNT(*) FROM log_entries WHERE log_file_id = $1", logFileId).Scan(&count)
+	if err != nil {
+		t.Fatalf("failed to count entries: %v", err)
+	}
+	return count
+}
+
+func TestPurgeDeletedFilesKeepsFollowedEntries(t *testing.T) {
+	dbPool, domainId, cleanup := setupTestDomain(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	// The test log file is processing, which would keep every partition
+	_, err := dbPool.Exec(ctx, "UPDATE log_files SET status = $1 WHERE domain_id = $2", models.StatusCompleted, domainId)
+	if err != nil {
+		t.Fatalf("failed to update test log file: %v", err)
+	}
+
+	// A followed file completed by a rollover, then the file it rolled over to
+	dir := t.TempDir()
+	appendToFile(t, filepath.Join(dir, "u_ex010101.log"), followHeader+deletionLine(0, "/followed"))
+	f := processor.NewFollower(dbPool, domainId, dir)
+	pollFollower(t, f)
+	appendToFile(t, filepath.Join(dir, "u_ex010102.log"), followHeader)
+	pollFollower(t, f)
+
+	var followedId, nextId uint
+	err = dbPool.QueryRow(ctx,
+		"SELECT MIN(id), MAX(id) FROM log_files WHERE domain_id = $1 AND status IN ($2, $3) AND name LIKE 'u_ex%'",
+		domainId, models.StatusCompleted, models.StatusFollowing,
+	).Scan(&followedId, &nextId)
+	if err != nil {
+		t.Fatalf("failed to get followed files: %v", err)
+	}
+	if countFileEntries(t, dbPool, followedId) != 1 {
+		t.Fatalf("expected the followed file to have 1 entry")
+	}
+
+	// An uploaded file with entries in the same partition
+	var deletedId uint
+	err = dbPool.QueryRow(ctx,
+		"INSERT INTO log_files (created_at, updated_at, domain_id, name, size, status) VALUES (now(), now(), $1, 'deleted.log', 0, $2) RETURNING id",
+		domainId, models.StatusProcessing,
+	).Scan(&deletedId)
+	if err != nil {
+		t.Fatalf("failed to create log file: %v", err)
+	}
+	content := parser.FIELDS_DEF + "\n" + deletionLine(1, "/deleted") + deletionLine(2, "/deleted")
+	outputFile := filepath.Join(t.TempDir(), "parsed_logs.txt")
+	if _, err := processor.ProcessLogReader(ctx, strings.NewReader(content), outputFile, 1, dbPool, "batch", deletedId); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = dbPool.Exec(ctx,
+		`UPDATE log_files SET status = $1, processed_at = now(), start_timestamp = '2001-01-01 12:00:01', end_timestamp = '2001-01-01 12:00:02'
+		WHERE id = $2`,
+		models.StatusCompleted, deletedId,
+	)
+	if err != nil {
+		t.Fatalf("failed to complete log file: %v", err)
+	}
+
+	// Both the uploaded file and the one being followed are deleted
+	_, err = dbPool.Exec(ctx, "UPDATE log_files SET status = $1 WHERE id IN ($2, $3)", models.StatusDeleting, deletedId, nextId)
+	if err != nil {
+		t.Fatalf("failed to delete log files: %v", err)
+	}
+	if _, err := processor.PurgeDeletedFiles(ctx, dbPool); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var remaining int
+	err = dbPool.QueryRow(ctx, "SELECT COUNT(*) FROM log_files WHERE id IN ($1, $2)", deletedId, nextId).Scan(&remaining)
+	if err != nil {
+		t.Fatalf("failed to count log files: %v", err)
+	}
+	if remaining != 0 {
+		t.Errorf("expected the deleted files to be removed, %d left", remaining)
+	}
+	if count := countFileEntries(t, dbPool, deletedId); count != 0 {
+		t.Errorf("expected the entries of the deleted file to be removed, %d left", count)
+	}
+	if count := countFileEntries(t, dbPool, followedId); count != 1 {
+		t.Errorf("expected the entry of the followed file to be kept, got %d", count)
+	}
+}
@@ -0,0 +1,178 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"iis-logs-parser/config"
+	"iis-logs-parser/models"
+	"iis-logs-parser/processor"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestDropFolderMatchDomain(t *testing.T) {
+	folder := config.DropFolder{Rules: []config.DropFolderRule{
+		{Pattern: "web01/*.log", DomainID: 1},
+		{Pattern: "u_ex*.log", DomainID: 2},
+	}}
+
+	testCases := []struct {
+		rel      string
+		domainId uint
+		matched  bool
+	}{
+		{"web01/u_ex231010.log", 1, true}, // the first matching rule wins
+		{"web01/access.log", 1, true},
+		{"web02/u_ex231010.log", 2, true}, // patterns without a "/" only match the file name
+		{"u_ex231010.log", 2, true},
+		{"web01/archive/access.log", 0, false},
+		{"notes.txt", 0, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.rel, func(t *testing.T) {
+			domainId, matched := folder.MatchDomain(filepath.FromSlash(tc.rel))
+			if domainId != tc.domainId || matched != tc.matched {
+				t.Errorf("expected %d, %v but got %d, %v", tc.domainId, tc.matched, domainId, matched)
+			}
+		})
+	}
+}
+
+// droppedFiles returns the log files registered for the domain from a drop folder, in registration order.
+// Their stored copies are removed when the test ends.
+func droppedFiles(t *testing.T, dbPool *pgxpool.Pool, domainId uint) []models.LogFile {
+	t.Helper()
+	rows, err := dbPool.Query(context.Background(),
+		"SELECT id, name, size, status, source_path FROM log_files WHERE domain_id = $1 AND source_path <> '' ORDER BY id",
+		domainId,
+	)
+	if err != nil {
+		t.Fatalf("failed to get registered files: %v", err)
+	}
+	var files []models.LogFile
+	var f models.LogFile
+	_, err = pgx.ForEachRow(rows, []any{&f.ID, &f.Name, &f.Size, &f.Status, &f.SourcePath}, func() error {
+		files = append(files, f)
+		storagePath := f.StoragePath()
+		t.Cleanup(func() { os.Remove(storagePath) })
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to get registered files: %v", err)
+	}
+	return files
+}
+
+func scanDropFolder(t *testing.T, w *processor.DropFolderWatcher) {
+	t.Helper()
+	if err := w.Scan(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func assertFileContent(t *testing.T, path string, expected string) {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected file %s: %v", path, err)
+	}
+	if string(content) != expected {
+		t.Fatalf("expected %s to contain %q, got %q", path, expected, content)
+	}
+}
+
+func TestDropFolderRegistersStableFiles(t *testing.T) {
+	dbPool, domainId, cleanup := setupTestDomain(t)
+	defer cleanup()
+
+	dir := t.TempDir()
+	w := processor.NewDropFolderWatcher(dbPool, config.DropFolder{
+		Path:  dir,
+		Rules: []config.DropFolderRule{{Pattern: "u_ex*.log", DomainID: domainId}},
+	})
+
+	path := filepath.Join(dir, "u_ex231010.log")
+	appendToFile(t, path, followHeader+followLine(0, "/a"))
+	appendToFile(t, filepath.Join(dir, "notes.txt"), "no rule matches")
+
+	// Seen for the first time, then still being written
+	scanDropFolder(t, w)
+	appendToFile(t, path, followLine(1, "/b"))
+	scanDropFolder(t, w)
+	if files := droppedFiles(t, dbPool, domainId); len(files) != 0 {
+		t.Fatalf("expected changing files to be left alone, got %+v", files)
+	}
+
+	first := followHeader + followLine(0, "/a") + followLine(1, "/b")
+	scanDropFolder(t, w)
+	files := droppedFiles(t, dbPool, domainId)
+	if len(files) != 1 {
+		t.Fatalf("expected the stable file to be registered, got %+v", files)
+	}
+	processingPath := filepath.Join(dir, "processing", "u_ex231010.log-"+strconv.FormatUint(uint64(files[0].ID), 10))
+	if files[0].Name != "u_ex231010.log" || files[0].Size != uint(len(first)) || files[0].Status != models.StatusPending || files[0].SourcePath != processingPath {
+		t.Fatalf("unexpected registered file %+v", files[0])
+	}
+	assertFileContent(t, processingPath, first)
+	assertFileContent(t, files[0].StoragePath(), first)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be moved, got %v", path, err)
+	}
+	assertFileContent(t, filepath.Join(dir, "notes.txt"), "no rule matches")
+
+	// Dropped again under the same name before the first one is processed
+	second := followHeader + followLine(2, "/c")
+	appendToFile(t, path, second)
+	scanDropFolder(t, w)
+	scanDropFolder(t, w)
+	files = droppedFiles(t, dbPool, domainId)
+	if len(files) != 2 || files[0].SourcePath != processingPath || files[1].SourcePath == processingPath {
+		t.Fatalf("expected both files to be registered, got %+v", files)
+	}
+	assertFileContent(t, processingPath, first)
+	assertFileContent(t, files[1].SourcePath, second)
+
+	// Processed files are moved out of the processing folder
+	_, err := dbPool.Exec(context.Background(), "UPDATE log_files SET status = CASE WHEN id = $1 THEN $3 ELSE $4 END WHERE id IN ($1, $2)",
+		files[0].ID, files[1].ID, models.StatusCompleted, models.StatusFailed,
+	)
+	if err != nil {
+		t.Fatalf("failed to update files: %v", err)
+	}
+	scanDropFolder(t, w)
+	files = droppedFiles(t, dbPool, domainId)
+	expectedPaths := []string{
+		filepath.Join(dir, "done", "u_ex231010.log-"+strconv.FormatUint(uint64(files[0].ID), 10)),
+		filepath.Join(dir, "failed", "u_ex231010.log-"+strconv.FormatUint(uint64(files[1].ID), 10)),
+	}
+	for i, content := range []string{first, second} {
+		if files[i].SourcePath != expectedPaths[i] {
+			t.Fatalf("expected file %d to be moved to %s, got %s", files[i].ID, expectedPaths[i], files[i].SourcePath)
+		}
+		assertFileContent(t, expectedPaths[i], content)
+	}
+}
+
+func TestDropFolderWaitsForStableSecs(t *testing.T) {
+	dbPool, domainId, cleanup := setupTestDomain(t)
+	defer cleanup()
+
+	dir := t.TempDir()
+	w := processor.NewDropFolderWatcher(dbPool, config.DropFolder{
+		Path:       dir,
+		StableSecs: 3600,
+		Rules:      []config.DropFolderRule{{Pattern: "*.log", DomainID: domainId}},
+	})
+	appendToFile(t, filepath.Join(dir, "u_ex231010.log"), followHeader+followLine(0, "/a"))
+
+	scanDropFolder(t, w)
+	scanDropFolder(t, w)
+	if files := droppedFiles(t, dbPool, domainId); len(files) != 0 {
+		t.Fatalf("expected the file to wait for %d seconds, got %+v", 3600, files)
+	}
+}
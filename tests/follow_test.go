@@ -0,0 +1,279 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"iis-logs-parser/models"
+	"iis-logs-parser/processor"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const followHeader = "#Fields: date time s-ip cs-method cs-uri-stem cs-uri-query s-port cs-username c-ip cs(User-Agent) sc-status sc-substatus sc-win32-status time-taken\n"
+
+// followLine returns a log line requesting uri, along with its line terminator
+func followLine(second int, uri string) string {
+	return fmt.Sprintf("2023-10-10 12:00:%02d 192.168.1.1 GET %s - 80 - 192.168.1.100 Mozilla/5.0 200 0 0 123\n", second, uri)
+}
+
+// followedFile is a log file created by a follower, its size is the offset right after its last ingested line
+type followedFile struct {
+	Name    string
+	Size    int64
+	Status  models.Status
+	Entries []string // "<line number> <uri stem>" of its entries, in line order
+}
+
+// assertFollowedFiles checks the files followed for the domain, in creation order
+func assertFollowedFiles(t *testing.T, dbPool *pgxpool.Pool, domainId uint, expected []followedFile) {
+	t.Helper()
+	ctx := context.Background()
+	rows, err := dbPool.Query(ctx,
+		"SELECT id, name, size, status FROM log_files WHERE domain_id = $1 AND status IN ($2, $3) ORDER BY id",
+		domainId, models.StatusFollowing, models.StatusCompleted,
+	)
+	if err != nil {
+		t.Fatalf("failed to get followed files: %v", err)
+	}
+	var ids []uint
+	var files []followedFile
+	var id uint
+	var file followedFile
+	_, err = pgx.ForEachRow(rows, []any{&id, &file.Name, &file.Size, &file.Status}, func() error {
+		ids = append(ids, id)
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to get followed files: %v", err)
+	}
+
+	for i := range files {
+		rows, err := dbPool.Query(ctx, "SELECT line_number || ' ' || uri_stem FROM log_entries_resolved WHERE log_file_id = $1 ORDER BY line_number", ids[i])
+		if err != nil {
+			t.Fatalf("failed to get entries: %v", err)
+		}
+		if files[i].Entries, err = pgx.CollectRows(rows, pgx.RowTo[string]); err != nil {
+			t.Fatalf("failed to get entries: %v", err)
+		}
+	}
+
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("expected followed files %+v, got %+v", expected, files)
+	}
+}
+
+func appendToFile(t *testing.T, path string, content string) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pollFollower(t *testing.T, f *processor.Follower) {
+	t.Helper()
+	if err := f.Poll(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestFollowAppendedLines(t *testing.T) {
+	dbPool, domainId, cleanup := setupTestDomain(t)
+	defer cleanup()
+
+	path := filepath.Join(t.TempDir(), "u_ex231010.log")
+	lineB := followLine(1, "/b")
+	appendToFile(t, path, followHeader+followLine(0, "/a")+lineB[:20])
+
+	f := processor.NewFollower(dbPool, domainId, path)
+	pollFollower(t, f)
+	// The line being written isn't ingested yet
+	size := int64(len(followHeader + followLine(0, "/a")))
+	assertFollowedFiles(t, dbPool, domainId, []followedFile{
+		{Name: "u_ex231010.log", Size: size, Status: models.StatusFollowing, Entries: []string{"2 /a"}},
+	})
+
+	appendToFile(t, path, lineB[20:]+followLine(2, "/c"))
+	pollFollower(t, f)
+	size += int64(len(lineB + followLine(2, "/c")))
+	assertFollowedFiles(t, dbPool, domainId, []followedFile{
+		{Name: "u_ex231010.log", Size: size, Status: models.StatusFollowing, Entries: []string{"2 /a", "3 /b", "4 /c"}},
+	})
+
+	// Nothing new
+	pollFollower(t, f)
+	assertFollowedFiles(t, dbPool, domainId, []followedFile{
+		{Name: "u_ex231010.log", Size: size, Status: models.StatusFollowing, Entries: []string{"2 /a", "3 /b", "4 /c"}},
+	})
+}
+
+func TestFollowRollover(t *testing.T) {
+	dbPool, domainId, cleanup := setupTestDomain(t)
+	defer cleanup()
+
+	dir := t.TempDir()
+	lineB := followLine(1, "/b")
+	// IIS was still writing the last line
+	first := followHeader + followLine(0, "/a") + lineB[:len(lineB)-1]
+	appendToFile(t, filepath.Join(dir, "u_ex231010.log"), first)
+
+	f := processor.NewFollower(dbPool, domainId, dir)
+	pollFollower(t, f)
+	assertFollowedFiles(t, dbPool, domainId, []followedFile{
+		{Name: "u_ex231010.log", Size: int64(len(followHeader + followLine(0, "/a"))), Status: models.StatusFollowing, Entries: []string{"2 /a"}},
+	})
+
+	// Once the next file is created the last line of the previous one is complete, even without a newline
+	second := followHeader + followLine(2, "/c")
+	appendToFile(t, filepath.Join(dir, "u_ex231011.log"), second)
+	pollFollower(t, f)
+	assertFollowedFiles(t, dbPool, domainId, []followedFile{
+		{Name: "u_ex231010.log", Size: int64(len(first)), Status: models.StatusCompleted, Entries: []string{"2 /a", "3 /b"}},
+		{Name: "u_ex231011.log", Size: 0, Status: models.StatusFollowing, Entries: []string{}},
+	})
+
+	pollFollower(t, f)
+	assertFollowedFiles(t, dbPool, domainId, []followedFile{
+		{Name: "u_ex231010.log", Size: int64(len(first)), Status: models.StatusCompleted, Entries: []string{"2 /a", "3 /b"}},
+		{Name: "u_ex231011.log", Size: int64(len(second)), Status: models.StatusFollowing, Entries: []string{"2 /c"}},
+	})
+}
+
+func TestFollowTruncatedFile(t *testing.T) {
+	dbPool, domainId, cleanup := setupTestDomain(t)
+	defer cleanup()
+
+	path := filepath.Join(t.TempDir(), "u_ex231010.log")
+	before := followHeader + followLine(0, "/a") + followLine(1, "/b")
+	appendToFile(t, path, before)
+
+	f := processor.NewFollower(dbPool, domainId, path)
+	pollFollower(t, f)
+	assertFollowedFiles(t, dbPool, domainId, []followedFile{
+		{Name: "u_ex231010.log", Size: int64(len(before)), Status: models.StatusFollowing, Entries: []string{"2 /a", "3 /b"}},
+	})
+
+	// Truncated then rewritten with less than what was ingested: the file starts over as a new log file
+	after := followHeader + followLine(2, "/c")
+	if err := os.WriteFile(path, []byte(after), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pollFollower(t, f)
+	pollFollower(t, f)
+	assertFollowedFiles(t, dbPool, domainId, []followedFile{
+		{Name: "u_ex231010.log", Size: int64(len(before)), Status: models.StatusCompleted, Entries: []string{"2 /a", "3 /b"}},
+		{Name: "u_ex231010.log", Size: int64(len(after)), Status: models.StatusFollowing, Entries: []string{"2 /c"}},
+	})
+}
+
+func TestFollowResumeFromSavedOffset(t *testing.T) {
+	dbPool, domainId, cleanup := setupTestDomain(t)
+	defer cleanup()
+
+	path := filepath.Join(t.TempDir(), "u_ex231010.log")
+	before := followHeader + followLine(0, "/a") + followLine(1, "/b")
+	appendToFile(t, path, before)
+
+	pollFollower(t, processor.NewFollower(dbPool, domainId, path))
+	assertFollowedFiles(t, dbPool, domainId, []followedFile{
+		{Name: "u_ex231010.log", Size: int64(len(before)), Status: models.StatusFollowing, Entries: []string{"2 /a", "3 /b"}},
+	})
+
+	// Lines appended while stopped are ingested by the next follower, the ones before aren't ingested twice
+	appendToFile(t, path, followLine(2, "/c"))
+	pollFollower(t, processor.NewFollower(dbPool, domainId, path))
+	assertFollowedFiles(t, dbPool, domainId, []followedFile{
+		{Name: "u_ex231010.log", Size: int64(len(before + followLine(2, "/c"))), Status: models.StatusFollowing, Entries: []string{"2 /a", "3 /b", "4 /c"}},
+	})
+}
+
+func TestFollowStopsOnDeletedFile(t *testing.T) {
+	dbPool, domainId, cleanup := setupTestDomain(t)
+	defer cleanup()
+
+	path := filepath.Join(t.TempDir(), "u_ex231010.log")
+	before := followHeader + followLine(0, "/a")
+	appendToFile(t, path, before)
+
+	f := processor.NewFollower(dbPool, domainId, path)
+	pollFollower(t, f)
+	_, err := dbPool.Exec(context.Background(), "UPDATE log_files SET status = $1 WHERE domain_id = $2 AND status = $3",
+		models.StatusDeleting, domainId, models.StatusFollowing,
+	)
+	if err != nil {
+		t.Fatalf("failed to delete followed file: %v", err)
+	}
+
+	// Deleted while being followed: nothing more is ingested and it stays deleting
+	appendToFile(t, path, followLine(1, "/b"))
+	if err := f.Poll(context.Background()); !errors.Is(err, processor.ErrFollowedFileDeleted) {
+		t.Fatalf("expected %v, got %v", processor.ErrFollowedFileDeleted, err)
+	}
+	var status models.Status
+	var size int64
+	var entries int
+	err = dbPool.QueryRow(context.Background(),
+		"SELECT f.status, f.size, (SELECT COUNT(*) FROM log_entries e WHERE e.log_file_id = f.id) FROM log_files f WHERE f.domain_id = $1 AND f.name = 'u_ex231010.log'",
+		domainId,
+	).Scan(&status, &size, &entries)
+	if err != nil {
+		t.Fatalf("failed to get followed file: %v", err)
+	}
+	if status != models.StatusDeleting || size != int64(len(before)) || entries != 1 {
+		t.Fatalf("expected the file to stay deleting with its first entry only, got %s, size %d, %d entries", status, size, entries)
+	}
+}
+
+func TestResolveFollowPath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "web01"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	appendToFile(t, filepath.Join(outside, "u_ex231010.log"), followHeader)
+	if err := os.Symlink(outside, filepath.Join(root, "other")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "web01"), filepath.Join(root, "current")); err != nil {
+		t.Fatal(err)
+	}
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		path     string
+		resolved string // empty when the path is rejected
+	}{
+		{"web01", filepath.Join(resolvedRoot, "web01")},
+		{"current", filepath.Join(resolvedRoot, "web01")}, // symlinks within the root are followed
+		{"other", ""},
+		{"other/u_ex231010.log", ""},
+		{"../" + filepath.Base(outside), ""},
+		{"missing", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			resolved, err := processor.ResolveFollowPath(root, tc.path)
+			if tc.resolved == "" && err == nil {
+				t.Fatalf("expected %q to be rejected, got %s", tc.path, resolved)
+			}
+			if tc.resolved != "" && (err != nil || resolved != tc.resolved) {
+				t.Fatalf("expected %s, got %s, %v", tc.resolved, resolved, err)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"reflect"
 	"testing"
 
 	db "iis-logs-parser/database"
@@ -14,6 +15,7 @@ import (
 	"iis-logs-parser/utils"
 
 	pgxZerolog "github.com/jackc/pgx-zerolog"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/jackc/pgx/v5/tracelog"
@@ -34,8 +36,9 @@ func (w Writer) Printf(format string, args ...interface{}) {
 	w.Logger.Debug().Msgf(format, args...)
 }
 
-// setupTestDB creates a test database connection and returns cleanup function
-func setupTestDB() (*pgxpool.Pool, func()) {
+// setupTestDB connects to the test database, applies the migrations and creates a log file to insert the entries into.
+// Returns its id and a cleanup function deleting it.
+func setupTestDB() (*pgxpool.Pool, uint, func()) {
 
 	dbConfig := &db.DBConfig{
 		Host:     "localhost",
@@ -65,14 +68,53 @@ func setupTestDB() (*pgxpool.Pool, func()) {
 		}
 	}
 
+	if _, err := db.MigrateUp(context.Background(), dbPool); err != nil {
+		log.Fatal().Err(err).Msg("Failed to migrate test database")
+	}
+
+	// The entries belong to a log file, which belongs to a domain and a user
+	var logFileId uint
+	err = dbPool.QueryRow(context.Background(),
+		`WITH u AS (
+			INSERT INTO users (created_at, updated_at, email, password) VALUES (now(), now(), 'test-' || gen_random_uuid() || '@example.com', '') RETURNING id
+		), d AS (
+			INSERT INTO domains (created_at, updated_at, user_id, domain_name) SELECT now(), now(), id, 'test.example.com' FROM u RETURNING id
+		)
+		INSERT INTO log_files (created_at, updated_at, domain_id, name, size, status) SELECT now(), now(), id, 'test.log', 0, $1 FROM d RETURNING id`,
+		models.StatusProcessing,
+	).Scan(&logFileId)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to create test log file")
+	}
+
+	// Deleting the log file cascades to its entries and rollups
 	cleanup := func() {
-		dbPool.Exec(context.Background(), "DROP TABLE IF EXISTS log_entries")
+		dbPool.Exec(context.Background(),
+			`WITH f AS (
+				DELETE FROM log_files WHERE id = $1 RETURNING domain_id
+			), d AS (
+				DELETE FROM domains WHERE id IN (SELECT domain_id FROM f) RETURNING user_id
+			)
+			DELETE FROM users WHERE id IN (SELECT user_id FROM d)`,
+			logFileId,
+		)
 	}
-	cleanup()
 
-	dbPool.Exec(context.Background(), "CREATE TABLE IF NOT EXISTS log_entries (ID INT GENERATED ALWAYS AS IDENTITY PRIMARY KEY,date DATE, time TIME, server_ip TEXT, method TEXT, uri_stem TEXT, uri_query TEXT, port TEXT, username TEXT, client_ip TEXT, user_agent TEXT, status TEXT, sub_status TEXT, win32_status TEXT, time_taken TEXT)")
+	return dbPool, logFileId, cleanup
+}
 
-	return dbPool, cleanup
+// setupTestDomain returns the domain of the test log file, and a cleanup function deleting it along with the log files created for it
+func setupTestDomain(t *testing.T) (*pgxpool.Pool, uint, func()) {
+	dbPool, logFileId, cleanup := setupTestDB()
+	var domainId uint
+	if err := dbPool.QueryRow(context.Background(), "SELECT domain_id FROM log_files WHERE id = $1", logFileId).Scan(&domainId); err != nil {
+		t.Fatalf("failed to get test domain: %v", err)
+	}
+	return dbPool, domainId, func() {
+		dbPool.Exec(context.Background(), "DELETE FROM log_files WHERE domain_id = $1 AND id <> $2", domainId, logFileId)
+		cleanup()
+		dbPool.Close()
+	}
 }
 
 // Helper function to create test log file
@@ -95,13 +137,13 @@ func createTestLogFile(t testing.TB, content string) (string, func()) {
 	}
 }
 
-func testProcessLogFileBase(t *testing.T, db *pgxpool.Pool, dbInsertionT string) []*models.LogEntry {
+func testProcessLogFileBase(t *testing.T, db *pgxpool.Pool, dbInsertionT string, logFileId uint) []*models.LogEntry {
 	testCase := GetProcessLogFileTC1()
 
 	fileName, cleanup := createTestLogFile(t, testCase.logFileContent)
 	defer cleanup()
 
-	duration, startTS, endTS, err := processor.ProcessLogFile(fileName, 2, db, dbInsertionT, 0)
+	duration, startTS, endTS, err := processor.ProcessLogFile(fileName, 2, db, dbInsertionT, logFileId)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -160,12 +202,12 @@ func testProcessLogFileBase(t *testing.T, db *pgxpool.Pool, dbInsertionT string)
 }
 
 func testProcessLogFileBaseWithDB(t *testing.T, dbInsertionT string) {
-	testDBPool, _ := setupTestDB()
-	// defer cleanup()
-	expected := testProcessLogFileBase(t, testDBPool, dbInsertionT)
+	testDBPool, logFileId, cleanup := setupTestDB()
+	defer cleanup()
+	expected := testProcessLogFileBase(t, testDBPool, dbInsertionT, logFileId)
 
 	var count int64
-	testDBPool.QueryRow(context.Background(), "SELECT COUNT(*) FROM log_entries").Scan(&count)
+	testDBPool.QueryRow(context.Background(), "SELECT COUNT(*) FROM log_entries WHERE log_file_id = $1", logFileId).Scan(&count)
 
 	if count != int64(len(expected)) {
 		t.Fatalf("expected %d entries in DB, got %d", len(expected), count)
@@ -173,14 +215,29 @@ func testProcessLogFileBaseWithDB(t *testing.T, dbInsertionT string) {
 
 	for i, entry := range expected {
 		var count int64
-		testDBPool.QueryRow(context.Background(), "SELECT COUNT(*) FROM log_entries WHERE date = $1 AND time = $2 AND server_ip = $3 AND method = $4 AND uri_stem = $5 AND uri_query = $6 AND port = $7 AND username = $8 AND client_ip = $9 AND user_agent = $10 AND status = $11 AND sub_status = $12 AND win32_status = $13 AND time_taken = $14",
-			entry.Date, entry.Time, entry.ServerIP, entry.Method, entry.URIStem, entry.URIQuery, entry.Port, entry.Username, entry.ClientIP, entry.UserAgent, entry.Status, entry.SubStatus, entry.Win32Status, entry.TimeTaken).Scan(&count)
+		testDBPool.QueryRow(context.Background(), "SELECT COUNT(*) FROM log_entries_resolved WHERE log_file_id = $15 AND date = $1 AND time = $2 AND server_ip = $3 AND method = $4 AND uri_stem = $5 AND uri_query = $6 AND port = $7 AND username = $8 AND client_ip = $9 AND user_agent = $10 AND status = $11 AND sub_status = $12 AND win32_status = $13 AND time_taken = $14",
+			entry.Date, entry.Time, entry.ServerIP, entry.Method, entry.URIStem, entry.URIQuery, entry.Port, entry.Username, entry.ClientIP, entry.UserAgent, entry.Status, entry.SubStatus, entry.Win32Status, entry.TimeTaken, logFileId).Scan(&count)
 
 		if count != 1 {
 			t.Fatalf("expected 1 entry in DB for entry %d, got %d", i, count)
 		}
 	}
 
+	// The entries give back the position of their line in the source file
+	rows, err := testDBPool.Query(context.Background(), "SELECT line_number, byte_offset FROM log_entries WHERE log_file_id = $1 ORDER BY line_number", logFileId)
+	if err != nil {
+		t.Fatalf("failed to query entry positions: %v", err)
+	}
+	positions, err := pgx.CollectRows(rows, pgx.RowToStructByPos[struct{ LineNumber, ByteOffset int64 }])
+	if err != nil {
+		t.Fatalf("failed to query entry positions: %v", err)
+	}
+	for i, entry := range expected {
+		if positions[i].LineNumber != entry.LineNumber || positions[i].ByteOffset != entry.ByteOffset {
+			t.Fatalf("expected entry %d at line %d offset %d, got line %d offset %d", i, entry.LineNumber, entry.ByteOffset, positions[i].LineNumber, positions[i].ByteOffset)
+		}
+	}
+
 	testDBPool.Close()
 }
 
@@ -193,14 +250,38 @@ func TestParseLogLine(t *testing.T) {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	if *entry != *expected {
+	if !reflect.DeepEqual(entry, expected) {
 		t.Fatalf("expected %+v, got %+v", expected, entry)
 	}
 }
 
+func TestParseLogLineUnsupportedFields(t *testing.T) {
+	_, err := parser.ParseLogLine("#Fields: date time s-ip cs-method cs-uri-stem")
+	if !errors.Is(err, parser.ErrUnsupportedFields) {
+		t.Fatalf("expected %v, got %v", parser.ErrUnsupportedFields, err)
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := db.LoadMigrations()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatalf("expected embedded migrations")
+	}
+	for i, m := range migrations {
+		if i > 0 && m.Version <= migrations[i-1].Version {
+			t.Fatalf("expected migrations in version order, got %d after %d", m.Version, migrations[i-1].Version)
+		}
+		if m.Down == "" {
+			t.Fatalf("expected migration %d_%s to have a down file", m.Version, m.Name)
+		}
+	}
+}
+
 func TestProcessLogFileNoDB(t *testing.T) {
-	// calculating the duration of the process, start and end timestamps not handled for no db combiner
-	testProcessLogFileBase(t, nil, "none")
+	testProcessLogFileBase(t, nil, "none", 0)
 }
 
 func TestProcessLogFileBatchDBInsert(t *testing.T) {
@@ -228,18 +309,74 @@ func BenchmarkProcessLogFile(b *testing.B) {
 	}
 
 	for _, c := range cases {
-		// Run a sub-benchmark for each case
-		b.Run(c.name, func(b *testing.B) {
-			testDB, cleanup := setupTestDB()
-			defer cleanup()
-
-			b.ResetTimer()
-			for i := 0; i < b.N; i++ {
-				_, _, _, err := processor.ProcessLogFile(c.file, 8, testDB, c.dbInsertionT, 0)
-				if err != nil {
-					b.Fatalf("unexpected error: %v", err)
+		// Run a sub-benchmark for each case, with and without the partition indexes to compare their insertion cost
+		for _, indexes := range []bool{true, false} {
+			name := c.name + "-indexes"
+			if !indexes {
+				name = c.name + "-no-indexes"
+			}
+			b.Run(name, func(b *testing.B) {
+				testDB, logFileId, cleanup := setupTestDB()
+				defer cleanup()
+				setEntryIndexes(b, testDB, indexes)
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_, _, _, err := processor.ProcessLogFile(c.file, 8, testDB, c.dbInsertionT, logFileId)
+					if err != nil {
+						b.Fatalf("unexpected error: %v", err)
+					}
 				}
+				b.StopTimer()
+				reportStorage(b, testDB)
+			})
+		}
+	}
+}
+
+// setEntryIndexes builds the partition indexes, or drops them and defers those of the new partitions.
+// Dropped indexes are built again by the indexes job.
+func setEntryIndexes(b *testing.B, testDB *pgxpool.Pool, enabled bool) {
+	ctx := context.Background()
+	if enabled {
+		if err := processor.BuildEntryIndexes(ctx, testDB); err != nil {
+			b.Fatalf("failed to build indexes: %v", err)
+		}
+		return
+	}
+
+	b.Setenv("ENTRY_INDEXES_MODE", "deferred")
+	rows, err := testDB.Query(ctx, "SELECT inhrelid::regclass::text FROM pg_inherits WHERE inhparent = 'log_entries'::regclass")
+	if err != nil {
+		b.Fatalf("failed to list partitions: %v", err)
+	}
+	partitions, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		b.Fatalf("failed to list partitions: %v", err)
+	}
+	for _, partition := range partitions {
+		for _, index := range db.EntryIndexes {
+			if _, err := testDB.Exec(ctx, "DROP INDEX IF EXISTS "+index.Name(partition)); err != nil {
+				b.Fatalf("failed to drop index: %v", err)
 			}
-		})
+		}
+	}
+}
+
+// reportStorage reports the disk space taken per entry by log_entries, its partitions and lookup tables
+func reportStorage(b *testing.B, testDB *pgxpool.Pool) {
+	var entries, bytes int64
+	err := testDB.QueryRow(context.Background(),
+		`SELECT (SELECT COUNT(*) FROM log_entries), COALESCE(SUM(pg_total_relation_size(t.oid)), 0)
+		FROM (
+			SELECT to_regclass(name) AS oid FROM unnest(ARRAY['log_entries', 'server_ips', 'uri_stems', 'user_agents']) AS name
+			UNION ALL
+			SELECT inhrelid FROM pg_inherits WHERE inhparent = 'log_entries'::regclass
+		) t WHERE t.oid IS NOT NULL`,
+	).Scan(&entries, &bytes)
+	if err != nil || entries == 0 {
+		b.Logf("couldn't measure storage: %v", err)
+		return
 	}
+	b.ReportMetric(float64(bytes)/float64(entries), "bytes/entry")
 }
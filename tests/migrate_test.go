@@ -0,0 +1,238 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	db "iis-logs-parser/database"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// baselineSchemaSQL creates the tables as AutoMigrate did before the migrations, along with a few entries.
+// The last entry has no valid date and time.
+const baselineSchemaSQL = `
+CREATE TABLE users (
+	id bigserial PRIMARY KEY, created_at timestamptz, updated_at timestamptz, deleted_at timestamptz,
+	email text, password text NOT NULL, first_name text, last_name text, job_title text, organization text,
+	phone_number text, role text, last_login_at timestamptz, verified boolean,
+	CONSTRAINT uni_users_email UNIQUE (email)
+);
+CREATE INDEX idx_users_deleted_at ON users (deleted_at);
+
+CREATE TABLE domains (
+	id bigserial PRIMARY KEY, created_at timestamptz, updated_at timestamptz, deleted_at timestamptz,
+	user_id bigint NOT NULL, domain_name varchar(255) NOT NULL, description text, is_active boolean DEFAULT true,
+	business_field varchar(255), business_sector varchar(255), is_subdomain boolean DEFAULT false, "default" boolean DEFAULT false,
+	CONSTRAINT fk_users_domains FOREIGN KEY (user_id) REFERENCES users (id)
+);
+CREATE INDEX idx_domains_deleted_at ON domains (deleted_at);
+
+CREATE TABLE log_files (
+	id bigserial PRIMARY KEY, created_at timestamptz, updated_at timestamptz, deleted_at timestamptz,
+	domain_id bigint NOT NULL, name varchar(255) NOT NULL, size bigint NOT NULL, status varchar(20) NOT NULL,
+	start_timestamp timestamp, end_timestamp timestamp, parsing_time bigint,
+	CONSTRAINT fk_domains_log_files FOREIGN KEY (domain_id) REFERENCES domains (id)
+);
+CREATE INDEX idx_log_files_deleted_at ON log_files (deleted_at);
+
+CREATE TABLE log_entries (
+	id bigserial PRIMARY KEY, created_at timestamptz, updated_at timestamptz, deleted_at timestamptz,
+	log_file_id bigint, date text, time text, server_ip text, method text, uri_stem text, uri_query text, port text,
+	username text, client_ip text, user_agent text, status text, sub_status text, win32_status text, time_taken text,
+	CONSTRAINT fk_log_files_log_entries FOREIGN KEY (log_file_id) REFERENCES log_files (id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+CREATE INDEX idx_log_entries_deleted_at ON log_entries (deleted_at);
+
+INSERT INTO users (created_at, email, password) VALUES (now(), 'baseline@example.com', '');
+INSERT INTO domains (created_at, user_id, domain_name) VALUES (now(), 1, 'baseline.example.com');
+INSERT INTO log_files (created_at, domain_id, name, size, status) VALUES (now(), 1, 'u_ex231010.log', 1024, 'completed');
+INSERT INTO log_entries (created_at, log_file_id, date, time, server_ip, method, uri_stem, user_agent, status) VALUES
+	('2023-10-10 12:05:00', 1, '2023-10-10', '12:00:00', '192.168.1.1', 'GET', '/index.html', 'Mozilla/5.0', '200'),
+	('2023-10-31 23:59:59', 1, '2023-10-31', '23:59:59', '192.168.1.1', 'GET', '/about.html', 'Mozilla/5.0', '200'),
+	('2023-11-01 00:00:01', 1, '2023-11-01', '00:00:00', '192.168.1.2', 'POST', '/index.html', NULL, '404'),
+	('2023-11-20 10:00:00', 1, '-', '-', '192.168.1.1', 'GET', '/index.html', 'Mozilla/5.0', '200');
+`
+
+// setupBaselineSchema creates a schema holding the baseline tables, and returns a pool using it.
+// The cleanup function drops the schema.
+func setupBaselineSchema(t *testing.T, testDB *pgxpool.Pool) (*pgxpool.Pool, func()) {
+	t.Helper()
+	ctx := context.Background()
+	schema := fmt.Sprintf("baseline_test_%d", time.Now().UnixNano())
+	if _, err := testDB.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	cleanup := func() { testDB.Exec(context.Background(), "DROP SCHEMA "+schema+" CASCADE") }
+
+	// The extensions of the test database are in public
+	pgxConfig := testDB.Config()
+	pgxConfig.ConnConfig.RuntimeParams["search_path"] = schema + ", public"
+	dbPool, err := pgxpool.NewWithConfig(ctx, pgxConfig)
+	if err != nil {
+		cleanup()
+		t.Fatalf("failed to connect: %v", err)
+	}
+	if _, err := dbPool.Exec(ctx, baselineSchemaSQL); err != nil {
+		dbPool.Close()
+		cleanup()
+		t.Fatalf("failed to create baseline schema: %v", err)
+	}
+	return dbPool, func() {
+		dbPool.Close()
+		cleanup()
+	}
+}
+
+func TestMigrateBaselineDatabase(t *testing.T) {
+	testDB, _, cleanup := setupTestDB()
+	defer testDB.Close()
+	defer cleanup()
+	dbPool, dropSchema := setupBaselineSchema(t, testDB)
+	defer dropSchema()
+	t.Setenv("PARTITION_INTERVAL", "month")
+
+	ctx := context.Background()
+	if _, err := db.MigrateUp(ctx, dbPool); err != nil {
+		t.Fatalf("failed to migrate baseline schema: %v", err)
+	}
+
+	var relkind string
+	if err := dbPool.QueryRow(ctx, "SELECT relkind::text FROM pg_class WHERE oid = 'log_entries'::regclass").Scan(&relkind); err != nil {
+		t.Fatalf("failed to get log_entries: %v", err)
+	}
+	if relkind != "p" {
+		t.Fatalf("expected log_entries to be partitioned, got relkind %s", relkind)
+	}
+	rows, err := dbPool.Query(ctx, "SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid WHERE i.inhparent = 'log_entries'::regclass ORDER BY 1")
+	if err != nil {
+		t.Fatalf("failed to get partitions: %v", err)
+	}
+	partitions, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		t.Fatalf("failed to get partitions: %v", err)
+	}
+	if expected := []string{"log_entries_p20231001", "log_entries_p20231101"}; !reflect.DeepEqual(partitions, expected) {
+		t.Fatalf("expected partitions %v, got %v", expected, partitions)
+	}
+
+	type entry struct {
+		ID        int64
+		Timestamp time.Time
+		ServerIP  *string
+		URIStem   *string
+		UserAgent *string
+	}
+	rows, err = dbPool.Query(ctx, "SELECT id, timestamp, server_ip, uri_stem, user_agent FROM log_entries_resolved ORDER BY id")
+	if err != nil {
+		t.Fatalf("failed to get entries: %v", err)
+	}
+	entries, err := pgx.CollectRows(rows, pgx.RowToStructByPos[entry])
+	if err != nil {
+		t.Fatalf("failed to get entries: %v", err)
+	}
+	value := func(s string) *string { return &s }
+	expected := []entry{
+		{1, time.Date(2023, 10, 10, 12, 0, 0, 0, time.UTC), value("192.168.1.1"), value("/index.html"), value("Mozilla/5.0")},
+		{2, time.Date(2023, 10, 31, 23, 59, 59, 0, time.UTC), value("192.168.1.1"), value("/about.html"), value("Mozilla/5.0")},
+		{3, time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC), value("192.168.1.2"), value("/index.html"), nil},
+		// Falls back to when it was inserted
+		{4, time.Date(2023, 11, 20, 10, 0, 0, 0, time.UTC), value("192.168.1.1"), value("/index.html"), value("Mozilla/5.0")},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("expected entries %+v, got %+v", expected, entries)
+	}
+
+	// Each value is stored once
+	var serverIPs, uriStems, userAgents int
+	err = dbPool.QueryRow(ctx, "SELECT (SELECT COUNT(*) FROM server_ips), (SELECT COUNT(*) FROM uri_stems), (SELECT COUNT(*) FROM user_agents)").
+		Scan(&serverIPs, &uriStems, &userAgents)
+	if err != nil {
+		t.Fatalf("failed to count dictionary values: %v", err)
+	}
+	if serverIPs != 2 || uriStems != 2 || userAgents != 1 {
+		t.Fatalf("expected 2 server IPs, 2 URI stems and 1 user agent, got %d, %d and %d", serverIPs, uriStems, userAgents)
+	}
+
+	// The columns added since the baseline are there for the later migrations
+	var attempts, logFileEntries int64
+	if err := dbPool.QueryRow(ctx, "SELECT attempts, entries FROM log_files WHERE id = 1").Scan(&attempts, &logFileEntries); err != nil {
+		t.Fatalf("failed to get log file: %v", err)
+	}
+	if attempts != 0 || logFileEntries != 4 {
+		t.Fatalf("expected 0 attempts and 4 entries, got %d and %d", attempts, logFileEntries)
+	}
+
+	// New entries are numbered after the converted ones
+	var id int64
+	err = dbPool.QueryRow(ctx, "INSERT INTO log_entries (log_file_id, timestamp) VALUES (1, '2023-10-11 00:00:00') RETURNING id").Scan(&id)
+	if err != nil {
+		t.Fatalf("failed to insert entry: %v", err)
+	}
+	if id != 5 {
+		t.Fatalf("expected id 5, got %d", id)
+	}
+}
+
+func TestGetMigrationStatusReadOnly(t *testing.T) {
+	testDB, _, cleanup := setupTestDB()
+	defer testDB.Close()
+	defer cleanup()
+	ctx := context.Background()
+
+	// An empty schema, without the schema_migrations table of public
+	schema := fmt.Sprintf("status_test_%d", time.Now().UnixNano())
+	if _, err := testDB.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	defer testDB.Exec(context.Background(), "DROP SCHEMA "+schema+" CASCADE")
+	pgxConfig := testDB.Config()
+	pgxConfig.ConnConfig.RuntimeParams["search_path"] = schema
+	dbPool, err := pgxpool.NewWithConfig(ctx, pgxConfig)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer dbPool.Close()
+
+	// A migration in progress doesn't delay the status
+	lockConn, err := testDB.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire connection: %v", err)
+	}
+	defer lockConn.Release()
+	if _, err := lockConn.Exec(ctx, "SELECT pg_advisory_lock(hashtext($1))", db.MigrationsLockKey); err != nil {
+		t.Fatalf("failed to take migrations lock: %v", err)
+	}
+	defer lockConn.Exec(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", db.MigrationsLockKey)
+
+	statusCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	statuses, err := db.GetMigrationStatus(statusCtx, dbPool)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	migrations, err := db.LoadMigrations()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(statuses) != len(migrations) {
+		t.Fatalf("expected %d migrations, got %d", len(migrations), len(statuses))
+	}
+	for _, status := range statuses {
+		if status.AppliedAt != nil || status.Missing {
+			t.Errorf("expected migration %d_%s to be pending, got %+v", status.Version, status.Name, status)
+		}
+	}
+
+	var exists bool
+	if err := dbPool.QueryRow(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists); err != nil {
+		t.Fatalf("failed to get schema_migrations: %v", err)
+	}
+	if exists {
+		t.Errorf("expected schema_migrations not to be created")
+	}
+}
@@ -0,0 +1,284 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"iis-logs-parser/models"
+	"iis-logs-parser/parser"
+	"iis-logs-parser/processor"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestIsTransientError(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"nil", nil, false},
+		{"deadline exceeded", context.DeadlineExceeded, true},
+		{"connection failure", &pgconn.PgError{Code: "08006"}, true},
+		{"too many connections", &pgconn.PgError{Code: "53300"}, true},
+		{"deadlock", &pgconn.PgError{Code: "40P01"}, true},
+		{"lock timeout", fmt.Errorf("batch insertion: %w", &pgconn.PgError{Code: "55P03"}), true},
+		{"undefined column", &pgconn.PgError{Code: "42703"}, false},
+		{"unsupported fields", fmt.Errorf("line 4: %w", parser.ErrUnsupportedFields), false},
+		{"missing file", fmt.Errorf("failed to open file: %w", os.ErrNotExist), false},
+		{"other", errors.New("something else"), false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := processor.IsTransientError(tc.err); actual != tc.expected {
+				t.Errorf("expected %v but got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	expected := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute}
+	for i, delay := range expected {
+		if actual := processor.RetryBackoff(i + 1); actual != delay {
+			t.Errorf("attempt %d: expected %v but got %v", i+1, delay, actual)
+		}
+	}
+
+	if actual := processor.RetryBackoff(100); actual != time.Hour {
+		t.Errorf("expected backoff to be capped to %v but got %v", time.Hour, actual)
+	}
+}
+
+func TestProcessLogReaderStats(t *testing.T) {
+	content := parser.FIELDS_DEF + `
+2023-10-10 12:00:00 192.168.1.1 GET /index.html - 80 - 192.168.1.100 Mozilla/5.0 200 0 0 123
+2023-10-10 12:00:00 192.168.1.1 GET /index.html - 80 - 192.168.1.100 Mozilla/5.0 200 0 0 123
+not a log line
+2023-10-10 12:00:01 192.168.1.1 GET /about.html - 80 - 192.168.1.101 Mozilla/5.0 404 0 0 456
+`
+	outputFile := filepath.Join(t.TempDir(), "parsed_logs.txt")
+
+	metrics, err := processor.ProcessLogReader(context.Background(), strings.NewReader(content), outputFile, 2, nil, "none", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if metrics.LinesRead != 5 {
+		t.Errorf("expected 5 lines read, got %d", metrics.LinesRead)
+	}
+	if metrics.BytesRead != int64(len(content)) {
+		t.Errorf("expected %d bytes read, got %d", len(content), metrics.BytesRead)
+	}
+	if metrics.RejectedLines != 1 {
+		t.Errorf("expected 1 rejected line, got %d", metrics.RejectedLines)
+	}
+	if metrics.DuplicateLines != 1 || metrics.DuplicateLinesApproximate {
+		t.Errorf("expected exactly 1 duplicate line, got %d (approximate: %v)", metrics.DuplicateLines, metrics.DuplicateLinesApproximate)
+	}
+
+	summary := metrics.Summary()
+	expected := &models.LogFileSummary{
+		Entries:      3,
+		StatusCodes:  map[string]int64{"200": 2, "404": 1},
+		Methods:      map[string]int64{"GET": 3},
+		TopURIStems:  []models.ValueCount{{Value: "/index.html", Count: 2}, {Value: "/about.html", Count: 1}},
+		TopClientIPs: []models.ValueCount{{Value: "192.168.1.100", Count: 2}, {Value: "192.168.1.101", Count: 1}},
+		ClientErrors: 1,
+		ErrorRate:    1.0 / 3,
+		TimeTakenMin: 123,
+		TimeTakenMax: 456,
+		TimeTakenAvg: 234,
+	}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("expected summary %+v, got %+v", expected, summary)
+	}
+
+	if _, err := processor.RenderSummary(summary); err != nil {
+		t.Errorf("unexpected error rendering the summary: %v", err)
+	}
+}
+
+func TestProcessLogReaderDuplicateLinesLimit(t *testing.T) {
+	lineA := "2023-10-10 12:00:00 192.168.1.1 GET /index.html - 80 - 192.168.1.100 Mozilla/5.0 200 0 0 123\n"
+	lineB := "2023-10-10 12:00:01 192.168.1.1 GET /about.html - 80 - 192.168.1.101 Mozilla/5.0 404 0 0 456\n"
+	content := parser.FIELDS_DEF + "\n" + lineA + lineA + lineB + lineB
+	outputFile := filepath.Join(t.TempDir(), "parsed_logs.txt")
+
+	// Only the first line is remembered, the duplicate of the second one goes unnoticed
+	t.Setenv("DUPLICATE_LINES_TRACKED", "1")
+	metrics, err := processor.ProcessLogReader(context.Background(), strings.NewReader(content), outputFile, 1, nil, "none", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if metrics.DuplicateLines != 1 || !metrics.DuplicateLinesApproximate {
+		t.Errorf("expected an approximate count of 1 duplicate line, got %d (approximate: %v)", metrics.DuplicateLines, metrics.DuplicateLinesApproximate)
+	}
+
+	t.Setenv("DUPLICATE_LINES_TRACKED", "0")
+	metrics, err = processor.ProcessLogReader(context.Background(), strings.NewReader(content), outputFile, 1, nil, "none", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if metrics.DuplicateLines != 0 || !metrics.DuplicateLinesApproximate {
+		t.Errorf("expected duplicate lines not to be detected, got %d (approximate: %v)", metrics.DuplicateLines, metrics.DuplicateLinesApproximate)
+	}
+}
+
+func TestLogRollupAddMerge(t *testing.T) {
+	var first, second models.LogRollup
+	first.Add(&models.LogEntry{Status: "200", TimeTaken: "5", LineSize: 90})
+	first.Add(&models.LogEntry{Status: "404", TimeTaken: "-", LineSize: 80})
+	second.Add(&models.LogEntry{Status: "503", TimeTaken: "12000", LineSize: 100})
+	first.Merge(&second)
+
+	timeTakenMin, timeTakenMax := int64(5), int64(12000)
+	expected := models.LogRollup{
+		Requests:         3,
+		Status2xx:        1,
+		Status4xx:        1,
+		Status5xx:        1,
+		LogBytes:         270,
+		TimedRequests:    2,
+		TimeTakenSum:     12005,
+		TimeTakenMin:     &timeTakenMin,
+		TimeTakenMax:     &timeTakenMax,
+		LatencyHistogram: models.LatencyHistogram{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+	}
+	if !reflect.DeepEqual(first, expected) {
+		t.Errorf("expected rollup %+v, got %+v", expected, first)
+	}
+
+	var histogram models.LatencyHistogram
+	value, _ := expected.LatencyHistogram.Value()
+	if err := histogram.Scan(value); err != nil || !reflect.DeepEqual(histogram, expected.LatencyHistogram) {
+		t.Errorf("expected histogram %v to round trip, got %v (%v)", expected.LatencyHistogram, histogram, err)
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	day := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)
+	entries := []*models.LogEntry{
+		{LogFileID: 1, LineNumber: 5, ByteOffset: 120, Timestamp: day.Add(time.Hour), Date: "2023-10-01", Time: "01:00:00", ServerIP: "10.0.0.1",
+			Method: "GET", URIStem: "/index.html", URIQuery: "-", Port: "443", Username: "-", ClientIP: "192.168.1.1", UserAgent: "Mozilla/5.0",
+			Status: "200", SubStatus: "0", Win32Status: "0", TimeTaken: "15"},
+		{LogFileID: 2, LineNumber: 1, Timestamp: day.Add(23 * time.Hour), Method: "POST", URIStem: "/api", Status: "500"},
+	}
+
+	var buf bytes.Buffer
+	writer, err := processor.NewArchiveWriter(&buf, processor.ArchiveHeader{DomainID: 3, Day: day, CreatedAt: day.Add(48 * time.Hour)})
+	if err != nil {
+		t.Fatalf("unexpected error creating the archive: %v", err)
+	}
+	for _, entry := range entries {
+		if err := writer.Write(entry); err != nil {
+			t.Fatalf("unexpected error writing an entry: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("unexpected error closing the archive: %v", err)
+	}
+	checksum := sha256.Sum256(buf.Bytes())
+	if writer.Entries() != 2 || writer.Bytes() != int64(buf.Len()) || writer.SHA256() != hex.EncodeToString(checksum[:]) {
+		t.Errorf("unexpected archive stats: %d entries, %d bytes, checksum %s", writer.Entries(), writer.Bytes(), writer.SHA256())
+	}
+
+	var read []*models.LogEntry
+	header, err := processor.ReadArchive(&buf, func(entry *models.LogEntry) error {
+		read = append(read, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error reading the archive: %v", err)
+	}
+	if header.Format != processor.ArchiveFormat || header.Version != processor.ArchiveFormatVersion || header.DomainID != 3 || !header.Day.Equal(day) {
+		t.Errorf("unexpected header %+v", header)
+	}
+	if !reflect.DeepEqual(read, entries) {
+		t.Errorf("expected entries %v, got %v", entries, read)
+	}
+}
+
+func TestCheckUploadQuotas(t *testing.T) {
+	usage := models.QuotaUsage{
+		Limits: models.QuotaLimits{MaxFileSize: 100, MaxStoredBytes: 1000, MaxEntries: 50, MaxUploadsPerDay: 3},
+		Usage:  models.Usage{StoredBytes: 850, Entries: 10, UploadsToday: 1},
+	}
+	full := usage
+	full.Usage.Entries = 50
+
+	cases := []struct {
+		name  string
+		usage models.QuotaUsage
+		sizes []int64
+		quota string
+	}{
+		{"within quotas", usage, []int64{100, 50}, ""},
+		{"unlimited", models.QuotaUsage{Usage: usage.Usage}, []int64{1 << 40, 1, 1}, ""},
+		{"file too large", usage, []int64{10, 101}, processor.QuotaMaxFileSize},
+		{"storage full", usage, []int64{100, 60}, processor.QuotaMaxStoredBytes},
+		{"entries full", full, []int64{1}, processor.QuotaMaxEntries},
+		{"too many uploads", usage, []int64{1, 1, 1}, processor.QuotaMaxUploadsPerDay},
+	}
+	for _, c := range cases {
+		err := processor.CheckUploadQuotas("user", c.usage, c.sizes)
+		var quotaErr *processor.QuotaError
+		if c.quota == "" && err != nil {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+		}
+		if c.quota != "" && (!errors.As(err, &quotaErr) || quotaErr.Quota != c.quota) {
+			t.Errorf("%s: expected the %s quota to be exceeded, got %v", c.name, c.quota, err)
+		}
+	}
+}
+
+func TestProcessLogReaderEntriesQuota(t *testing.T) {
+	dbPool, logFileId, cleanup := setupTestDB()
+	defer dbPool.Close()
+	defer cleanup()
+
+	ctx := context.Background()
+	_, err := dbPool.Exec(ctx, "UPDATE domains SET quota_max_entries = 3 WHERE id = (SELECT domain_id FROM log_files WHERE id = $1)", logFileId)
+	if err != nil {
+		t.Fatalf("failed to set quota: %v", err)
+	}
+	content := parser.FIELDS_DEF + `
+2023-10-10 12:00:00 192.168.1.1 GET /index.html - 80 - 192.168.1.100 Mozilla/5.0 200 0 0 123
+2023-10-10 12:00:01 192.168.1.1 GET /about.html - 80 - 192.168.1.101 Mozilla/5.0 404 0 0 456
+`
+	outputFile := filepath.Join(t.TempDir(), "parsed_logs.txt")
+	assertEntries := func(expected int64) {
+		t.Helper()
+		var entries int64
+		if err := dbPool.QueryRow(ctx, "SELECT entries FROM log_files WHERE id = $1", logFileId).Scan(&entries); err != nil {
+			t.Fatalf("failed to get entries: %v", err)
+		}
+		if entries != expected {
+			t.Fatalf("expected %d entries, got %d", expected, entries)
+		}
+	}
+
+	if _, err := processor.ProcessLogReader(ctx, strings.NewReader(content), outputFile, 1, dbPool, "batch", logFileId); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertEntries(2)
+
+	// The batch doesn't fit in what's left
+	_, err = processor.ProcessLogReader(ctx, strings.NewReader(content), outputFile, 1, dbPool, "batch", logFileId)
+	var quotaErr *processor.QuotaError
+	if !errors.As(err, &quotaErr) || quotaErr.Scope != "domain" || quotaErr.Quota != processor.QuotaMaxEntries || quotaErr.Limit != 3 {
+		t.Fatalf("expected the domain entries quota to be exceeded, got %v", err)
+	}
+	assertEntries(2)
+}
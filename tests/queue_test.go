@@ -0,0 +1,156 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"iis-logs-parser/models"
+	"iis-logs-parser/processor"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// queueLine returns a log line of 2005-05-05, a day no other test writes to
+func queueLine(second int) string {
+	return fmt.Sprintf("2005-05-05 12:00:%02d 192.168.1.1 GET /queue - 80 - 192.168.1.100 Mozilla/5.0 200 0 0 123\n", second)
+}
+
+// createPendingFiles creates n pending files of the domain, stored with content, and returns their ids in creation order.
+// The stored files are removed when the test ends.
+func createPendingFiles(t *testing.T, dbPool *pgxpool.Pool, domainId uint, n int, content string) []uint {
+	t.Helper()
+	ids := make([]uint, 0, n)
+	for i := 0; i < n; i++ {
+		var logFile models.LogFile
+		err := dbPool.QueryRow(context.Background(),
+			`INSERT INTO log_files (created_at, updated_at, domain_id, name, size, status) VALUES (now(), now(), $1, $2, $3, $4)
+			RETURNING id, name`,
+			domainId, fmt.Sprintf("queued-%d.log", i), len(content), models.StatusPending,
+		).Scan(&logFile.ID, &logFile.Name)
+		if err != nil {
+			t.Fatalf("failed to create log file: %v", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(logFile.StoragePath()), 0o755); err != nil {
+			t.Fatalf("failed to create storage directory: %v", err)
+		}
+		if err := os.WriteFile(logFile.StoragePath(), []byte(content), 0o644); err != nil {
+			t.Fatalf("failed to store log file: %v", err)
+		}
+		t.Cleanup(func() {
+			os.Remove(logFile.StoragePath())
+			os.Remove(logFile.StoragePath() + "_" + "parsed_logs.txt")
+		})
+		ids = append(ids, logFile.ID)
+	}
+	return ids
+}
+
+func TestConcurrentClaimsNeverShareFile(t *testing.T) {
+	dbPool, domainId, cleanup := setupTestDomain(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	ids := createPendingFiles(t, dbPool, domainId, 8, followHeader+queueLine(0)+queueLine(1)+queueLine(2))
+
+	// Two queues claim the files at the same time, each processing two at a time
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q := processor.NewQueue(dbPool, 2, 2)
+			q.ProcessPending(ctx)
+			q.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+
+	// Each claim counts an attempt, a file claimed twice would have its entries inserted twice too
+	type claimedFile struct {
+		ID       uint
+		Status   models.Status
+		Attempts int
+		Entries  int64
+	}
+	rows, err := dbPool.Query(ctx,
+		`SELECT f.id, f.status, f.attempts, (SELECT COUNT(*) FROM log_entries e WHERE e.log_file_id = f.id)
+		FROM log_files f WHERE f.id = ANY($1) ORDER BY f.id`,
+		ids,
+	)
+	if err != nil {
+		t.Fatalf("failed to get log files: %v", err)
+	}
+	files, err := pgx.CollectRows(rows, pgx.RowToStructByPos[claimedFile])
+	if err != nil {
+		t.Fatalf("failed to get log files: %v", err)
+	}
+	if len(files) != len(ids) {
+		t.Fatalf("expected %d log files, got %d", len(ids), len(files))
+	}
+	for _, f := range files {
+		if f.Status != models.StatusCompleted || f.Attempts != 1 || f.Entries != 3 {
+			t.Errorf("expected file %d to be completed after a single claim with 3 entries, got %+v", f.ID, f)
+		}
+	}
+}
+
+func TestQueueOrderTakesTurnsBetweenUsers(t *testing.T) {
+	dbPool, firstDomainId, cleanup := setupTestDomain(t)
+	defer cleanup()
+	_, secondDomainId, cleanupSecond := setupTestDomain(t)
+	defer cleanupSecond()
+	ctx := context.Background()
+
+	// The first user already has its test file processing, the second one has nothing processing
+	_, err := dbPool.Exec(ctx, "UPDATE log_files SET status = $1 WHERE domain_id = $2", models.StatusCompleted, secondDomainId)
+	if err != nil {
+		t.Fatalf("failed to update test log file: %v", err)
+	}
+	first := createPendingFiles(t, dbPool, firstDomainId, 4, followHeader+queueLine(0))
+	second := createPendingFiles(t, dbPool, secondDomainId, 2, followHeader+queueLine(0))
+
+	// The last upload of the first user is prioritized, and its third one waits for a retry
+	if _, err := dbPool.Exec(ctx, "UPDATE log_files SET priority = 1 WHERE id = $1", first[3]); err != nil {
+		t.Fatalf("failed to prioritize log file: %v", err)
+	}
+	if _, err := dbPool.Exec(ctx, "UPDATE log_files SET next_retry_at = now() + interval '1 hour' WHERE id = $1", first[2]); err != nil {
+		t.Fatalf("failed to delay log file: %v", err)
+	}
+
+	rows, err := dbPool.Query(ctx, "SELECT id, position FROM log_files_queue WHERE id = ANY($1) ORDER BY position", append(first, second...))
+	if err != nil {
+		t.Fatalf("failed to get queue: %v", err)
+	}
+	var order []uint
+	var positions []int64
+	var id uint
+	var position int64
+	_, err = pgx.ForEachRow(rows, []any{&id, &position}, func() error {
+		order = append(order, id)
+		positions = append(positions, position)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to get queue: %v", err)
+	}
+
+	// The second user goes first since the first one has a file processing, then they take turns,
+	// the prioritized file first among those of its user and before the file of the other user with the same turn
+	expected := []uint{second[0], first[3], second[1], first[0], first[1]}
+	if !reflect.DeepEqual(order, expected) {
+		t.Fatalf("expected queue order %v, got %v", expected, order)
+	}
+	// Clients are given these positions, other users' pending files may come in between
+	for i, position := range positions {
+		if position < int64(i+1) || (i > 0 && position <= positions[i-1]) {
+			t.Errorf("expected increasing positions starting at 1 or more, got %v", positions)
+			break
+		}
+	}
+}
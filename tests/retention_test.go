@@ -0,0 +1,193 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"iis-logs-parser/config"
+	"iis-logs-parser/models"
+	"iis-logs-parser/parser"
+	"iis-logs-parser/processor"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// insertRetentionEntries inserts n entries of the log file, one second apart from the start of day
+func insertRetentionEntries(t *testing.T, dbPool *pgxpool.Pool, logFileId uint, day time.Time, n int) {
+	t.Helper()
+	var sb strings.Builder
+	sb.WriteString(parser.FIELDS_DEF + "\n")
+	for i := 0; i < n; i++ {
+		timestamp := day.Add(time.Duration(i) * time.Second)
+		fmt.Fprintf(&sb, "%s 192.168.1.1 GET /retention - 80 - 192.168.1.100 Mozilla/5.0 200 0 0 123\n", timestamp.Format(time.DateTime))
+	}
+	outputFile := filepath.Join(t.TempDir(), "parsed_logs.txt")
+	if _, err := processor.ProcessLogReader(context.Background(), strings.NewReader(sb.String()), outputFile, 4, dbPool, "batch", logFileId); err != nil {
+		t.Fatalf("failed to insert entries: %v", err)
+	}
+}
+
+func setEntriesRetention(t *testing.T, dbPool *pgxpool.Pool, logFileId uint, days *int) {
+	t.Helper()
+	_, err := dbPool.Exec(context.Background(),
+		"UPDATE domains SET entries_retention_days = $1 WHERE id = (SELECT domain_id FROM log_files WHERE id = $2)", days, logFileId,
+	)
+	if err != nil {
+		t.Fatalf("failed to set retention: %v", err)
+	}
+}
+
+// fileEntriesCounter returns the entries counter of the log file, not its entries
+func fileEntriesCounter(t *testing.T, dbPool *pgxpool.Pool, logFileId uint) int64 {
+	t.Helper()
+	var entries int64
+	if err := dbPool.QueryRow(context.Background(), "SELECT entries FROM log_files WHERE id = $1", logFileId).Scan(&entries); err != nil {
+		t.Fatalf("failed to get log file: %v", err)
+	}
+	return entries
+}
+
+func setRetentionDefaults(t *testing.T, entriesDays int) {
+	t.Setenv("ENTRIES_RETENTION_DAYS", fmt.Sprint(entriesDays))
+	t.Setenv("FILES_RETENTION_DAYS", "0")
+	t.Setenv("SUMMARIES_RETENTION_DAYS", "0")
+}
+
+func TestApplyRetentionDomainOverride(t *testing.T) {
+	dbPool, defaultFileId, cleanup := setupTestDB()
+	defer dbPool.Close()
+	defer cleanup()
+	overridePool, overrideFileId, cleanupOverride := setupTestDB()
+	defer overridePool.Close()
+	defer cleanupOverride()
+	ctx := context.Background()
+
+	setRetentionDefaults(t, 30)
+	tenYears := 3650
+	setEntriesRetention(t, dbPool, overrideFileId, &tenYears)
+
+	// Past the default retention but not the override, more entries than a deletion batch, and a recent one
+	now := time.Now().UTC()
+	old := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -100)
+	oldEntries := config.RETENTION_BATCH_SIZE + 5
+	insertRetentionEntries(t, dbPool, defaultFileId, old, oldEntries)
+	insertRetentionEntries(t, dbPool, defaultFileId, old.AddDate(0, 0, 99), 1)
+	insertRetentionEntries(t, dbPool, overrideFileId, old, 1)
+
+	if err := processor.ApplyRetention(ctx, dbPool); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if count := countFileEntries(t, dbPool, defaultFileId); count != 1 {
+		t.Errorf("expected the old entries of the domain without override to be deleted, %d left", count)
+	}
+	if entries := fileEntriesCounter(t, dbPool, defaultFileId); entries != 1 {
+		t.Errorf("expected the entries of the file to be counted again, got %d", entries)
+	}
+	if count := countFileEntries(t, dbPool, overrideFileId); count != 1 {
+		t.Errorf("expected the entry of the domain with a longer retention to be kept, got %d", count)
+	}
+	if entries := fileEntriesCounter(t, dbPool, overrideFileId); entries != 1 {
+		t.Errorf("expected the entries counter of the kept file to be unchanged, got %d", entries)
+	}
+
+	// One purge recorded for the domain, with all the batches' rows
+	var purges, rows int64
+	var cutoff time.Time
+	err := dbPool.QueryRow(ctx,
+		`SELECT COUNT(*), COALESCE(SUM(rows), 0), COALESCE(MAX(cutoff), 'epoch') FROM retention_purges
+		WHERE target = $1 AND domain_id = (SELECT domain_id FROM log_files WHERE id = $2)`,
+		models.RetentionEntries, defaultFileId,
+	).Scan(&purges, &rows, &cutoff)
+	if err != nil {
+		t.Fatalf("failed to get purges: %v", err)
+	}
+	if purges != 1 || rows != int64(oldEntries) {
+		t.Errorf("expected 1 purge of %d rows, got %d purges of %d rows", oldEntries, purges, rows)
+	}
+	if expected := now.AddDate(0, 0, -30); cutoff.Sub(expected).Abs() > time.Minute {
+		t.Errorf("expected the cutoff to be 30 days ago, got %v", cutoff)
+	}
+	err = dbPool.QueryRow(ctx,
+		"SELECT COUNT(*) FROM retention_purges WHERE domain_id = (SELECT domain_id FROM log_files WHERE id = $1)", overrideFileId,
+	).Scan(&purges)
+	if err != nil {
+		t.Fatalf("failed to get purges: %v", err)
+	}
+	if purges != 0 {
+		t.Errorf("expected no purge for the domain with a longer retention, got %d", purges)
+	}
+}
+
+func TestApplyRetentionKeepForever(t *testing.T) {
+	dbPool, foreverFileId, cleanup := setupTestDB()
+	defer dbPool.Close()
+	defer cleanup()
+	defaultPool, defaultFileId, cleanupDefault := setupTestDB()
+	defer defaultPool.Close()
+	defer cleanupDefault()
+	ctx := context.Background()
+
+	setRetentionDefaults(t, 30)
+	forever := 0
+	setEntriesRetention(t, dbPool, foreverFileId, &forever)
+
+	// 2003-06-15 is a day no other test writes to
+	day := time.Date(2003, 6, 15, 0, 0, 0, 0, time.UTC)
+	insertRetentionEntries(t, dbPool, foreverFileId, day, 1)
+	insertRetentionEntries(t, dbPool, defaultFileId, day, 1)
+	var partition string
+	err := dbPool.QueryRow(ctx, "SELECT tableoid::regclass::text FROM log_entries WHERE log_file_id = $1", foreverFileId).Scan(&partition)
+	if err != nil {
+		t.Fatalf("failed to get partition: %v", err)
+	}
+	partitionExists := func() bool {
+		var exists bool
+		if err := dbPool.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", partition).Scan(&exists); err != nil {
+			t.Fatalf("failed to get partition: %v", err)
+		}
+		return exists
+	}
+
+	// A domain keeping its entries forever keeps the partition, the others' entries are deleted from it
+	if err := processor.ApplyRetention(ctx, dbPool); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !partitionExists() {
+		t.Fatalf("expected partition %s to be kept", partition)
+	}
+	if count := countFileEntries(t, dbPool, foreverFileId); count != 1 {
+		t.Errorf("expected the entry kept forever to be kept, got %d", count)
+	}
+	if count := countFileEntries(t, dbPool, defaultFileId); count != 0 {
+		t.Errorf("expected the entry of the other domain to be deleted, %d left", count)
+	}
+
+	// Once no domain keeps its entries forever, the whole partition is dropped
+	thirtyDays := 30
+	setEntriesRetention(t, dbPool, foreverFileId, &thirtyDays)
+	if err := processor.ApplyRetention(ctx, dbPool); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if partitionExists() {
+		t.Fatalf("expected partition %s to be dropped", partition)
+	}
+	if entries := fileEntriesCounter(t, dbPool, foreverFileId); entries != 0 {
+		t.Errorf("expected the entries of the file to be counted again, got %d", entries)
+	}
+
+	var domainId *uint
+	var rows int64
+	err = dbPool.QueryRow(ctx, "SELECT domain_id, rows FROM retention_purges WHERE target = $1 AND partition = $2 ORDER BY id DESC LIMIT 1", models.RetentionEntries, partition).
+		Scan(&domainId, &rows)
+	if err != nil {
+		t.Fatalf("failed to get the purge of the partition: %v", err)
+	}
+	if domainId != nil || rows != 1 {
+		t.Errorf("expected a purge of 1 row without domain, got %d rows of domain %v", rows, domainId)
+	}
+}
@@ -0,0 +1,60 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"iis-logs-parser/scheduler"
+)
+
+func TestCronNext(t *testing.T) {
+	// Thursday
+	from := time.Date(2024, time.February, 29, 10, 17, 30, 0, time.UTC)
+
+	testCases := []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2024, time.February, 29, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, time.February, 29, 10, 30, 0, 0, time.UTC)},
+		{"30 3 * * *", time.Date(2024, time.March, 1, 3, 30, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2024, time.February, 29, 13, 0, 0, 0, time.UTC)},
+		{"0 0 * * 1", time.Date(2024, time.March, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		// Either day field matches when both are restricted
+		{"0 0 13 * 5", time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.expr, func(t *testing.T) {
+			schedule, err := scheduler.ParseCron(tc.expr)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if actual := schedule.Next(from); !actual.Equal(tc.expected) {
+				t.Errorf("expected %v but got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := scheduler.ParseCron(expr); err == nil {
+			t.Errorf("expected an error for %q", expr)
+		}
+	}
+}
+
+func TestEveryNext(t *testing.T) {
+	schedule := scheduler.Every(time.Minute)
+	from := time.Date(2024, time.February, 29, 10, 17, 30, 0, time.UTC)
+	expected := time.Date(2024, time.February, 29, 10, 18, 0, 0, time.UTC)
+	if actual := schedule.Next(from); !actual.Equal(expected) {
+		t.Errorf("expected %v but got %v", expected, actual)
+	}
+	if actual := schedule.Next(expected); !actual.Equal(expected.Add(time.Minute)) {
+		t.Errorf("expected %v but got %v", expected.Add(time.Minute), actual)
+	}
+}
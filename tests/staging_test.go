@@ -0,0 +1,179 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"iis-logs-parser/models"
+	"iis-logs-parser/parser"
+	"iis-logs-parser/processor"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// stagingLog returns a log of n lines requesting uri on 2004-03-03, a day no other test writes to
+func stagingLog(uri string, n int) string {
+	var sb strings.Builder
+	sb.WriteString(parser.FIELDS_DEF + "\n")
+	for i := 0; i < n; i++ {
+		timestamp := time.Date(2004, 3, 3, 0, 0, i, 0, time.UTC)
+		fmt.Fprintf(&sb, "%s 192.168.1.1 GET %s - 80 - 192.168.1.100 Mozilla/5.0 200 0 0 123\n", timestamp.Format(time.DateTime), uri)
+	}
+	return sb.String()
+}
+
+func ingestStagingLog(t *testing.T, dbPool *pgxpool.Pool, logFileId uint, content string, dbInsertionT string) {
+	t.Helper()
+	outputFile := filepath.Join(t.TempDir(), "parsed_logs.txt")
+	if _, err := processor.ProcessLogReader(context.Background(), strings.NewReader(content), outputFile, 4, dbPool, dbInsertionT, logFileId); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// assertVisibleEntries checks the entries, the rollups and the entries counter of the log file, all requesting uri
+func assertVisibleEntries(t *testing.T, dbPool *pgxpool.Pool, logFileId uint, uri string, count int64) {
+	t.Helper()
+	ctx := context.Background()
+	rows, err := dbPool.Query(ctx, "SELECT uri_stem, COUNT(*) FROM log_entries_resolved WHERE log_file_id = $1 GROUP BY uri_stem", logFileId)
+	if err != nil {
+		t.Fatalf("failed to get entries: %v", err)
+	}
+	entries := map[string]int64{}
+	var uriStem string
+	var n int64
+	if _, err := pgx.ForEachRow(rows, []any{&uriStem, &n}, func() error { entries[uriStem] = n; return nil }); err != nil {
+		t.Fatalf("failed to get entries: %v", err)
+	}
+	if expected := map[string]int64{uri: count}; !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expected entries %v, got %v", expected, entries)
+	}
+
+	var requests, counter int64
+	err = dbPool.QueryRow(ctx,
+		`SELECT (SELECT COALESCE(SUM(requests), 0) FROM log_rollups WHERE log_file_id = $1 AND granularity = $2),
+			(SELECT entries FROM log_files WHERE id = $1)`,
+		logFileId, models.RollupDay,
+	).Scan(&requests, &counter)
+	if err != nil {
+		t.Fatalf("failed to get rollups: %v", err)
+	}
+	if requests != count || counter != count {
+		t.Errorf("expected %d requests in the rollups and %d entries counted, got %d and %d", count, count, requests, counter)
+	}
+}
+
+func assertNothingStaged(t *testing.T, dbPool *pgxpool.Pool, logFileId uint) {
+	t.Helper()
+	var entries, rollups int64
+	err := dbPool.QueryRow(context.Background(),
+		"SELECT (SELECT COUNT(*) FROM log_entries_staging WHERE log_file_id = $1), (SELECT COUNT(*) FROM log_rollups_staging WHERE log_file_id = $1)",
+		logFileId,
+	).Scan(&entries, &rollups)
+	if err != nil {
+		t.Fatalf("failed to count staged rows: %v", err)
+	}
+	if entries != 0 || rollups != 0 {
+		t.Errorf("expected nothing left staged, got %d entries and %d rollups", entries, rollups)
+	}
+}
+
+func TestReplaceStagedEntriesVisibleUntilCommit(t *testing.T) {
+	dbPool, logFileId, cleanup := setupTestDB()
+	defer dbPool.Close()
+	defer cleanup()
+	ctx := context.Background()
+
+	ingestStagingLog(t, dbPool, logFileId, stagingLog("/old", 2), "batch")
+	ingestStagingLog(t, dbPool, logFileId, stagingLog("/new", 3), "staging")
+	assertVisibleEntries(t, dbPool, logFileId, "/old", 2)
+
+	// The swap is held before it moves the staged rollups, once it has replaced the entries
+	lockTx, err := dbPool.Begin(ctx)
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %v", err)
+	}
+	defer lockTx.Rollback(ctx)
+	if _, err := lockTx.Exec(ctx, "LOCK TABLE log_rollups_staging IN ACCESS EXCLUSIVE MODE"); err != nil {
+		t.Fatalf("failed to lock staged rollups: %v", err)
+	}
+	swapped := make(chan error, 1)
+	go func() {
+		_, err := processor.ReplaceStagedEntries(ctx, dbPool, logFileId)
+		swapped <- err
+	}()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		var waiting bool
+		err := dbPool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_locks WHERE relation = 'log_rollups_staging'::regclass AND NOT granted)").Scan(&waiting)
+		if err != nil {
+			t.Fatalf("failed to get locks: %v", err)
+		}
+		if waiting {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("the swap never waited for the staged rollups")
+		}
+	}
+
+	// Readers still see the old entries and rollups until the swap commits
+	assertVisibleEntries(t, dbPool, logFileId, "/old", 2)
+	if err := lockTx.Rollback(ctx); err != nil {
+		t.Fatalf("failed to unlock staged rollups: %v", err)
+	}
+	if err := <-swapped; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assertVisibleEntries(t, dbPool, logFileId, "/new", 3)
+	assertNothingStaged(t, dbPool, logFileId)
+}
+
+func TestFailedReprocessKeepsEntries(t *testing.T) {
+	dbPool, logFileId, cleanup := setupTestDB()
+	defer dbPool.Close()
+	defer cleanup()
+	ctx := context.Background()
+
+	ingestStagingLog(t, dbPool, logFileId, stagingLog("/old", 2), "batch")
+
+	// Reprocessed from a stored file that can't be parsed past a first full batch of entries
+	var logFile models.LogFile
+	logFile.ID = logFileId
+	err := dbPool.QueryRow(ctx,
+		"UPDATE log_files SET status = $1, processed_at = now() WHERE id = $2 RETURNING name",
+		models.StatusPending, logFileId,
+	).Scan(&logFile.Name)
+	if err != nil {
+		t.Fatalf("failed to requeue log file: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(logFile.StoragePath()), 0o755); err != nil {
+		t.Fatalf("failed to create storage directory: %v", err)
+	}
+	content := stagingLog("/new", 10001) + "#Fields: date time\n" + stagingLog("/new", 1)
+	if err := os.WriteFile(logFile.StoragePath(), []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to store log file: %v", err)
+	}
+	defer os.Remove(logFile.StoragePath())
+	defer os.Remove(logFile.StoragePath() + "_" + "parsed_logs.txt")
+
+	q := processor.NewQueue(dbPool, 1, 2)
+	q.ProcessPending(ctx)
+	q.Shutdown(ctx)
+
+	var status models.Status
+	var lastError string
+	if err := dbPool.QueryRow(ctx, "SELECT status, last_error FROM log_files WHERE id = $1", logFileId).Scan(&status, &lastError); err != nil {
+		t.Fatalf("failed to get log file: %v", err)
+	}
+	if status != models.StatusFailed || lastError == "" {
+		t.Fatalf("expected the reprocess to fail, got status %s and error %q", status, lastError)
+	}
+	assertVisibleEntries(t, dbPool, logFileId, "/old", 2)
+	assertNothingStaged(t, dbPool, logFileId)
+}
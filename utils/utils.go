@@ -8,6 +8,7 @@ import (
 	"io"
 	"maps"
 	"os"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -41,8 +42,8 @@ func (sw *SyncWriter) Flush() error {
 
 func MapToTableLogMsg(mp *map[string]int64) (string, error) {
 	rows := [][]string{}
-	for k, v := range *mp {
-		rows = append(rows, []string{k, fmt.Sprintf("%v", v)})
+	for _, k := range slices.Sorted(maps.Keys(*mp)) {
+		rows = append(rows, []string{k, fmt.Sprintf("%v", (*mp)[k])})
 	}
 
 	t := tableStr.New()